@@ -72,24 +72,61 @@ func main() {
 	defer redisClient.Close()
 
 	// outbound sender
-	sender := outbound.NewHTTP(outbound.Config{
-		URL:          cfg.Outbound.URL,
-		Timeout:      cfg.Outbound.Timeout,
-		MaxRetries:   cfg.Outbound.MaxRetries,
-		ExpectStatus: cfg.Outbound.ExpectStatus,
-		AuthHeader:   cfg.Outbound.AuthHeader,
-		AuthValue:    cfg.Outbound.AuthValue,
-	}, logger)
+	sender, err := newOutboundSender(cfg.Outbound, logger)
+	if err != nil {
+		logger.Fatal("outbound sender", zap.Error(err))
+	}
+	if rl := cfg.Outbound.RateLimit; rl.Global.Rate > 0 || rl.PerRecipient.Rate > 0 {
+		var limiter outbound.Limiter = outbound.NewMemoryLimiter()
+		if rl.Backend == "redis" {
+			limiter = redisClient
+		}
+		sender = outbound.NewRateLimited(sender, limiter, outbound.RateLimitConfig{
+			Global:       outbound.Bucket{Rate: rl.Global.Rate, Burst: rl.Global.Burst},
+			PerRecipient: outbound.Bucket{Rate: rl.PerRecipient.Rate, Burst: rl.PerRecipient.Burst},
+		}, logger)
+		logger.Info("outbound rate limits enabled", zap.String("backend", rl.Backend), zap.Float64("global", rl.Global.Rate), zap.Float64("per_recipient", rl.PerRecipient.Rate))
+	}
+	// the breaker wraps the rate limiter so that the scheduler sees an open circuit
+	var breaker *outbound.Breaker
+	if cb := cfg.Outbound.CircuitBreaker; cb.Enabled {
+		breaker = outbound.NewBreaker(sender, outbound.BreakerConfig{
+			FailureThreshold: cb.FailureThreshold,
+			OpenTimeout:      cb.OpenTimeout,
+			HalfOpenMaxCalls: cb.HalfOpenMaxCalls,
+		}, logger)
+		sender = breaker
+		logger.Info("outbound circuit breaker enabled", zap.Int("failure_threshold", cb.FailureThreshold), zap.Duration("open_timeout", cb.OpenTimeout))
+	}
 
 	// scheduler
 	sched := scheduler.New(scheduler.Config{
-		Enabled:   cfg.Scheduler.Enabled,
-		Interval:  cfg.Scheduler.Interval,
-		BatchSize: cfg.Scheduler.BatchSize,
+		Enabled:       cfg.Scheduler.Enabled,
+		Interval:      cfg.Scheduler.Interval,
+		BatchSize:     cfg.Scheduler.BatchSize,
+		Mode:          scheduler.Mode(cfg.Scheduler.Mode),
+		LeaseDuration: cfg.Scheduler.LeaseDuration,
+		MaxAttempts:   cfg.Scheduler.MaxAttempts,
+		Backoff: scheduler.Backoff{
+			Initial:    cfg.Scheduler.Backoff.Initial,
+			Max:        cfg.Scheduler.Backoff.Max,
+			Multiplier: cfg.Scheduler.Backoff.Multiplier,
+			Jitter:     cfg.Scheduler.Backoff.Jitter,
+		},
+		Concurrency:    cfg.Scheduler.Concurrency,
+		SendTimeout:    cfg.Scheduler.SendTimeout,
+		Listen:         cfg.Scheduler.Listen,
+		NotifyDebounce: cfg.Scheduler.NotifyDebounce,
+		CacheTTL:       cfg.Redis.TTL,
+		LeaderElection: cfg.Scheduler.LeaderElection.Enabled,
+		ElectionRetry:  cfg.Scheduler.LeaderElection.Retry,
 	}, db, redisClient, sender, logger)
 
 	msgSvc := service.NewMessageService(db, logger, sched, sender)
-	schedSvc := service.NewScheduler(sched, logger)
+	// the supervisor runs the scheduler independently of request contexts
+	schedSvc := service.NewScheduler(scheduler.NewSupervisor(sched), db, cfg.Scheduler.StateSync, logger)
+	receiptSvc := service.NewReceiptService(db, redisClient, logger)
+	outboundSvc := service.NewOutboundService(breaker)
 
 	// HTTP server
 	srv := api.NewServer(api.ServerCfg{
@@ -98,7 +135,7 @@ func main() {
 		WriteTimeout: cfg.Server.WriteTimeout,
 		IdleTimeout:  cfg.Server.IdleTimeout,
 		IsProd:       cfg.App.Env == "prod",
-	}, msgSvc, schedSvc, logger)
+	}, msgSvc, schedSvc, receiptSvc, outboundSvc, logger)
 
 	go func() {
 		if err := srv.Start(); err != nil && err != http.ErrServerClosed {
@@ -121,3 +158,106 @@ func main() {
 		logger.Error("logger sync", zap.Error(err))
 	}
 }
+
+// newOutboundSender creates the sender of the single configured provider,
+// or a router between the providers when outbound.providers is set
+func newOutboundSender(cfg config.OutboundCfg, logger *zap.Logger) (outbound.Sender, error) {
+	if len(cfg.Providers) == 0 {
+		expect, rules, err := statusConfig(cfg.ExpectStatus, cfg.StatusRules)
+		if err != nil {
+			return nil, err
+		}
+		return outbound.NewHTTP(outbound.Config{
+			Name:              "default",
+			URL:               cfg.URL,
+			Timeout:           cfg.Timeout,
+			MaxRetries:        cfg.MaxRetries,
+			ExpectStatus:      expect,
+			StatusRules:       rules,
+			AuthHeader:        cfg.AuthHeader,
+			AuthValue:         cfg.AuthValue,
+			IdempotencyHeader: cfg.IdempotencyHeader,
+			Signing:           signingConfig(cfg.Signing, nil),
+			ContentType:       cfg.Payload.ContentType,
+			BodyTemplate:      cfg.Payload.BodyTemplate,
+			MessageIDPath:     cfg.Payload.MessageIDPath,
+			MessageIDHeader:   cfg.Payload.MessageIDHeader,
+		}, logger)
+	}
+
+	providers := make([]outbound.Provider, 0, len(cfg.Providers))
+	for _, p := range cfg.Providers {
+		payload := p.Payload
+		if payload == (config.PayloadCfg{}) {
+			payload = cfg.Payload
+		}
+		expectStatus, statusRules := p.ExpectStatus, p.StatusRules
+		if len(expectStatus) == 0 {
+			expectStatus = cfg.ExpectStatus
+		}
+		if len(statusRules) == 0 {
+			statusRules = cfg.StatusRules
+		}
+		expect, rules, err := statusConfig(expectStatus, statusRules)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", p.Name, err)
+		}
+		oc := outbound.Config{
+			Name:              p.Name,
+			URL:               p.URL,
+			Timeout:           p.Timeout,
+			MaxRetries:        cfg.MaxRetries,
+			ExpectStatus:      expect,
+			StatusRules:       rules,
+			AuthHeader:        p.AuthHeader,
+			AuthValue:         p.AuthValue,
+			IdempotencyHeader: cfg.IdempotencyHeader,
+			Signing:           signingConfig(cfg.Signing, p.SigningSecrets),
+			ContentType:       payload.ContentType,
+			BodyTemplate:      payload.BodyTemplate,
+			MessageIDPath:     payload.MessageIDPath,
+			MessageIDHeader:   payload.MessageIDHeader,
+		}
+		if oc.Timeout == 0 {
+			oc.Timeout = cfg.Timeout
+		}
+		sender, err := outbound.NewHTTP(oc, logger)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", p.Name, err)
+		}
+		providers = append(providers, outbound.Provider{
+			Name:     p.Name,
+			Sender:   sender,
+			Weight:   p.Weight,
+			Prefixes: p.Prefixes,
+		})
+		logger.Info("outbound provider configured", zap.String("name", p.Name), zap.String("url", p.URL), zap.Int("weight", p.Weight), zap.Strings("prefixes", p.Prefixes))
+	}
+	return outbound.NewRouter(providers, outbound.RoutingStrategy(cfg.Routing), logger), nil
+}
+
+// signingConfig returns the signing configuration of a provider,
+// secrets replace the shared ones when set
+func signingConfig(cfg config.SigningCfg, secrets []string) outbound.SigningConfig {
+	if len(secrets) == 0 {
+		secrets = cfg.Secrets
+	}
+	return outbound.SigningConfig{Secrets: secrets, Header: cfg.Header, TimestampHeader: cfg.TimestampHeader}
+}
+
+// statusConfig parses the expected statuses and the status rules of a provider
+func statusConfig(expect []string, rules []config.StatusRuleCfg) (outbound.StatusMatcher, []outbound.StatusRule, error) {
+	m, err := outbound.ParseStatusMatcher(expect...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("expect_status: %w", err)
+	}
+	out := make([]outbound.StatusRule, 0, len(rules))
+	for _, r := range rules {
+		rule, err := outbound.ParseStatusRule(r.Status, r.Outcome)
+		if err != nil {
+			return nil, nil, fmt.Errorf("status_rules: %w", err)
+		}
+		out = append(out, rule)
+	}
+	return m, out, nil
+}
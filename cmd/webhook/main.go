@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/hakan-sariman/insider-assessment/internal/outbound"
+
 	"github.com/google/uuid"
 )
 
@@ -20,12 +26,147 @@ type inbound struct {
 	Content string `json:"content"`
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	id := uuid.New().String()
+// receipt is the delivery report posted back to the API
+type receipt struct {
+	MessageID string    `json:"messageId"`
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// idempotencyHeader is the header the API puts our message id in
+const idempotencyHeader = "Idempotency-Key"
+
+// dlr configures delivery receipts, read from the environment:
+// WEBHOOK_DLR_URL enables them (e.g. http://api:8080/api/v1/receipts),
+// WEBHOOK_DLR_DELAY is how long after accepting a message it is reported,
+// recipients starting with WEBHOOK_DLR_UNDELIVERED_PREFIX are reported undelivered
+var dlr = struct {
+	url               string
+	delay             time.Duration
+	undeliveredPrefix string
+	client            *http.Client
+}{delay: 2 * time.Second, client: &http.Client{Timeout: 5 * time.Second}}
+
+func loadDLRConfig() {
+	dlr.url = os.Getenv("WEBHOOK_DLR_URL")
+	dlr.undeliveredPrefix = os.Getenv("WEBHOOK_DLR_UNDELIVERED_PREFIX")
+	if v := os.Getenv("WEBHOOK_DLR_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid WEBHOOK_DLR_DELAY: %v", err)
+		}
+		dlr.delay = d
+	}
+}
+
+// signing configures signature verification, read from the environment:
+// WEBHOOK_SIGNING_SECRETS (comma separated) enables it, requests without a
+// signature made with one of them, or signed more than WEBHOOK_SIGNATURE_TOLERANCE
+// ago, are rejected with 401. WEBHOOK_SIGNATURE_HEADER and
+// WEBHOOK_SIGNATURE_TIMESTAMP_HEADER name the headers
+var signing = struct {
+	secrets         []string
+	header          string
+	timestampHeader string
+	tolerance       time.Duration
+}{
+	header:          outbound.DefaultSignatureHeader,
+	timestampHeader: outbound.DefaultSignatureTimestampHeader,
+	tolerance:       outbound.DefaultSignatureTolerance,
+}
+
+func loadSigningConfig() {
+	for _, secret := range strings.Split(os.Getenv("WEBHOOK_SIGNING_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			signing.secrets = append(signing.secrets, secret)
+		}
+	}
+	if v := os.Getenv("WEBHOOK_SIGNATURE_HEADER"); v != "" {
+		signing.header = v
+	}
+	if v := os.Getenv("WEBHOOK_SIGNATURE_TIMESTAMP_HEADER"); v != "" {
+		signing.timestampHeader = v
+	}
+	if v := os.Getenv("WEBHOOK_SIGNATURE_TOLERANCE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid WEBHOOK_SIGNATURE_TOLERANCE: %v", err)
+		}
+		signing.tolerance = d
+	}
+}
+
+// verifySignature checks the signature of body when signing is enabled
+func verifySignature(r *http.Request, body []byte) error {
+	if len(signing.secrets) == 0 {
+		return nil
+	}
+	return outbound.Verify(signing.secrets, r.Header.Get(signing.header), r.Header.Get(signing.timestampHeader), body, time.Now(), signing.tolerance)
+}
 
-	limited := http.MaxBytesReader(w, r.Body, 1<<20)
+// sendReceipt reports the delivery of a message after dlr.delay
+func sendReceipt(id, to string) {
+	time.Sleep(dlr.delay)
+	rc := receipt{MessageID: id, Status: "delivered", Timestamp: time.Now().UTC()}
+	if dlr.undeliveredPrefix != "" && strings.HasPrefix(to, dlr.undeliveredPrefix) {
+		rc.Status, rc.Error = "undelivered", "absent subscriber"
+	}
+	b, err := json.Marshal(rc)
+	if err != nil {
+		log.Printf("receipt %s: marshal: %v", id, err)
+		return
+	}
+	resp, err := dlr.client.Post(dlr.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("receipt %s: post: %v", id, err)
+		return
+	}
+	_ = resp.Body.Close()
+	log.Printf("receipt %s: %s -> %d", id, rc.Status, resp.StatusCode)
+}
+
+// seen maps idempotency keys to the messageId returned for them,
+// like a real provider would to dedupe resends
+var seen = struct {
+	sync.Mutex
+	ids map[string]string
+}{ids: map[string]string{}}
+
+// messageIDFor returns the messageId already issued for key, or a new one
+func messageIDFor(key string) (id string, duplicate bool) {
+	if key == "" {
+		return uuid.New().String(), false
+	}
+	seen.Lock()
+	defer seen.Unlock()
+	if id, ok := seen.ids[key]; ok {
+		return id, true
+	}
+	id = uuid.New().String()
+	seen.ids[key] = id
+	return id, false
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	dec := json.NewDecoder(limited)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		log.Printf("read body: %v", err)
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := verifySignature(r, body); err != nil {
+		log.Printf("rejected %s %s: %v", r.Method, r.URL, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(response{Message: err.Error()})
+		return
+	}
+
+	id, duplicate := messageIDFor(r.Header.Get(idempotencyHeader))
+
+	dec := json.NewDecoder(bytes.NewReader(body))
 	dec.DisallowUnknownFields()
 	var in inbound
 	var decodeErr string
@@ -43,6 +184,8 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		To          string            `json:"to"`
 		Content     string            `json:"content"`
 		DecodeError string            `json:"decodeError,omitempty"`
+		MessageID   string            `json:"messageId"`
+		Duplicate   bool              `json:"duplicate,omitempty"`
 	}{
 		Method:      r.Method,
 		URL:         r.URL.String(),
@@ -50,17 +193,26 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		To:          strings.TrimSpace(in.To),
 		Content:     strings.TrimSpace(in.Content),
 		DecodeError: strings.TrimSpace(decodeErr),
+		MessageID:   id,
+		Duplicate:   duplicate,
 	}
 	if b, err := json.Marshal(logEntry); err == nil {
 		log.Println(string(b))
 	}
 
+	if dlr.url != "" && !duplicate && decodeErr == "" {
+		go sendReceipt(id, strings.TrimSpace(in.To))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	_ = json.NewEncoder(w).Encode(response{Message: "Accepted", MessageID: id})
 }
 
 func main() {
+	loadDLRConfig()
+	loadSigningConfig()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handler)
 
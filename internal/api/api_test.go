@@ -7,36 +7,135 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/hakan-sariman/insider-assessment/internal/model"
+	"github.com/hakan-sariman/insider-assessment/internal/outbound"
+	"github.com/hakan-sariman/insider-assessment/internal/scheduler"
 	"github.com/hakan-sariman/insider-assessment/internal/service"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
+
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 type fakeMsgSvc struct {
+	createReq  service.CreateMessageRequest
 	createResp *model.Message
 	createErr  error
+	listReq    service.ListMessagesRequest
 	listResp   []model.Message
 	listErr    error
+	getResp    *model.Message
+	getErr     error
+	gotID      string
 }
 
 func (f *fakeMsgSvc) CreateMessage(ctx context.Context, req service.CreateMessageRequest) (*model.Message, error) {
+	f.createReq = req
 	return f.createResp, f.createErr
 }
-func (f *fakeMsgSvc) ListSentMessages(ctx context.Context, limit, offset int) ([]model.Message, error) {
+func (f *fakeMsgSvc) CreateMessages(ctx context.Context, reqs []service.CreateMessageRequest) ([]service.BatchResult, error) {
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	out := make([]service.BatchResult, len(reqs))
+	for i, req := range reqs {
+		if req.Content == "" {
+			out[i].Err = errors.New("empty content")
+			continue
+		}
+		out[i].Message = &model.Message{ID: uuid.New(), To: req.To, Content: req.Content}
+	}
+	return out, nil
+}
+func (f *fakeMsgSvc) ListMessages(ctx context.Context, req service.ListMessagesRequest) ([]model.Message, error) {
+	f.listReq = req
 	return f.listResp, f.listErr
 }
+func (f *fakeMsgSvc) GetMessage(ctx context.Context, id string) (*model.Message, error) {
+	f.gotID = id
+	return f.getResp, f.getErr
+}
+func (f *fakeMsgSvc) GetMessageByProviderID(ctx context.Context, providerMessageID string) (*model.Message, error) {
+	f.gotID = providerMessageID
+	return f.getResp, f.getErr
+}
+func (f *fakeMsgSvc) CancelMessage(ctx context.Context, id string) (*model.Message, error) {
+	f.gotID = id
+	return f.getResp, f.getErr
+}
 
-type fakeSchedSvc struct{ started, stopped bool }
+func (f *fakeMsgSvc) ListDeadLetters(ctx context.Context, limit, offset int) ([]model.Message, error) {
+	return f.listResp, f.listErr
+}
+func (f *fakeMsgSvc) GetDeadLetter(ctx context.Context, id string) (*model.Message, error) {
+	f.gotID = id
+	return f.getResp, f.getErr
+}
+func (f *fakeMsgSvc) RequeueDeadLetter(ctx context.Context, id string) (*model.Message, error) {
+	f.gotID = id
+	return f.getResp, f.getErr
+}
 
-func (f *fakeSchedSvc) Start(ctx context.Context) { f.started = true }
-func (f *fakeSchedSvc) Stop(reason error)         { f.stopped = true }
+type fakeSchedSvc struct {
+	started, stopped bool
+	stateErr         error
+	leader           scheduler.LeaderInfo
+	leaderErr        error
+	status           *service.SchedulerStatus
+	statusErr        error
+	tuning           service.SchedulerTuning
+}
+
+func (f *fakeSchedSvc) Start(ctx context.Context, reason string) error {
+	f.started = f.stateErr == nil
+	return f.stateErr
+}
+func (f *fakeSchedSvc) Stop(ctx context.Context, reason string) error {
+	f.stopped = f.stateErr == nil
+	return f.stateErr
+}
+func (f *fakeSchedSvc) Restart(ctx context.Context, reason string) error { return nil }
+func (f *fakeSchedSvc) Run(ctx context.Context)                          { <-ctx.Done() }
+func (f *fakeSchedSvc) Status(ctx context.Context) (*service.SchedulerStatus, error) {
+	return f.status, f.statusErr
+}
+func (f *fakeSchedSvc) Tune(ctx context.Context, req service.SchedulerTuning) (*service.SchedulerStatus, error) {
+	f.tuning = req
+	if req.BatchSize != nil && *req.BatchSize > scheduler.MaxBatchSize {
+		return nil, service.ErrInvalidTuning
+	}
+	return &service.SchedulerStatus{}, f.statusErr
+}
+func (f *fakeSchedSvc) Leader(ctx context.Context) (scheduler.LeaderInfo, error) {
+	return f.leader, f.leaderErr
+}
+
+type fakeReceiptSvc struct {
+	req  service.ReceiptRequest
+	resp *model.Message
+	err  error
+}
+
+func (f *fakeReceiptSvc) RecordReceipt(ctx context.Context, req service.ReceiptRequest) (*model.Message, error) {
+	f.req = req
+	return f.resp, f.err
+}
 
 func newTestServer(m service.Message, s service.Scheduler) *Server {
+	return newTestServerWithReceipts(m, s, &fakeReceiptSvc{})
+}
+
+type fakeOutboundSvc struct{ snap outbound.BreakerSnapshot }
+
+func (f *fakeOutboundSvc) Circuit() outbound.BreakerSnapshot { return f.snap }
+
+func newTestServerWithReceipts(m service.Message, s service.Scheduler, rs service.Receipt) *Server {
 	cfg := ServerCfg{Port: 0, ReadTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: time.Second, IsProd: true}
-	return NewServer(cfg, m, s, zap.NewNop())
+	return NewServer(cfg, m, s, rs, &fakeOutboundSvc{snap: outbound.BreakerSnapshot{State: outbound.BreakerClosed}}, zap.NewNop())
 }
 
 func TestHealthz(t *testing.T) {
@@ -65,6 +164,72 @@ func TestCreateMessage(t *testing.T) {
 	}
 }
 
+func TestCreateMessage_SendAt(t *testing.T) {
+	fm := &fakeMsgSvc{createResp: &model.Message{To: "a", Content: "b"}}
+	s := newTestServer(fm, &fakeSchedSvc{})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/messages", strings.NewReader(`{"to":"a","content":"b","send_at":"2030-01-02T15:04:05Z"}`))
+	rr := httptest.NewRecorder()
+	s.createMessage(rr, req)
+	if rr.Code != 201 {
+		t.Fatalf("unexpected code: %d", rr.Code)
+	}
+	if fm.createReq.SendAt == nil || !fm.createReq.SendAt.Equal(time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)) {
+		t.Fatalf("send_at not passed: %v", fm.createReq.SendAt)
+	}
+}
+
+func TestCreateMessage_IdempotencyKey(t *testing.T) {
+	fm := &fakeMsgSvc{createResp: &model.Message{To: "a", Content: "b"}}
+	s := newTestServer(fm, &fakeSchedSvc{})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/messages", strings.NewReader(`{"to":"a","content":"b"}`))
+	req.Header.Set(IdempotencyKeyHeader, "key-1")
+	rr := httptest.NewRecorder()
+	s.createMessage(rr, req)
+	if rr.Code != 201 || fm.createReq.IdempotencyKey != "key-1" {
+		t.Fatalf("unexpected: %d %q", rr.Code, fm.createReq.IdempotencyKey)
+	}
+
+	fm.createErr = service.ErrIdempotencyConflict
+	rr = httptest.NewRecorder()
+	s.createMessage(rr, httptest.NewRequest(http.MethodPost, "/api/v1/messages", strings.NewReader(`{"to":"a","content":"c"}`)))
+	if rr.Code != 409 {
+		t.Fatalf("expected 409, got %d", rr.Code)
+	}
+}
+
+func TestCreateMessages_Batch(t *testing.T) {
+	s := newTestServer(&fakeMsgSvc{}, &fakeSchedSvc{})
+	body := `[{"to":"a","content":"b"},{"to":"a","content":""}]`
+	rr := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/messages:batch", strings.NewReader(body)))
+	if rr.Code != 200 {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var out []batchItemResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil || len(out) != 2 {
+		t.Fatalf("unexpected body: %v %s", err, rr.Body.String())
+	}
+	if out[0].ID == "" || out[0].Error != "" || out[1].Index != 1 || out[1].ID != "" || out[1].Error == "" {
+		t.Fatalf("unexpected results: %#v", out)
+	}
+}
+
+func TestCreateMessages_Errors(t *testing.T) {
+	s := newTestServer(&fakeMsgSvc{}, &fakeSchedSvc{})
+	rr := httptest.NewRecorder()
+	s.createMessages(rr, httptest.NewRequest(http.MethodPost, "/api/v1/messages:batch", strings.NewReader(`{"to":"a"}`)))
+	if rr.Code != 400 {
+		t.Fatalf("expected 400 for non-array body, got %d", rr.Code)
+	}
+
+	s = newTestServer(&fakeMsgSvc{createErr: errors.New("db")}, &fakeSchedSvc{})
+	rr = httptest.NewRecorder()
+	s.createMessages(rr, httptest.NewRequest(http.MethodPost, "/api/v1/messages:batch", strings.NewReader(`[{"to":"a","content":"b"}]`)))
+	if rr.Code != 500 {
+		t.Fatalf("expected 500, got %d", rr.Code)
+	}
+}
+
 func TestCreateMessage_InvalidJSON(t *testing.T) {
 	s := newTestServer(&fakeMsgSvc{}, &fakeSchedSvc{})
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/messages", strings.NewReader("{"))
@@ -96,6 +261,87 @@ func TestListMessages_Success(t *testing.T) {
 	}
 }
 
+func TestListMessages_DefaultsToSent(t *testing.T) {
+	fm := &fakeMsgSvc{}
+	s := newTestServer(fm, &fakeSchedSvc{})
+	rr := httptest.NewRecorder()
+	s.listMessages(rr, httptest.NewRequest(http.MethodGet, "/api/v1/messages", nil))
+	if rr.Code != 200 {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if len(fm.listReq.Statuses) != 1 || fm.listReq.Statuses[0] != model.StatusSent || fm.listReq.Limit != DefaultLimitListMessages {
+		t.Fatalf("unexpected request: %#v", fm.listReq)
+	}
+}
+
+func TestListMessages_Filters(t *testing.T) {
+	fm := &fakeMsgSvc{}
+	s := newTestServer(fm, &fakeSchedSvc{})
+	rr := httptest.NewRecorder()
+	s.listMessages(rr, httptest.NewRequest(http.MethodGet, "/api/v1/messages?status=unsent,failed&to=%2B90555&created_from=2024-01-01T00:00:00Z&sent_to=2024-02-01T00:00:00Z", nil))
+	if rr.Code != 200 {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	req := fm.listReq
+	if len(req.Statuses) != 2 || req.Statuses[1] != model.StatusFailed || req.To != "+90555" {
+		t.Fatalf("unexpected request: %#v", req)
+	}
+	if req.CreatedFrom == nil || req.SentTo == nil || req.CreatedTo != nil || req.SentFrom != nil {
+		t.Fatalf("unexpected time range: %#v", req)
+	}
+
+	rr = httptest.NewRecorder()
+	s.listMessages(rr, httptest.NewRequest(http.MethodGet, "/api/v1/messages?sent_from=yesterday", nil))
+	if rr.Code != 400 {
+		t.Fatalf("expected 400 for bad time, got %d", rr.Code)
+	}
+}
+
+func TestGetAndCancelMessage(t *testing.T) {
+	id := uuid.New()
+	fm := &fakeMsgSvc{getResp: &model.Message{ID: id, Status: model.StatusCancelled}}
+	s := newTestServer(fm, &fakeSchedSvc{})
+
+	rr := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/messages/"+id.String(), nil))
+	if rr.Code != 200 || fm.gotID != id.String() {
+		t.Fatalf("get: unexpected %d %q", rr.Code, fm.gotID)
+	}
+
+	rr = httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/api/v1/messages/"+id.String(), nil))
+	var out model.Message
+	_ = json.Unmarshal(rr.Body.Bytes(), &out)
+	if rr.Code != 200 || out.Status != model.StatusCancelled {
+		t.Fatalf("cancel: unexpected %d %#v", rr.Code, out)
+	}
+
+	fm.getErr = service.ErrConflict
+	rr = httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/api/v1/messages/"+id.String(), nil))
+	if rr.Code != 409 {
+		t.Fatalf("cancel: expected 409, got %d", rr.Code)
+	}
+}
+
+func TestGetMessageByProviderID(t *testing.T) {
+	fm := &fakeMsgSvc{getResp: &model.Message{ID: uuid.New(), Status: model.StatusSent}}
+	s := newTestServer(fm, &fakeSchedSvc{})
+
+	rr := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/messages/by-provider-id/prov-1", nil))
+	if rr.Code != 200 || fm.gotID != "prov-1" {
+		t.Fatalf("unexpected %d %q", rr.Code, fm.gotID)
+	}
+
+	fm.getErr = service.ErrNotFound
+	rr = httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/messages/by-provider-id/unknown", nil))
+	if rr.Code != 404 {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+}
+
 func TestListMessages_Error(t *testing.T) {
 	s := newTestServer(&fakeMsgSvc{listErr: errors.New("db")}, &fakeSchedSvc{})
 	req := httptest.NewRequest(http.MethodGet, "/api/v1/messages?limit=10&offset=0", nil)
@@ -119,4 +365,356 @@ func TestSchedulerControls(t *testing.T) {
 	if rr.Code != 200 || !fs.stopped {
 		t.Fatalf("stop failed")
 	}
+
+	fs = &fakeSchedSvc{stateErr: errors.New("db")}
+	s = newTestServer(&fakeMsgSvc{}, fs)
+	rr = httptest.NewRecorder()
+	s.stopScheduler(rr, httptest.NewRequest(http.MethodPost, "/api/v1/scheduler/stop", nil))
+	if rr.Code != 500 {
+		t.Fatalf("expected 500 when the state is not stored, got %d", rr.Code)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	id := uuid.New()
+	fm := &fakeMsgSvc{listResp: []model.Message{{ID: id, Status: model.StatusFailed}}, getResp: &model.Message{ID: id, Status: model.StatusUnsent}}
+	s := newTestServer(fm, &fakeSchedSvc{})
+
+	rr := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/dead-letters", nil))
+	if rr.Code != 200 {
+		t.Fatalf("list: expected 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/dead-letters/"+id.String()+"/requeue", nil))
+	if rr.Code != 200 || fm.gotID != id.String() {
+		t.Fatalf("requeue: unexpected %d %q", rr.Code, fm.gotID)
+	}
+}
+
+func TestDeadLetters_ErrorMapping(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{service.ErrInvalidID, 400},
+		{service.ErrNotFound, 404},
+		{service.ErrConflict, 409},
+		{errors.New("db"), 500},
+	}
+	for _, c := range cases {
+		s := newTestServer(&fakeMsgSvc{getErr: c.err}, &fakeSchedSvc{})
+		rr := httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/dead-letters/x/requeue", nil))
+		if rr.Code != c.code {
+			t.Fatalf("%v: expected %d, got %d", c.err, c.code, rr.Code)
+		}
+	}
+}
+
+func TestReceipt(t *testing.T) {
+	frs := &fakeReceiptSvc{resp: &model.Message{ID: uuid.New(), Status: model.StatusDelivered}}
+	s := newTestServerWithReceipts(&fakeMsgSvc{}, &fakeSchedSvc{}, frs)
+
+	body := `{"messageId":"prov-1","status":"delivered","timestamp":"2030-01-02T15:04:05Z"}`
+	rr := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/receipts", strings.NewReader(body)))
+	if rr.Code != 200 {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if frs.req.ProviderMessageID != "prov-1" || frs.req.Status != model.StatusDelivered || frs.req.Timestamp == nil {
+		t.Fatalf("unexpected request: %#v", frs.req)
+	}
+
+	for err, code := range map[error]int{
+		service.ErrInvalidReceipt: 400,
+		service.ErrNotFound:       404,
+		service.ErrConflict:       409,
+	} {
+		frs.err = err
+		rr = httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/receipts", strings.NewReader(body)))
+		if rr.Code != code {
+			t.Fatalf("%v: expected %d, got %d", err, code, rr.Code)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/receipts", strings.NewReader("{")))
+	if rr.Code != 400 {
+		t.Fatalf("invalid json: expected 400, got %d", rr.Code)
+	}
+}
+
+func TestGetCircuit(t *testing.T) {
+	openedAt := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	halfOpenAt := openedAt.Add(30 * time.Second)
+	cfg := ServerCfg{ReadTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: time.Second, IsProd: true}
+	out := &fakeOutboundSvc{snap: outbound.BreakerSnapshot{State: outbound.BreakerOpen, ConsecutiveFailures: 5, OpenedAt: &openedAt, HalfOpenAt: &halfOpenAt}}
+	s := NewServer(cfg, &fakeMsgSvc{}, &fakeSchedSvc{}, &fakeReceiptSvc{}, out, zap.NewNop())
+
+	rr := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/outbound/circuit", nil))
+	if rr.Code != 200 {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var got outbound.BreakerSnapshot
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.State != outbound.BreakerOpen || got.ConsecutiveFailures != 5 || got.HalfOpenAt == nil || !got.HalfOpenAt.Equal(halfOpenAt) {
+		t.Fatalf("unexpected circuit: %+v", got)
+	}
+}
+
+func TestGetSchedulerLeader(t *testing.T) {
+	fs := &fakeSchedSvc{leader: scheduler.LeaderInfo{Election: true, Leader: "api-1", Self: "api-2"}}
+	s := newTestServer(&fakeMsgSvc{}, fs)
+	rr := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/scheduler/leader", nil))
+	if rr.Code != 200 {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var got scheduler.LeaderInfo
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil || got != fs.leader {
+		t.Fatalf("unexpected leader: %+v %v", got, err)
+	}
+
+	fs.leaderErr = errors.New("db down")
+	rr = httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/scheduler/leader", nil))
+	if rr.Code != 500 {
+		t.Fatalf("expected 500, got %d", rr.Code)
+	}
+}
+
+func TestGetScheduler(t *testing.T) {
+	fs := &fakeSchedSvc{status: &service.SchedulerStatus{
+		Stats:      scheduler.Stats{Running: true, Interval: "10s", BatchSize: 2, TotalSent: 5, LastError: "boom"},
+		QueueDepth: 4,
+		Counts:     map[model.Status]int{model.StatusUnsent: 4},
+	}}
+	s := newTestServer(&fakeMsgSvc{}, fs)
+	rr := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/scheduler", nil))
+	if rr.Code != 200 {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var got map[string]any
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got["running"] != true || got["interval"] != "10s" || got["total_sent"] != float64(5) || got["queue_depth"] != float64(4) || got["last_error"] != "boom" {
+		t.Fatalf("unexpected status: %v", got)
+	}
+
+	fs.statusErr = errors.New("db down")
+	rr = httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/scheduler", nil))
+	if rr.Code != 500 {
+		t.Fatalf("expected 500, got %d", rr.Code)
+	}
+}
+
+func TestPatchScheduler(t *testing.T) {
+	fs := &fakeSchedSvc{}
+	s := newTestServer(&fakeMsgSvc{}, fs)
+	patch := func(body string) int {
+		rr := httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPatch, "/api/v1/scheduler", strings.NewReader(body)))
+		return rr.Code
+	}
+
+	if code := patch(`{"interval":"30s","batch_size":10}`); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if fs.tuning.Interval == nil || *fs.tuning.Interval != 30*time.Second || fs.tuning.BatchSize == nil || *fs.tuning.BatchSize != 10 {
+		t.Fatalf("unexpected tuning %+v", fs.tuning)
+	}
+	if code := patch(`{"interval":"30s"}`); code != 200 || fs.tuning.BatchSize != nil {
+		t.Fatalf("expected a partial update, got %d %+v", code, fs.tuning)
+	}
+
+	for _, bad := range []string{`{`, `{}`, `{"interval":"soon"}`, `{"batch_size":100000}`} {
+		if code := patch(bad); code != 400 {
+			t.Fatalf("%s: expected 400, got %d", bad, code)
+		}
+	}
+
+	fs.statusErr = errors.New("db down")
+	if code := patch(`{"batch_size":5}`); code != 500 {
+		t.Fatalf("expected 500, got %d", code)
+	}
+}
+
+// memStore backs a real scheduler and scheduler service in memory
+type memStore struct {
+	mu     sync.Mutex
+	unsent []model.Message
+	sent   int
+	state  *model.SchedulerState
+}
+
+func (m *memStore) add(msg model.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unsent = append(m.unsent, msg)
+}
+func (m *memStore) sentCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sent
+}
+func (m *memStore) FetchUnsent(ctx context.Context, owner string, n int, lease time.Duration) ([]model.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	claimed := m.unsent[:min(n, len(m.unsent))]
+	m.unsent = m.unsent[len(claimed):]
+	return claimed, nil
+}
+func (m *memStore) MarkSent(ctx context.Context, id, owner string, d model.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent++
+	return nil
+}
+func (m *memStore) IncrementAttempt(ctx context.Context, id, owner string, lastErr *string, retryIn time.Duration) error {
+	return nil
+}
+func (m *memStore) MarkFailed(ctx context.Context, id, owner string, lastErr *string) error {
+	return nil
+}
+func (m *memStore) Defer(ctx context.Context, id, owner string, retryIn time.Duration) error {
+	return nil
+}
+func (m *memStore) GetSchedulerState(ctx context.Context) (*model.SchedulerState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == nil {
+		return nil, storage.ErrNoSchedulerState
+	}
+	st := *m.state
+	return &st, nil
+}
+func (m *memStore) SetSchedulerState(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = &st
+	return &st, nil
+}
+func (m *memStore) SetSchedulerTuning(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == nil {
+		m.state = &model.SchedulerState{Running: true}
+	}
+	if st.IntervalMs > 0 {
+		m.state.IntervalMs = st.IntervalMs
+	}
+	if st.BatchSize > 0 {
+		m.state.BatchSize = st.BatchSize
+	}
+	m.state.UpdatedBy = st.UpdatedBy
+	out := *m.state
+	return &out, nil
+}
+func (m *memStore) CountByStatus(ctx context.Context) (map[model.Status]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return map[model.Status]int{model.StatusUnsent: len(m.unsent), model.StatusSent: m.sent}, nil
+}
+
+type okSender struct{}
+
+func (okSender) Send(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+	return outbound.SendResult{MessageID: "mid-" + req.ID}, nil
+}
+
+// eventually fails the test when cond does not hold within a second
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSchedulerLifecycle_RealScheduler(t *testing.T) {
+	store := &memStore{}
+	sched := scheduler.New(scheduler.Config{Enabled: true, Interval: 10 * time.Millisecond, BatchSize: 10}, store, nil, okSender{}, zap.NewNop())
+	schedSvc := service.NewScheduler(scheduler.NewSupervisor(sched), store, time.Hour, zap.NewNop())
+	s := newTestServer(&fakeMsgSvc{}, schedSvc)
+
+	runCtx, stopRun := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		schedSvc.Run(runCtx)
+	}()
+	defer func() { stopRun(); <-runDone }()
+	eventually(t, "the scheduler to start without a desired state", sched.Running)
+
+	call := func(ctx context.Context, method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)).WithContext(ctx))
+		return rr
+	}
+
+	if rr := call(context.Background(), http.MethodPost, "/api/v1/scheduler/stop", `{"reason":"maintenance"}`); rr.Code != 200 {
+		t.Fatalf("stop: %d %s", rr.Code, rr.Body.String())
+	}
+	eventually(t, "the scheduler to stop", func() bool { return !sched.Running() })
+
+	// the request context ends with the request, the scheduler must not
+	reqCtx, endRequest := context.WithCancel(context.Background())
+	if rr := call(reqCtx, http.MethodPost, "/api/v1/scheduler/start", ""); rr.Code != 200 {
+		t.Fatalf("start: %d %s", rr.Code, rr.Body.String())
+	}
+	endRequest()
+	eventually(t, "the scheduler to start", sched.Running)
+	store.add(model.Message{ID: uuid.New(), To: "+905551112233", Content: "hi"})
+	eventually(t, "the message to be sent after the start request ended", func() bool { return store.sentCount() == 1 })
+
+	if rr := call(context.Background(), http.MethodPost, "/api/v1/scheduler/restart", `{"reason":"deploy"}`); rr.Code != 200 {
+		t.Fatalf("restart: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(context.Background(), http.MethodPost, "/api/v1/scheduler/restart", `{`); rr.Code != 400 {
+		t.Fatalf("expected 400 for invalid json, got %d", rr.Code)
+	}
+
+	rr := call(context.Background(), http.MethodGet, "/api/v1/scheduler", "")
+	var st service.SchedulerStatus
+	if err := json.NewDecoder(rr.Body).Decode(&st); err != nil || rr.Code != 200 {
+		t.Fatalf("status: %d %v", rr.Code, err)
+	}
+	if !st.Running || !st.Lifecycle.Running || st.TotalSent != 1 || st.Desired == nil || st.Desired.Reason != "started by API" {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	var actions []string
+	for _, e := range st.Lifecycle.Events {
+		actions = append(actions, e.Action+": "+e.Reason)
+	}
+	want := []string{
+		"start: desired state running: no desired state set",
+		"stop: desired state stopped: maintenance",
+		"start: desired state running: started by API",
+		"restart: deploy",
+	}
+	if strings.Join(actions, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected lifecycle %v, got %v", want, actions)
+	}
+
+	// shutting the replica down stops the scheduler for good
+	stopRun()
+	<-runDone
+	if sched.Running() {
+		t.Fatalf("expected the scheduler to stop with the replica")
+	}
+	if rr := call(context.Background(), http.MethodPost, "/api/v1/scheduler/restart", ""); rr.Code != 409 {
+		t.Fatalf("expected 409 restarting a stopped scheduler, got %d", rr.Code)
+	}
 }
@@ -3,21 +3,62 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/hakan-sariman/insider-assessment/internal/model"
 	"github.com/hakan-sariman/insider-assessment/internal/service"
 
+	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
 
 type createMessageReq struct {
 	To      string `json:"to"`
 	Content string `json:"content"`
+	// SendAt is an optional RFC 3339 time to deliver the message at
+	SendAt *time.Time `json:"send_at,omitempty" example:"2030-01-02T15:04:05Z"`
+}
+
+// lifecycleReq is the optional body of the scheduler start, stop and restart requests
+type lifecycleReq struct {
+	Reason string `json:"reason,omitempty" example:"provider maintenance"`
+}
+
+// patchSchedulerReq changes the scheduler settings, unset fields are kept
+type patchSchedulerReq struct {
+	// Interval is a duration like 30s or 2m
+	Interval  *string `json:"interval,omitempty" example:"30s"`
+	BatchSize *int    `json:"batch_size,omitempty" example:"10"`
+}
+
+// batchItemResult is the per-item result of createMessages
+type batchItemResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// receiptReq is a delivery report sent by the provider
+type receiptReq struct {
+	MessageID string `json:"messageId"`
+	// Status is delivered or undelivered
+	Status string `json:"status" example:"delivered"`
+	// Timestamp is when the message was delivered or given up on (RFC 3339)
+	Timestamp *time.Time `json:"timestamp,omitempty" example:"2030-01-02T15:04:05Z"`
+	Error     string     `json:"error,omitempty"`
 }
 
 const (
 	DefaultLimitListMessages = 50
+	// MaxBatchBodyBytes limits the createMessages request body
+	MaxBatchBodyBytes = 4 << 20
+	// IdempotencyKeyHeader makes createMessage safe to retry
+	IdempotencyKeyHeader = "Idempotency-Key"
 )
 
 // healthz godoc
@@ -37,13 +78,16 @@ func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
 
 // createMessage godoc
 // @Summary Create a message
-// @Description Creates a new message to be sent by the scheduler
+// @Description Creates a new message to be sent by the scheduler, optionally scheduled for a later time with send_at.
+// @Description Requests retried with the same Idempotency-Key return the message created first.
 // @Tags Messages
 // @Accept json
 // @Produce json
+// @Param Idempotency-Key header string false "Client generated key that makes retries safe"
 // @Param request body createMessageReq true "Create message payload"
 // @Success 201 {object} model.Message
 // @Failure 400 {string} string "invalid json or validation error"
+// @Failure 409 {string} string "idempotency key already used for a different request"
 // @Router /api/v1/messages [post]
 func (s *Server) createMessage(w http.ResponseWriter, r *http.Request) {
 	s.log.Debug("createMessage API called")
@@ -54,9 +98,16 @@ func (s *Server) createMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	msg, err := s.msgSvc.CreateMessage(r.Context(), service.CreateMessageRequest{
-		To:      req.To,
-		Content: req.Content,
+		To:             req.To,
+		Content:        req.Content,
+		SendAt:         req.SendAt,
+		IdempotencyKey: r.Header.Get(IdempotencyKeyHeader),
 	})
+	if errors.Is(err, service.ErrIdempotencyConflict) {
+		s.log.Warn("createMessage: idempotency conflict", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		s.log.Error("createMessage: failed", zap.Error(err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -70,53 +121,330 @@ func (s *Server) createMessage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// createMessages godoc
+// @Summary Create messages in bulk
+// @Description Validates every message and stores the valid ones in one go.
+// @Description The response has one result per item in request order, with either the new message id or the validation error.
+// @Tags Messages
+// @Accept json
+// @Produce json
+// @Param request body []createMessageReq true "Messages to create"
+// @Success 200 {array} batchItemResult
+// @Failure 400 {string} string "invalid json or too many messages"
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/messages:batch [post]
+func (s *Server) createMessages(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("createMessages API called")
+	var reqs []createMessageReq
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBatchBodyBytes)).Decode(&reqs); err != nil {
+		s.log.Error("createMessages: invalid json", zap.Error(err))
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	svcReqs := make([]service.CreateMessageRequest, len(reqs))
+	for i, req := range reqs {
+		svcReqs[i] = service.CreateMessageRequest{To: req.To, Content: req.Content, SendAt: req.SendAt}
+	}
+	results, err := s.msgSvc.CreateMessages(r.Context(), svcReqs)
+	if errors.Is(err, service.ErrBatchTooLarge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.log.Error("createMessages: db error", zap.Error(err))
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]batchItemResult, len(results))
+	for i, res := range results {
+		out[i].Index = i
+		if res.Err != nil {
+			out[i].Error = res.Err.Error()
+			continue
+		}
+		out[i].ID = res.Message.ID.String()
+	}
+	s.log.Info("createMessages: success", zap.Int("count", len(out)))
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(out)
+	if err != nil {
+		s.log.Error("createMessages: encode error", zap.Error(err))
+	}
+}
+
 // listMessages godoc
-// @Summary List sent messages
-// @Description Returns a paginated list of sent messages
+// @Summary List messages
+// @Description Returns a paginated list of messages, sent messages unless status says otherwise
 // @Tags Messages
 // @Produce json
+// @Param status query string false "Comma separated statuses (unsent, sending, sent, failed, cancelled, delivered, undelivered)" default(sent)
+// @Param to query string false "Recipient"
+// @Param created_from query string false "Created at or after (RFC 3339)"
+// @Param created_to query string false "Created before (RFC 3339)"
+// @Param sent_from query string false "Sent at or after (RFC 3339)"
+// @Param sent_to query string false "Sent before (RFC 3339)"
 // @Param limit query int false "Max number of records" default(50)
 // @Param offset query int false "Offset for pagination" default(0)
 // @Success 200 {array} model.Message
+// @Failure 400 {string} string "invalid filter"
 // @Failure 500 {string} string "db error"
 // @Router /api/v1/messages [get]
 func (s *Server) listMessages(w http.ResponseWriter, r *http.Request) {
 	s.log.Debug("listMessages API called")
 
-	q := r.URL.Query()
-	limit, _ := strconv.Atoi(q.Get("limit"))
-	offset, _ := strconv.Atoi(q.Get("offset"))
-	if limit <= 0 {
-		limit = DefaultLimitListMessages
+	req, err := listMessagesRequest(r)
+	if err != nil {
+		s.log.Error("listMessages: invalid filter", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if offset < 0 {
-		offset = 0
+	msgs, err := s.msgSvc.ListMessages(r.Context(), req)
+	if err != nil {
+		s.writeServiceError(w, "listMessages", err)
+		return
+	}
+	s.log.Debug("listMessages: success", zap.Int("count", len(msgs)))
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(msgs)
+	if err != nil {
+		s.log.Error("listMessages: encode error", zap.Error(err))
+	}
+}
+
+// getMessage godoc
+// @Summary Get a message
+// @Description Returns a message in any status
+// @Tags Messages
+// @Produce json
+// @Param id path string true "Message ID"
+// @Success 200 {object} model.Message
+// @Failure 400 {string} string "invalid message id"
+// @Failure 404 {string} string "message not found"
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/messages/{id} [get]
+func (s *Server) getMessage(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("getMessage API called")
+	msg, err := s.msgSvc.GetMessage(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeServiceError(w, "getMessage", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		s.log.Error("getMessage: encode error", zap.Error(err))
+	}
+}
+
+// getMessageByProviderID godoc
+// @Summary Get a message by provider message id
+// @Description Returns the message the provider acknowledged with the given id
+// @Tags Messages
+// @Produce json
+// @Param providerMessageId path string true "Provider message ID"
+// @Success 200 {object} model.Message
+// @Failure 400 {string} string "invalid message id"
+// @Failure 404 {string} string "message not found"
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/messages/by-provider-id/{providerMessageId} [get]
+func (s *Server) getMessageByProviderID(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("getMessageByProviderID API called")
+	msg, err := s.msgSvc.GetMessageByProviderID(r.Context(), mux.Vars(r)["providerMessageId"])
+	if err != nil {
+		s.writeServiceError(w, "getMessageByProviderID", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		s.log.Error("getMessageByProviderID: encode error", zap.Error(err))
+	}
+}
+
+// cancelMessage godoc
+// @Summary Cancel a message
+// @Description Cancels a message that has not been picked up for sending yet
+// @Tags Messages
+// @Produce json
+// @Param id path string true "Message ID"
+// @Success 200 {object} model.Message
+// @Failure 400 {string} string "invalid message id"
+// @Failure 404 {string} string "message not found"
+// @Failure 409 {string} string "message is no longer unsent"
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/messages/{id} [delete]
+func (s *Server) cancelMessage(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("cancelMessage API called")
+	msg, err := s.msgSvc.CancelMessage(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeServiceError(w, "cancelMessage", err)
+		return
+	}
+	s.log.Info("cancelMessage: success", zap.String("id", msg.ID.String()))
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		s.log.Error("cancelMessage: encode error", zap.Error(err))
+	}
+}
+
+// receipt godoc
+// @Summary Record a delivery receipt
+// @Description Called by the provider with a delivery report for a sent message,
+// @Description the message moves to delivered or undelivered. Repeating a receipt is accepted.
+// @Tags Receipts
+// @Accept json
+// @Produce json
+// @Param request body receiptReq true "Delivery report"
+// @Success 200 {object} model.Message
+// @Failure 400 {string} string "invalid json or receipt"
+// @Failure 404 {string} string "message not found"
+// @Failure 409 {string} string "message is not sent"
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/receipts [post]
+func (s *Server) receipt(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("receipt API called")
+	var req receiptReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.log.Error("receipt: invalid json", zap.Error(err))
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
 	}
+	msg, err := s.receiptSvc.RecordReceipt(r.Context(), service.ReceiptRequest{
+		ProviderMessageID: req.MessageID,
+		Status:            model.Status(req.Status),
+		Timestamp:         req.Timestamp,
+		Error:             req.Error,
+	})
+	if err != nil {
+		s.writeServiceError(w, "receipt", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		s.log.Error("receipt: encode error", zap.Error(err))
+	}
+}
 
-	msgs, err := s.msgSvc.ListSentMessages(r.Context(), limit, offset)
+// getCircuit godoc
+// @Summary Get the outbound circuit breaker state
+// @Description Returns the state of the circuit breaker around the provider: closed, open, half-open or disabled.
+// @Description While open the scheduler leaves messages unsent without charging attempts.
+// @Tags Outbound
+// @Produce json
+// @Success 200 {object} outbound.BreakerSnapshot
+// @Router /api/v1/outbound/circuit [get]
+func (s *Server) getCircuit(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("getCircuit API called")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(s.outSvc.Circuit())
+	if err != nil {
+		s.log.Error("getCircuit: encode error", zap.Error(err))
+	}
+}
+
+// listDeadLetters godoc
+// @Summary List dead-lettered messages
+// @Description Returns a paginated list of messages that ran out of send attempts
+// @Tags DeadLetters
+// @Produce json
+// @Param limit query int false "Max number of records" default(50)
+// @Param offset query int false "Offset for pagination" default(0)
+// @Success 200 {array} model.Message
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/dead-letters [get]
+func (s *Server) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("listDeadLetters API called")
+	limit, offset := pagination(r)
+	msgs, err := s.msgSvc.ListDeadLetters(r.Context(), limit, offset)
 	if err != nil {
-		s.log.Error("listMessages: db error", zap.Error(err))
+		s.log.Error("listDeadLetters: db error", zap.Error(err))
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
-	s.log.Debug("listMessages: success", zap.Int("count", len(msgs)))
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(msgs)
 	if err != nil {
-		s.log.Error("listMessages: encode error", zap.Error(err))
+		s.log.Error("listDeadLetters: encode error", zap.Error(err))
+	}
+}
+
+// getDeadLetter godoc
+// @Summary Get a dead-lettered message
+// @Description Returns a message that ran out of send attempts, including its last error
+// @Tags DeadLetters
+// @Produce json
+// @Param id path string true "Message ID"
+// @Success 200 {object} model.Message
+// @Failure 400 {string} string "invalid message id"
+// @Failure 404 {string} string "message not found"
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/dead-letters/{id} [get]
+func (s *Server) getDeadLetter(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("getDeadLetter API called")
+	msg, err := s.msgSvc.GetDeadLetter(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeServiceError(w, "getDeadLetter", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		s.log.Error("getDeadLetter: encode error", zap.Error(err))
+	}
+}
+
+// requeueDeadLetter godoc
+// @Summary Requeue a dead-lettered message
+// @Description Moves a dead-lettered message back to unsent and resets its attempt count
+// @Tags DeadLetters
+// @Produce json
+// @Param id path string true "Message ID"
+// @Success 200 {object} model.Message
+// @Failure 400 {string} string "invalid message id"
+// @Failure 404 {string} string "message not found"
+// @Failure 409 {string} string "message is not dead-lettered"
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/dead-letters/{id}/requeue [post]
+func (s *Server) requeueDeadLetter(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("requeueDeadLetter API called")
+	msg, err := s.msgSvc.RequeueDeadLetter(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeServiceError(w, "requeueDeadLetter", err)
+		return
+	}
+	s.log.Info("requeueDeadLetter: success", zap.String("id", msg.ID.String()))
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		s.log.Error("requeueDeadLetter: encode error", zap.Error(err))
 	}
 }
 
 // startScheduler godoc
 // @Summary Start scheduler
-// @Description Starts the background scheduler that sends messages
+// @Description Starts the background scheduler that sends messages on every replica. The desired state is stored,
+// @Description replicas pick it up within scheduler.state_sync and keep it across restarts.
 // @Tags Scheduler
+// @Accept json
 // @Produce plain
+// @Param request body lifecycleReq false "Why the scheduler is started"
 // @Success 200 {string} string "scheduler started"
+// @Failure 400 {string} string "invalid json"
+// @Failure 500 {string} string "db error"
 // @Router /api/v1/scheduler/start [post]
 func (s *Server) startScheduler(w http.ResponseWriter, r *http.Request) {
 	s.log.Debug("startScheduler API called")
-	s.schedSvc.Start(r.Context())
+	reason, ok := s.lifecycleReason(w, r, "started by API")
+	if !ok {
+		return
+	}
+	if err := s.schedSvc.Start(r.Context(), reason); err != nil {
+		s.log.Error("startScheduler: state update failed", zap.Error(err))
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	_, err := w.Write([]byte("scheduler started"))
 	if err != nil {
@@ -126,17 +454,238 @@ func (s *Server) startScheduler(w http.ResponseWriter, r *http.Request) {
 
 // stopScheduler godoc
 // @Summary Stop scheduler
-// @Description Stops the background scheduler
+// @Description Stops the background scheduler on every replica. The desired state is stored,
+// @Description replicas pick it up within scheduler.state_sync and keep it across restarts.
 // @Tags Scheduler
+// @Accept json
 // @Produce plain
+// @Param request body lifecycleReq false "Why the scheduler is stopped"
 // @Success 200 {string} string "scheduler stopped"
+// @Failure 400 {string} string "invalid json"
+// @Failure 500 {string} string "db error"
 // @Router /api/v1/scheduler/stop [post]
 func (s *Server) stopScheduler(w http.ResponseWriter, r *http.Request) {
 	s.log.Debug("stopScheduler API called")
-	s.schedSvc.Stop(errors.New("scheduler stopped by API"))
+	reason, ok := s.lifecycleReason(w, r, "stopped by API")
+	if !ok {
+		return
+	}
+	if err := s.schedSvc.Stop(r.Context(), reason); err != nil {
+		s.log.Error("stopScheduler: state update failed", zap.Error(err))
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	_, err := w.Write([]byte("scheduler stopped"))
 	if err != nil {
 		s.log.Error("stopScheduler: write error", zap.Error(err))
 	}
 }
+
+// restartScheduler godoc
+// @Summary Restart scheduler
+// @Description Stops the scheduler of the replica serving the request, waiting for the sends in flight, and starts it again.
+// @Description The desired state of the other replicas is left as it is.
+// @Tags Scheduler
+// @Accept json
+// @Produce plain
+// @Param request body lifecycleReq false "Why the scheduler is restarted"
+// @Success 200 {string} string "scheduler restarted"
+// @Failure 400 {string} string "invalid json"
+// @Failure 409 {string} string "scheduler is not running on this replica"
+// @Router /api/v1/scheduler/restart [post]
+func (s *Server) restartScheduler(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("restartScheduler API called")
+	reason, ok := s.lifecycleReason(w, r, "restarted by API")
+	if !ok {
+		return
+	}
+	if err := s.schedSvc.Restart(r.Context(), reason); errors.Is(err, service.ErrSchedulerNotRunning) {
+		s.log.Warn("restartScheduler: not restarted", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		s.log.Error("restartScheduler: failed", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte("scheduler restarted"))
+	if err != nil {
+		s.log.Error("restartScheduler: write error", zap.Error(err))
+	}
+}
+
+// lifecycleReason reads the reason of a start, stop or restart request, def when
+// the request has no body. It writes the error response when it reports false.
+func (s *Server) lifecycleReason(w http.ResponseWriter, r *http.Request, def string) (string, bool) {
+	var req lifecycleReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		s.log.Error("scheduler lifecycle: invalid json", zap.Error(err))
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return "", false
+	}
+	if req.Reason == "" {
+		return def, true
+	}
+	return req.Reason, true
+}
+
+// getScheduler godoc
+// @Summary Get scheduler status
+// @Description Returns what the scheduler of the replica serving the request is doing: whether it runs, its interval and batch size,
+// @Description the results of the last batch and since the replica started, the last error, the desired state and the queue depth.
+// @Tags Scheduler
+// @Produce json
+// @Success 200 {object} service.SchedulerStatus
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/scheduler [get]
+func (s *Server) getScheduler(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("getScheduler API called")
+	st, err := s.schedSvc.Status(r.Context())
+	if err != nil {
+		s.log.Error("getScheduler: status failed", zap.Error(err))
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(st)
+	if err != nil {
+		s.log.Error("getScheduler: encode error", zap.Error(err))
+	}
+}
+
+// patchScheduler godoc
+// @Summary Change scheduler settings
+// @Description Changes the interval and batch size of the scheduler on every replica without a restart. The settings are stored
+// @Description and replace the configured ones across restarts. A running scheduler starts its next interval from now.
+// @Tags Scheduler
+// @Accept json
+// @Produce json
+// @Param request body patchSchedulerReq true "Settings to change"
+// @Success 200 {object} service.SchedulerStatus
+// @Failure 400 {string} string "invalid json or settings out of bounds"
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/scheduler [patch]
+func (s *Server) patchScheduler(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("patchScheduler API called")
+	var req patchSchedulerReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.log.Error("patchScheduler: invalid json", zap.Error(err))
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Interval == nil && req.BatchSize == nil {
+		http.Error(w, "interval or batch_size is required", http.StatusBadRequest)
+		return
+	}
+	var tuning service.SchedulerTuning
+	if req.Interval != nil {
+		d, err := time.ParseDuration(*req.Interval)
+		if err != nil {
+			http.Error(w, "invalid interval", http.StatusBadRequest)
+			return
+		}
+		tuning.Interval = &d
+	}
+	tuning.BatchSize = req.BatchSize
+	st, err := s.schedSvc.Tune(r.Context(), tuning)
+	if err != nil {
+		s.writeServiceError(w, "patchScheduler", err)
+		return
+	}
+	s.log.Info("patchScheduler: success", zap.String("interval", st.Interval), zap.Int("batch_size", st.BatchSize))
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(st)
+	if err != nil {
+		s.log.Error("patchScheduler: encode error", zap.Error(err))
+	}
+}
+
+// getSchedulerLeader godoc
+// @Summary Get the scheduler leader
+// @Description Returns which replica runs the scheduler. With leader election only the leader sends messages,
+// @Description leadership moves to another replica when the leader stops.
+// @Tags Scheduler
+// @Produce json
+// @Success 200 {object} scheduler.LeaderInfo
+// @Failure 500 {string} string "db error"
+// @Router /api/v1/scheduler/leader [get]
+func (s *Server) getSchedulerLeader(w http.ResponseWriter, r *http.Request) {
+	s.log.Debug("getSchedulerLeader API called")
+	info, err := s.schedSvc.Leader(r.Context())
+	if err != nil {
+		s.log.Error("getSchedulerLeader: leader lookup failed", zap.Error(err))
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(info)
+	if err != nil {
+		s.log.Error("getSchedulerLeader: encode error", zap.Error(err))
+	}
+}
+
+// pagination reads limit and offset query parameters
+func pagination(r *http.Request) (limit, offset int) {
+	q := r.URL.Query()
+	limit, _ = strconv.Atoi(q.Get("limit"))
+	offset, _ = strconv.Atoi(q.Get("offset"))
+	if limit <= 0 {
+		limit = DefaultLimitListMessages
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// listMessagesRequest reads the listMessages query parameters,
+// only sent messages are listed when no status is given
+func listMessagesRequest(r *http.Request) (service.ListMessagesRequest, error) {
+	q := r.URL.Query()
+	req := service.ListMessagesRequest{
+		Statuses: []model.Status{model.StatusSent},
+		To:       q.Get("to"),
+	}
+	req.Limit, req.Offset = pagination(r)
+	if v := q.Get("status"); v != "" {
+		req.Statuses = nil
+		for _, st := range strings.Split(v, ",") {
+			req.Statuses = append(req.Statuses, model.Status(strings.TrimSpace(st)))
+		}
+	}
+	for name, dst := range map[string]**time.Time{
+		"created_from": &req.CreatedFrom,
+		"created_to":   &req.CreatedTo,
+		"sent_from":    &req.SentFrom,
+		"sent_to":      &req.SentTo,
+	} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return req, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*dst = &t
+	}
+	return req, nil
+}
+
+// writeServiceError maps service errors to HTTP status codes
+func (s *Server) writeServiceError(w http.ResponseWriter, op string, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidID), errors.Is(err, service.ErrInvalidFilter), errors.Is(err, service.ErrInvalidReceipt),
+		errors.Is(err, service.ErrInvalidTuning):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, service.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, service.ErrConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		s.log.Error(op+": db error", zap.Error(err))
+		http.Error(w, "db error", http.StatusInternalServerError)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/hakan-sariman/insider-assessment/internal/service"
@@ -15,11 +16,19 @@ import (
 
 // Server is the API server
 type Server struct {
-	cfg      ServerCfg
-	msgSvc   service.Message
-	schedSvc service.Scheduler
-	log      *zap.Logger
-	http     *http.Server
+	cfg        ServerCfg
+	msgSvc     service.Message
+	schedSvc   service.Scheduler
+	receiptSvc service.Receipt
+	outSvc     service.Outbound
+	log        *zap.Logger
+	http       *http.Server
+
+	// stopSched stops the scheduler sync started by Start,
+	// schedDone is closed once it has returned
+	mtx       sync.Mutex
+	stopSched context.CancelCauseFunc
+	schedDone chan struct{}
 }
 
 // ServerCfg is the configuration for the API server
@@ -33,13 +42,15 @@ type ServerCfg struct {
 
 // NewServer creates a new API server
 // and registers the routes
-func NewServer(cfg ServerCfg, msgSvc service.Message, schedSvc service.Scheduler, log *zap.Logger) *Server {
+func NewServer(cfg ServerCfg, msgSvc service.Message, schedSvc service.Scheduler, receiptSvc service.Receipt, outSvc service.Outbound, log *zap.Logger) *Server {
 	r := mux.NewRouter()
 	s := &Server{
-		cfg:      cfg,
-		msgSvc:   msgSvc,
-		schedSvc: schedSvc,
-		log:      log,
+		cfg:        cfg,
+		msgSvc:     msgSvc,
+		schedSvc:   schedSvc,
+		receiptSvc: receiptSvc,
+		outSvc:     outSvc,
+		log:        log,
 	}
 
 	// health check
@@ -48,12 +59,31 @@ func NewServer(cfg ServerCfg, msgSvc service.Message, schedSvc service.Scheduler
 	api := r.PathPrefix("/api/v1").Subrouter()
 
 	// api/v1/scheduler
+	api.HandleFunc("/scheduler", s.getScheduler).Methods("GET")
+	api.HandleFunc("/scheduler", s.patchScheduler).Methods("PATCH")
 	api.HandleFunc("/scheduler/start", s.startScheduler).Methods("POST")
 	api.HandleFunc("/scheduler/stop", s.stopScheduler).Methods("POST")
+	api.HandleFunc("/scheduler/restart", s.restartScheduler).Methods("POST")
+	api.HandleFunc("/scheduler/leader", s.getSchedulerLeader).Methods("GET")
 
 	// api/v1/messages
 	api.HandleFunc("/messages", s.createMessage).Methods("POST")
+	api.HandleFunc("/messages:batch", s.createMessages).Methods("POST")
 	api.HandleFunc("/messages", s.listMessages).Methods("GET")
+	api.HandleFunc("/messages/by-provider-id/{providerMessageId}", s.getMessageByProviderID).Methods("GET")
+	api.HandleFunc("/messages/{id}", s.getMessage).Methods("GET")
+	api.HandleFunc("/messages/{id}", s.cancelMessage).Methods("DELETE")
+
+	// api/v1/dead-letters
+	api.HandleFunc("/dead-letters", s.listDeadLetters).Methods("GET")
+	api.HandleFunc("/dead-letters/{id}", s.getDeadLetter).Methods("GET")
+	api.HandleFunc("/dead-letters/{id}/requeue", s.requeueDeadLetter).Methods("POST")
+
+	// api/v1/receipts
+	api.HandleFunc("/receipts", s.receipt).Methods("POST")
+
+	// api/v1/outbound
+	api.HandleFunc("/outbound/circuit", s.getCircuit).Methods("GET")
 
 	// if not production, register swagger
 	if !cfg.IsProd {
@@ -72,17 +102,35 @@ func NewServer(cfg ServerCfg, msgSvc service.Message, schedSvc service.Scheduler
 }
 
 // Start starts the API server
-// and the message service
+// and keeps the scheduler in its desired state
 func (s *Server) Start() error {
 	s.log.Info("API server starting...")
-	s.schedSvc.Start(context.Background())
+	ctx, cancel := context.WithCancelCause(context.Background())
+	done := make(chan struct{})
+	s.mtx.Lock()
+	s.stopSched, s.schedDone = cancel, done
+	s.mtx.Unlock()
+	go func() {
+		defer close(done)
+		s.schedSvc.Run(ctx)
+	}()
 	s.log.Info("http server listening", zap.String("addr", s.http.Addr))
 	return s.http.ListenAndServe()
 }
 
-// Shutdown shuts down the API server
-// and the message service
+// Shutdown shuts down the API server and stops the scheduler
+// of this replica, the desired state is left as it is
 func (s *Server) Shutdown(ctx context.Context) error {
-	s.schedSvc.Stop(errors.New("server shutdown"))
+	s.mtx.Lock()
+	stop, done := s.stopSched, s.schedDone
+	s.mtx.Unlock()
+	if stop != nil {
+		stop(errors.New("server shutdown"))
+		select {
+		case <-done:
+		case <-ctx.Done():
+			s.log.Warn("scheduler did not stop before the shutdown deadline")
+		}
+	}
 	return s.http.Shutdown(ctx)
 }
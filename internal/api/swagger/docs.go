@@ -15,40 +15,649 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/api/v1/dead-letters": {
+            "get": {
+                "description": "Returns a paginated list of messages that ran out of send attempts",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "DeadLetters"
+                ],
+                "summary": "List dead-lettered messages",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "default": 50,
+                        "description": "Max number of records",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 0,
+                        "description": "Offset for pagination",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/model.Message"
+                            }
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/dead-letters/{id}": {
+            "get": {
+                "description": "Returns a message that ran out of send attempts, including its last error",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "DeadLetters"
+                ],
+                "summary": "Get a dead-lettered message",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/model.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid message id",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "message not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/dead-letters/{id}/requeue": {
+            "post": {
+                "description": "Moves a dead-lettered message back to unsent and resets its attempt count",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "DeadLetters"
+                ],
+                "summary": "Requeue a dead-lettered message",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/model.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid message id",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "message not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "message is not dead-lettered",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
         "/api/v1/messages": {
             "get": {
-                "description": "Returns a paginated list of sent messages",
+                "description": "Returns a paginated list of messages, sent messages unless status says otherwise",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "List messages",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "default": "sent",
+                        "description": "Comma separated statuses (unsent, sending, sent, failed, cancelled, delivered, undelivered)",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Recipient",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Created at or after (RFC 3339)",
+                        "name": "created_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Created before (RFC 3339)",
+                        "name": "created_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Sent at or after (RFC 3339)",
+                        "name": "sent_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Sent before (RFC 3339)",
+                        "name": "sent_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 50,
+                        "description": "Max number of records",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 0,
+                        "description": "Offset for pagination",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/model.Message"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "invalid filter",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Creates a new message to be sent by the scheduler, optionally scheduled for a later time with send_at.\nRequests retried with the same Idempotency-Key return the message created first.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Create a message",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Client generated key that makes retries safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Create message payload",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.createMessageReq"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/model.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid json or validation error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "idempotency key already used for a different request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/messages/by-provider-id/{providerMessageId}": {
+            "get": {
+                "description": "Returns the message the provider acknowledged with the given id",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Get a message by provider message id",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Provider message ID",
+                        "name": "providerMessageId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/model.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid message id",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "message not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/messages/{id}": {
+            "get": {
+                "description": "Returns a message in any status",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Get a message",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/model.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid message id",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "message not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Cancels a message that has not been picked up for sending yet",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Cancel a message",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/model.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid message id",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "message not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "message is no longer unsent",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/messages:batch": {
+            "post": {
+                "description": "Validates every message and stores the valid ones in one go.\nThe response has one result per item in request order, with either the new message id or the validation error.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Create messages in bulk",
+                "parameters": [
+                    {
+                        "description": "Messages to create",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.createMessageReq"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.batchItemResult"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "invalid json or too many messages",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/outbound/circuit": {
+            "get": {
+                "description": "Returns the state of the circuit breaker around the provider: closed, open, half-open or disabled.\nWhile open the scheduler leaves messages unsent without charging attempts.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Outbound"
+                ],
+                "summary": "Get the outbound circuit breaker state",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/outbound.BreakerSnapshot"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/receipts": {
+            "post": {
+                "description": "Called by the provider with a delivery report for a sent message,\nthe message moves to delivered or undelivered. Repeating a receipt is accepted.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Receipts"
+                ],
+                "summary": "Record a delivery receipt",
+                "parameters": [
+                    {
+                        "description": "Delivery report",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.receiptReq"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/model.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid json or receipt",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "message not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "message is not sent",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/scheduler": {
+            "get": {
+                "description": "Returns what the scheduler of the replica serving the request is doing: whether it runs, its interval and batch size,\nthe results of the last batch and since the replica started, the last error, the desired state and the queue depth.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Scheduler"
+                ],
+                "summary": "Get scheduler status",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/service.SchedulerStatus"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "description": "Changes the interval and batch size of the scheduler on every replica without a restart. The settings are stored\nand replace the configured ones across restarts. A running scheduler starts its next interval from now.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Scheduler"
+                ],
+                "summary": "Change scheduler settings",
+                "parameters": [
+                    {
+                        "description": "Settings to change",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.patchSchedulerReq"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/service.SchedulerStatus"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid json or settings out of bounds",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/scheduler/leader": {
+            "get": {
+                "description": "Returns which replica runs the scheduler. With leader election only the leader sends messages,\nleadership moves to another replica when the leader stops.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "Messages"
-                ],
-                "summary": "List sent messages",
-                "parameters": [
-                    {
-                        "type": "integer",
-                        "default": 50,
-                        "description": "Max number of records",
-                        "name": "limit",
-                        "in": "query"
-                    },
-                    {
-                        "type": "integer",
-                        "default": 0,
-                        "description": "Offset for pagination",
-                        "name": "offset",
-                        "in": "query"
-                    }
+                    "Scheduler"
                 ],
+                "summary": "Get the scheduler leader",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/model.Message"
-                            }
+                            "$ref": "#/definitions/scheduler.LeaderInfo"
                         }
                     },
                     "500": {
@@ -58,39 +667,46 @@ const docTemplate = `{
                         }
                     }
                 }
-            },
+            }
+        },
+        "/api/v1/scheduler/restart": {
             "post": {
-                "description": "Creates a new message to be sent by the scheduler",
+                "description": "Stops the scheduler of the replica serving the request, waiting for the sends in flight, and starts it again.\nThe desired state of the other replicas is left as it is.",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
-                    "application/json"
+                    "text/plain"
                 ],
                 "tags": [
-                    "Messages"
+                    "Scheduler"
                 ],
-                "summary": "Create a message",
+                "summary": "Restart scheduler",
                 "parameters": [
                     {
-                        "description": "Create message payload",
+                        "description": "Why the scheduler is restarted",
                         "name": "request",
                         "in": "body",
-                        "required": true,
                         "schema": {
-                            "$ref": "#/definitions/api.createMessageReq"
+                            "$ref": "#/definitions/api.lifecycleReq"
                         }
                     }
                 ],
                 "responses": {
-                    "201": {
-                        "description": "Created",
+                    "200": {
+                        "description": "scheduler restarted",
                         "schema": {
-                            "$ref": "#/definitions/model.Message"
+                            "type": "string"
                         }
                     },
                     "400": {
-                        "description": "invalid json or validation error",
+                        "description": "invalid json",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "scheduler is not running on this replica",
                         "schema": {
                             "type": "string"
                         }
@@ -100,7 +716,10 @@ const docTemplate = `{
         },
         "/api/v1/scheduler/start": {
             "post": {
-                "description": "Starts the background scheduler that sends messages",
+                "description": "Starts the background scheduler that sends messages on every replica. The desired state is stored,\nreplicas pick it up within scheduler.state_sync and keep it across restarts.",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "text/plain"
                 ],
@@ -108,19 +727,44 @@ const docTemplate = `{
                     "Scheduler"
                 ],
                 "summary": "Start scheduler",
+                "parameters": [
+                    {
+                        "description": "Why the scheduler is started",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/api.lifecycleReq"
+                        }
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "scheduler started",
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "400": {
+                        "description": "invalid json",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
             }
         },
         "/api/v1/scheduler/stop": {
             "post": {
-                "description": "Stops the background scheduler",
+                "description": "Stops the background scheduler on every replica. The desired state is stored,\nreplicas pick it up within scheduler.state_sync and keep it across restarts.",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "text/plain"
                 ],
@@ -128,12 +772,34 @@ const docTemplate = `{
                     "Scheduler"
                 ],
                 "summary": "Stop scheduler",
+                "parameters": [
+                    {
+                        "description": "Why the scheduler is stopped",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/api.lifecycleReq"
+                        }
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "scheduler stopped",
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "400": {
+                        "description": "invalid json",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "db error",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
             }
@@ -160,17 +826,80 @@ const docTemplate = `{
         }
     },
     "definitions": {
+        "api.batchItemResult": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "index": {
+                    "type": "integer"
+                }
+            }
+        },
         "api.createMessageReq": {
             "type": "object",
             "properties": {
                 "content": {
                     "type": "string"
                 },
+                "send_at": {
+                    "description": "SendAt is an optional RFC 3339 time to deliver the message at",
+                    "type": "string",
+                    "example": "2030-01-02T15:04:05Z"
+                },
                 "to": {
                     "type": "string"
                 }
             }
         },
+        "api.lifecycleReq": {
+            "type": "object",
+            "properties": {
+                "reason": {
+                    "type": "string",
+                    "example": "provider maintenance"
+                }
+            }
+        },
+        "api.patchSchedulerReq": {
+            "type": "object",
+            "properties": {
+                "batch_size": {
+                    "type": "integer",
+                    "example": 10
+                },
+                "interval": {
+                    "description": "Interval is a duration like 30s or 2m",
+                    "type": "string",
+                    "example": "30s"
+                }
+            }
+        },
+        "api.receiptReq": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "messageId": {
+                    "type": "string"
+                },
+                "status": {
+                    "description": "Status is delivered or undelivered",
+                    "type": "string",
+                    "example": "delivered"
+                },
+                "timestamp": {
+                    "description": "Timestamp is when the message was delivered or given up on (RFC 3339)",
+                    "type": "string",
+                    "example": "2030-01-02T15:04:05Z"
+                }
+            }
+        },
         "model.Message": {
             "type": "object",
             "properties": {
@@ -183,15 +912,42 @@ const docTemplate = `{
                 "created_at": {
                     "type": "string"
                 },
+                "delivered_at": {
+                    "type": "string"
+                },
                 "id": {
                     "type": "string"
                 },
                 "last_error": {
                     "type": "string"
                 },
+                "lease_expires_at": {
+                    "type": "string"
+                },
+                "lease_owner": {
+                    "type": "string"
+                },
+                "next_attempt_at": {
+                    "type": "string"
+                },
+                "provider": {
+                    "type": "string"
+                },
+                "provider_latency_ms": {
+                    "type": "integer"
+                },
                 "provider_message_id": {
                     "type": "string"
                 },
+                "provider_status": {
+                    "type": "integer"
+                },
+                "receipt_at": {
+                    "type": "string"
+                },
+                "send_at": {
+                    "type": "string"
+                },
                 "sent_at": {
                     "type": "string"
                 },
@@ -206,16 +962,231 @@ const docTemplate = `{
                 }
             }
         },
+        "model.SchedulerState": {
+            "type": "object",
+            "properties": {
+                "batch_size": {
+                    "type": "integer"
+                },
+                "interval_ms": {
+                    "description": "IntervalMs and BatchSize replace the configured values when set",
+                    "type": "integer"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "running": {
+                    "type": "boolean"
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "updated_by": {
+                    "description": "UpdatedBy is the id of the replica that set the state",
+                    "type": "string"
+                }
+            }
+        },
         "model.Status": {
             "type": "string",
             "enum": [
                 "unsent",
-                "sent"
+                "sending",
+                "sent",
+                "failed",
+                "cancelled",
+                "delivered",
+                "undelivered"
             ],
             "x-enum-varnames": [
                 "StatusUnsent",
-                "StatusSent"
+                "StatusSending",
+                "StatusSent",
+                "StatusFailed",
+                "StatusCancelled",
+                "StatusDelivered",
+                "StatusUndelivered"
+            ]
+        },
+        "outbound.BreakerSnapshot": {
+            "type": "object",
+            "properties": {
+                "consecutive_failures": {
+                    "type": "integer"
+                },
+                "half_open_at": {
+                    "description": "HalfOpenAt is when an open circuit starts letting probes through",
+                    "type": "string"
+                },
+                "last_error": {
+                    "type": "string"
+                },
+                "opened_at": {
+                    "type": "string"
+                },
+                "state": {
+                    "$ref": "#/definitions/outbound.BreakerState"
+                }
+            }
+        },
+        "outbound.BreakerState": {
+            "type": "string",
+            "enum": [
+                "closed",
+                "open",
+                "half-open",
+                "disabled"
+            ],
+            "x-enum-varnames": [
+                "BreakerClosed",
+                "BreakerOpen",
+                "BreakerHalfOpen",
+                "BreakerDisabled"
+            ]
+        },
+        "scheduler.LeaderInfo": {
+            "type": "object",
+            "properties": {
+                "election": {
+                    "description": "Election is false when every replica runs its scheduler",
+                    "type": "boolean"
+                },
+                "is_leader": {
+                    "type": "boolean"
+                },
+                "leader": {
+                    "description": "Leader is the id of the replica running the scheduler",
+                    "type": "string"
+                },
+                "self": {
+                    "description": "Self is the id of this replica",
+                    "type": "string"
+                }
+            }
+        },
+        "scheduler.Lifecycle": {
+            "type": "object",
+            "properties": {
+                "closed": {
+                    "description": "Closed is set once the supervisor is closed, the scheduler does not start again",
+                    "type": "boolean"
+                },
+                "events": {
+                    "description": "Events are the latest starts, stops and restarts, oldest first",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/scheduler.LifecycleEvent"
+                    }
+                },
+                "running": {
+                    "type": "boolean"
+                },
+                "since": {
+                    "description": "Since is when the scheduler was last started or stopped",
+                    "type": "string"
+                }
+            }
+        },
+        "scheduler.LifecycleEvent": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "at": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "scheduler.Mode": {
+            "type": "string",
+            "enum": [
+                "tick",
+                "drain"
+            ],
+            "x-enum-varnames": [
+                "ModeTick",
+                "ModeDrain"
             ]
+        },
+        "service.SchedulerStatus": {
+            "type": "object",
+            "properties": {
+                "batch_size": {
+                    "type": "integer"
+                },
+                "counts": {
+                    "description": "Counts is the number of messages by status",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                },
+                "desired": {
+                    "description": "Desired is the running state replicas converge on, unset until it is first set",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/model.SchedulerState"
+                        }
+                    ]
+                },
+                "enabled": {
+                    "type": "boolean"
+                },
+                "interval": {
+                    "type": "string"
+                },
+                "last_error": {
+                    "type": "string"
+                },
+                "last_error_at": {
+                    "type": "string"
+                },
+                "last_tick_at": {
+                    "description": "LastTickAt is when the last batch started, including batches\nskipped because this replica is not the leader or the circuit is open",
+                    "type": "string"
+                },
+                "last_tick_duration_ms": {
+                    "type": "integer"
+                },
+                "last_tick_failed": {
+                    "type": "integer"
+                },
+                "last_tick_sent": {
+                    "description": "LastTickSent and LastTickFailed count the sends of the last batch\nthe provider accepted and the ones that failed",
+                    "type": "integer"
+                },
+                "lifecycle": {
+                    "description": "Lifecycle has the latest starts, stops and restarts of this replica's scheduler",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/scheduler.Lifecycle"
+                        }
+                    ]
+                },
+                "mode": {
+                    "$ref": "#/definitions/scheduler.Mode"
+                },
+                "queue_depth": {
+                    "description": "QueueDepth is the number of unsent messages",
+                    "type": "integer"
+                },
+                "running": {
+                    "type": "boolean"
+                },
+                "self": {
+                    "type": "string"
+                },
+                "total_failed": {
+                    "type": "integer"
+                },
+                "total_sent": {
+                    "type": "integer"
+                }
+            }
         }
     }
 }`
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -18,8 +19,56 @@ func NewRedis(addr string, db int) *Redis {
 // Close closes the Redis client
 func (r *Redis) Close() error { return r.c.Close() }
 
-// SetSent sets the sent timestamp for the provided key
-// Caller should pass the full key (e.g., "message:<id>")
-func (r *Redis) SetSent(ctx context.Context, key string, sentAt time.Time, ttl time.Duration) error {
-	return r.c.Set(ctx, key, sentAt.UTC().Format(time.RFC3339Nano), ttl).Err()
+// MessageKey is the key of a sent message, by the provider's message id
+func MessageKey(providerMessageID string) string {
+	return "message:" + providerMessageID
+}
+
+// SetMessageID stores our message id for the provided key
+// Caller should pass the full key (e.g., MessageKey(providerMessageID))
+func (r *Redis) SetMessageID(ctx context.Context, key, messageID string, ttl time.Duration) error {
+	return r.c.Set(ctx, key, messageID, ttl).Err()
+}
+
+// GetMessageID returns the message id stored for the provided key,
+// empty if there is none
+func (r *Redis) GetMessageID(ctx context.Context, key string) (string, error) {
+	id, err := r.c.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return id, err
+}
+
+// takeTokenScript refills the token bucket in KEYS[1] at ARGV[1] tokens per
+// second up to ARGV[2] using the Redis clock, then takes a token.
+// It returns 0 when a token was taken, otherwise milliseconds until one is available.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return wait
+`)
+
+// TakeToken takes a token from the bucket shared by every replica under key,
+// it returns zero when a token was taken and otherwise how long until one is available
+func (r *Redis) TakeToken(ctx context.Context, key string, rate float64, burst int) (time.Duration, error) {
+	ms, err := takeTokenScript.Run(ctx, r.c, []string{key}, rate, burst).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
 }
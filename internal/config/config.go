@@ -28,17 +28,101 @@ type (
 		TTL  time.Duration `mapstructure:"ttl"`
 	}
 	SchedulerCfg struct {
-		Enabled   bool          `mapstructure:"enabled"`
-		Interval  time.Duration `mapstructure:"interval"`
-		BatchSize int           `mapstructure:"batch_size"`
+		Enabled        bool          `mapstructure:"enabled"`
+		Interval       time.Duration `mapstructure:"interval"`
+		BatchSize      int           `mapstructure:"batch_size"`
+		Mode           string        `mapstructure:"mode"`
+		LeaseDuration  time.Duration `mapstructure:"lease_duration"`
+		MaxAttempts    int           `mapstructure:"max_attempts"`
+		Backoff        BackoffCfg    `mapstructure:"backoff"`
+		Concurrency    int           `mapstructure:"concurrency"`
+		SendTimeout    time.Duration `mapstructure:"send_timeout"`
+		Listen         bool          `mapstructure:"listen"`
+		NotifyDebounce time.Duration `mapstructure:"notify_debounce"`
+		LeaderElection ElectionCfg   `mapstructure:"leader_election"`
+		// StateSync is how often the desired running state is read from Postgres
+		StateSync time.Duration `mapstructure:"state_sync"`
+	}
+	ElectionCfg struct {
+		Enabled bool          `mapstructure:"enabled"`
+		Retry   time.Duration `mapstructure:"retry"`
+	}
+	BackoffCfg struct {
+		Initial    time.Duration `mapstructure:"initial"`
+		Max        time.Duration `mapstructure:"max"`
+		Multiplier float64       `mapstructure:"multiplier"`
+		Jitter     float64       `mapstructure:"jitter"`
 	}
 	OutboundCfg struct {
-		URL          string        `mapstructure:"url"`
-		Timeout      time.Duration `mapstructure:"timeout"`
-		MaxRetries   int           `mapstructure:"max_retries"`
-		ExpectStatus int           `mapstructure:"expect_status"`
-		AuthHeader   string        `mapstructure:"auth_header"`
-		AuthValue    string        `mapstructure:"auth_value"`
+		URL        string        `mapstructure:"url"`
+		Timeout    time.Duration `mapstructure:"timeout"`
+		MaxRetries int           `mapstructure:"max_retries"`
+		// ExpectStatus lists the statuses of accepted messages: codes,
+		// ranges like 200-204 and classes like 2xx
+		ExpectStatus      []string        `mapstructure:"expect_status"`
+		StatusRules       []StatusRuleCfg `mapstructure:"status_rules"`
+		AuthHeader        string          `mapstructure:"auth_header"`
+		AuthValue         string          `mapstructure:"auth_value"`
+		IdempotencyHeader string          `mapstructure:"idempotency_header"`
+		RateLimit         RateLimitCfg    `mapstructure:"rate_limit"`
+		CircuitBreaker    BreakerCfg      `mapstructure:"circuit_breaker"`
+		Signing           SigningCfg      `mapstructure:"signing"`
+		Payload           PayloadCfg      `mapstructure:"payload"`
+		// Routing is weighted or failover, used when Providers is set
+		Routing string `mapstructure:"routing"`
+		// Providers replaces the single provider above, unset fields
+		// fall back to the values above
+		Providers []ProviderCfg `mapstructure:"providers"`
+	}
+	ProviderCfg struct {
+		Name         string          `mapstructure:"name"`
+		URL          string          `mapstructure:"url"`
+		Timeout      time.Duration   `mapstructure:"timeout"`
+		ExpectStatus []string        `mapstructure:"expect_status"`
+		StatusRules  []StatusRuleCfg `mapstructure:"status_rules"`
+		AuthHeader   string          `mapstructure:"auth_header"`
+		AuthValue    string          `mapstructure:"auth_value"`
+		Weight       int             `mapstructure:"weight"`
+		Prefixes     []string        `mapstructure:"prefixes"`
+		// SigningSecrets replaces signing.secrets for this provider
+		SigningSecrets []string `mapstructure:"signing_secrets"`
+		// Payload replaces outbound.payload for this provider when set
+		Payload PayloadCfg `mapstructure:"payload"`
+	}
+	StatusRuleCfg struct {
+		Status string `mapstructure:"status"`
+		// Outcome is success, retry, permanent or rate_limited
+		Outcome string `mapstructure:"outcome"`
+	}
+	PayloadCfg struct {
+		ContentType string `mapstructure:"content_type"`
+		// BodyTemplate is a text/template of the request body with .ID, .To and .Content
+		BodyTemplate    string `mapstructure:"body_template"`
+		MessageIDPath   string `mapstructure:"message_id_path"`
+		MessageIDHeader string `mapstructure:"message_id_header"`
+	}
+	SigningCfg struct {
+		// Secrets sign request bodies with HMAC-SHA256, empty disables signing;
+		// list the new secret next to the old one while rotating
+		Secrets         []string `mapstructure:"secrets"`
+		Header          string   `mapstructure:"header"`
+		TimestampHeader string   `mapstructure:"timestamp_header"`
+	}
+	BreakerCfg struct {
+		Enabled          bool          `mapstructure:"enabled"`
+		FailureThreshold int           `mapstructure:"failure_threshold"`
+		OpenTimeout      time.Duration `mapstructure:"open_timeout"`
+		HalfOpenMaxCalls int           `mapstructure:"half_open_max_calls"`
+	}
+	RateLimitCfg struct {
+		// Backend is memory (per replica) or redis (shared by replicas)
+		Backend      string    `mapstructure:"backend"`
+		Global       BucketCfg `mapstructure:"global"`
+		PerRecipient BucketCfg `mapstructure:"per_recipient"`
+	}
+	BucketCfg struct {
+		Rate  float64 `mapstructure:"rate"`
+		Burst int     `mapstructure:"burst"`
 	}
 	Config struct {
 		App       AppCfg       `mapstructure:"app"`
@@ -76,9 +160,32 @@ func Load() (*Config, error) {
 	v.SetDefault("scheduler.enabled", true)
 	v.SetDefault("scheduler.interval", "2m")
 	v.SetDefault("scheduler.batch_size", 2)
+	v.SetDefault("scheduler.mode", "tick")
+	v.SetDefault("scheduler.lease_duration", "1m")
+	v.SetDefault("scheduler.max_attempts", 5)
+	v.SetDefault("scheduler.backoff.initial", "10s")
+	v.SetDefault("scheduler.backoff.max", "10m")
+	v.SetDefault("scheduler.backoff.multiplier", 2)
+	v.SetDefault("scheduler.backoff.jitter", 0.2)
+	v.SetDefault("scheduler.concurrency", 4)
+	v.SetDefault("scheduler.listen", true)
+	v.SetDefault("scheduler.notify_debounce", "100ms")
+	v.SetDefault("scheduler.leader_election.enabled", false)
+	v.SetDefault("scheduler.leader_election.retry", "5s")
+	v.SetDefault("scheduler.state_sync", "10s")
 	v.SetDefault("outbound.timeout", "5s")
 	v.SetDefault("outbound.max_retries", 3)
-	v.SetDefault("outbound.expect_status", 202)
+	v.SetDefault("outbound.expect_status", []string{"202"})
+	v.SetDefault("outbound.idempotency_header", "Idempotency-Key")
+	v.SetDefault("outbound.rate_limit.backend", "memory")
+	v.SetDefault("outbound.routing", "weighted")
+	v.SetDefault("outbound.signing.secrets", []string{})
+	v.SetDefault("outbound.signing.header", "X-Signature")
+	v.SetDefault("outbound.signing.timestamp_header", "X-Signature-Timestamp")
+	v.SetDefault("outbound.circuit_breaker.enabled", true)
+	v.SetDefault("outbound.circuit_breaker.failure_threshold", 5)
+	v.SetDefault("outbound.circuit_breaker.open_timeout", "30s")
+	v.SetDefault("outbound.circuit_breaker.half_open_max_calls", 1)
 
 	if err := v.ReadInConfig(); err != nil {
 		// continue with env/defaults
@@ -11,10 +11,37 @@ import (
 type Status string
 
 const (
-	StatusUnsent Status = "unsent"
-	StatusSent   Status = "sent"
+	StatusUnsent  Status = "unsent"
+	StatusSending Status = "sending"
+	StatusSent    Status = "sent"
+	// StatusFailed is the dead-letter status of messages that ran out of attempts
+	StatusFailed Status = "failed"
+	// StatusCancelled is the status of messages cancelled before they were sent
+	StatusCancelled Status = "cancelled"
+	// StatusDelivered is the status of sent messages the provider reported as delivered
+	StatusDelivered Status = "delivered"
+	// StatusUndelivered is the status of sent messages the provider could not deliver
+	StatusUndelivered Status = "undelivered"
 )
 
+// Statuses lists every message status
+var Statuses = []Status{StatusUnsent, StatusSending, StatusSent, StatusFailed, StatusCancelled, StatusDelivered, StatusUndelivered}
+
+// Sent reports whether s is the status of a message the provider accepted
+func (s Status) Sent() bool {
+	return s == StatusSent || s == StatusDelivered || s == StatusUndelivered
+}
+
+// Valid reports whether s is a known status
+func (s Status) Valid() bool {
+	for _, st := range Statuses {
+		if s == st {
+			return true
+		}
+	}
+	return false
+}
+
 const (
 	// MaxContentLength is the maximum length of a message content
 	MaxContentLength = 140
@@ -26,12 +53,31 @@ type Message struct {
 	To                string     `json:"to"`
 	Content           string     `json:"content"`
 	Status            Status     `json:"status"`
+	Provider          *string    `json:"provider,omitempty"`
 	ProviderMessageID *string    `json:"provider_message_id,omitempty"`
+	ProviderStatus    *int       `json:"provider_status,omitempty"`
+	ProviderLatencyMs *int       `json:"provider_latency_ms,omitempty"`
 	AttemptCount      int        `json:"attempt_count"`
+	SendAt            *time.Time `json:"send_at,omitempty"`
+	NextAttemptAt     time.Time  `json:"next_attempt_at"`
 	CreatedAt         time.Time  `json:"created_at"`
 	UpdatedAt         time.Time  `json:"updated_at"`
 	SentAt            *time.Time `json:"sent_at,omitempty"`
+	DeliveredAt       *time.Time `json:"delivered_at,omitempty"`
+	ReceiptAt         *time.Time `json:"receipt_at,omitempty"`
 	LastError         *string    `json:"last_error,omitempty"`
+	LeaseOwner        *string    `json:"lease_owner,omitempty"`
+	LeaseExpiresAt    *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+// Delivery is what the provider answered when a message was sent
+type Delivery struct {
+	// Provider is the name of the provider the message was sent through
+	Provider          string
+	ProviderMessageID string
+	ProviderStatus    int
+	ProviderLatency   time.Duration
+	SentAt            time.Time
 }
 
 // NewMessage creates a new message
@@ -42,12 +88,23 @@ func NewMessage(to, content string) (*Message, error) {
 	id := uuid.New()
 	now := time.Now().UTC()
 	return &Message{
-		ID:           id,
-		To:           to,
-		Content:      content,
-		Status:       StatusUnsent,
-		AttemptCount: 0,
-		CreatedAt:    now,
-		UpdatedAt:    now,
+		ID:            id,
+		To:            to,
+		Content:       content,
+		Status:        StatusUnsent,
+		AttemptCount:  0,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
 	}, nil
 }
+
+// ScheduleAt sets the requested delivery time of the message,
+// it will not be sent before sendAt
+func (m *Message) ScheduleAt(sendAt time.Time) {
+	sendAt = sendAt.UTC()
+	m.SendAt = &sendAt
+	if sendAt.After(m.NextAttemptAt) {
+		m.NextAttemptAt = sendAt
+	}
+}
@@ -1,6 +1,9 @@
 package model
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestNewMessage_Validation(t *testing.T) {
 	long := make([]byte, 141)
@@ -12,3 +15,19 @@ func TestNewMessage_Validation(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+func TestMessage_ScheduleAt(t *testing.T) {
+	m, _ := NewMessage("+905551112233", "ok")
+	created := m.NextAttemptAt
+
+	m.ScheduleAt(created.Add(-time.Hour))
+	if m.SendAt == nil || !m.NextAttemptAt.Equal(created) {
+		t.Fatalf("past send_at must be due immediately, got %v", m.NextAttemptAt)
+	}
+
+	future := created.Add(time.Hour)
+	m.ScheduleAt(future)
+	if !m.SendAt.Equal(future) || !m.NextAttemptAt.Equal(future) {
+		t.Fatalf("expected due at %v, got %v", future, m.NextAttemptAt)
+	}
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// SchedulerState is the desired running state of the scheduler shared by all replicas
+type SchedulerState struct {
+	Running bool   `json:"running"`
+	Reason  string `json:"reason,omitempty"`
+	// IntervalMs and BatchSize replace the configured values when set
+	IntervalMs int64 `json:"interval_ms,omitempty"`
+	BatchSize  int   `json:"batch_size,omitempty"`
+	// UpdatedBy is the id of the replica that set the state
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,185 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets every message through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects every message until OpenTimeout has passed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a few probe messages through to test the provider
+	BreakerHalfOpen BreakerState = "half-open"
+	// BreakerDisabled is reported when no breaker is configured
+	BreakerDisabled BreakerState = "disabled"
+)
+
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 30 * time.Second
+	DefaultHalfOpenMaxCalls = 1
+)
+
+// BreakerConfig is the configuration for the circuit breaker
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed sends that opens the circuit
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before probes are let through
+	OpenTimeout time.Duration
+	// HalfOpenMaxCalls is the number of probes in flight while half-open
+	HalfOpenMaxCalls int
+}
+
+// CircuitOpenError is returned without sending while the circuit is open,
+// the message should be retried after RetryAfter without counting as a failure
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open, retry after %s", e.RetryAfter)
+}
+
+// IsCircuitOpen reports whether err is a CircuitOpenError and returns it
+func IsCircuitOpen(err error) (*CircuitOpenError, bool) {
+	var co *CircuitOpenError
+	if errors.As(err, &co) {
+		return co, true
+	}
+	return nil, false
+}
+
+// BreakerSnapshot is the observable state of a circuit breaker
+type BreakerSnapshot struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+	// HalfOpenAt is when an open circuit starts letting probes through
+	HalfOpenAt *time.Time `json:"half_open_at,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// Breaker is a Sender that stops calling the next sender
+// after repeated failures until the provider recovers
+type Breaker struct {
+	next Sender
+	cfg  BreakerConfig
+	log  *zap.Logger
+	now  func() time.Time
+
+	mtx       sync.Mutex
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	probes    int
+	lastError string
+}
+
+// NewBreaker wraps next in a circuit breaker
+func NewBreaker(next Sender, cfg BreakerConfig, log *zap.Logger) *Breaker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = DefaultFailureThreshold
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = DefaultOpenTimeout
+	}
+	if cfg.HalfOpenMaxCalls <= 0 {
+		cfg.HalfOpenMaxCalls = DefaultHalfOpenMaxCalls
+	}
+	return &Breaker{next: next, cfg: cfg, log: log, now: time.Now, state: BreakerClosed}
+}
+
+// Send sends req through the next sender unless the circuit is open
+func (b *Breaker) Send(ctx context.Context, req SendRequest) (SendResult, error) {
+	probe, err := b.acquire()
+	if err != nil {
+		return SendResult{}, err
+	}
+	res, err := b.next.Send(ctx, req)
+	b.record(probe, err)
+	return res, err
+}
+
+// Open reports whether messages are currently rejected without sending
+func (b *Breaker) Open() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.state == BreakerOpen && b.now().Before(b.openedAt.Add(b.cfg.OpenTimeout))
+}
+
+// Snapshot returns the current state of the breaker
+func (b *Breaker) Snapshot() BreakerSnapshot {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	snap := BreakerSnapshot{State: b.state, ConsecutiveFailures: b.failures, LastError: b.lastError}
+	if b.state != BreakerClosed {
+		openedAt, halfOpenAt := b.openedAt, b.openedAt.Add(b.cfg.OpenTimeout)
+		snap.OpenedAt, snap.HalfOpenAt = &openedAt, &halfOpenAt
+	}
+	return snap
+}
+
+// acquire lets a send through or rejects it with a CircuitOpenError,
+// probe is set for sends let through while half-open
+func (b *Breaker) acquire() (probe bool, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.now()
+	if b.state == BreakerOpen {
+		halfOpenAt := b.openedAt.Add(b.cfg.OpenTimeout)
+		if now.Before(halfOpenAt) {
+			return false, &CircuitOpenError{RetryAfter: halfOpenAt.Sub(now)}
+		}
+		b.setState(BreakerHalfOpen)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.cfg.HalfOpenMaxCalls {
+			return false, &CircuitOpenError{RetryAfter: b.cfg.OpenTimeout}
+		}
+		b.probes++
+		return true, nil
+	}
+	return false, nil
+}
+
+// record updates the breaker with the outcome of a send
+func (b *Breaker) record(probe bool, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if probe {
+		b.probes--
+	}
+	// throttled or cancelled sends say nothing about the provider
+	if _, ok := IsRateLimited(err); ok || errors.Is(err, context.Canceled) {
+		return
+	}
+	// a permanent rejection is an answer from a healthy provider
+	if err == nil || IsPermanent(err) {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+	b.failures++
+	b.lastError = err.Error()
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.cfg.FailureThreshold) {
+		b.openedAt = b.now()
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *Breaker) setState(state BreakerState) {
+	b.log.Warn("circuit breaker state changed", zap.String("from", string(b.state)), zap.String("to", string(state)), zap.Int("failures", b.failures))
+	b.state = state
+}
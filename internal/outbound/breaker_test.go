@@ -0,0 +1,133 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// scriptedSender fails while fail is set
+type scriptedSender struct {
+	fail  bool
+	calls int
+}
+
+func (s *scriptedSender) Send(ctx context.Context, req SendRequest) (SendResult, error) {
+	s.calls++
+	if s.fail {
+		return SendResult{}, errors.New("provider down")
+	}
+	return SendResult{MessageID: "mid"}, nil
+}
+
+func newTestBreaker(next Sender, now *time.Time) *Breaker {
+	b := NewBreaker(next, BreakerConfig{FailureThreshold: 2, OpenTimeout: 10 * time.Second}, zap.NewNop())
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+func TestBreaker_OpensAfterThreshold(t *testing.T) {
+	now := time.Now()
+	next := &scriptedSender{fail: true}
+	b := newTestBreaker(next, &now)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.Send(ctx, SendRequest{}); err == nil {
+			t.Fatalf("send %d: expected the provider error", i)
+		}
+	}
+	if !b.Open() || b.Snapshot().State != BreakerOpen {
+		t.Fatalf("expected open circuit, got %+v", b.Snapshot())
+	}
+	_, err := b.Send(ctx, SendRequest{})
+	co, ok := IsCircuitOpen(err)
+	if !ok || co.RetryAfter != 10*time.Second {
+		t.Fatalf("expected CircuitOpenError, got %v", err)
+	}
+	if next.calls != 2 {
+		t.Fatalf("open circuit must not call the provider, got %d calls", next.calls)
+	}
+}
+
+func TestBreaker_HalfOpenProbe(t *testing.T) {
+	now := time.Now()
+	next := &scriptedSender{fail: true}
+	b := newTestBreaker(next, &now)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, _ = b.Send(ctx, SendRequest{})
+	}
+
+	// a failed probe opens the circuit again
+	now = now.Add(11 * time.Second)
+	if b.Open() {
+		t.Fatal("expected probes to be let through after OpenTimeout")
+	}
+	if _, err := b.Send(ctx, SendRequest{}); err == nil || next.calls != 3 {
+		t.Fatalf("expected a failed probe, got %v with %d calls", err, next.calls)
+	}
+	if !b.Open() {
+		t.Fatal("expected a failed probe to open the circuit again")
+	}
+
+	// a successful probe closes it
+	now = now.Add(11 * time.Second)
+	next.fail = false
+	if _, err := b.Send(ctx, SendRequest{}); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if snap := b.Snapshot(); snap.State != BreakerClosed || snap.ConsecutiveFailures != 0 {
+		t.Fatalf("expected closed circuit, got %+v", snap)
+	}
+}
+
+func TestBreaker_HalfOpenLimitsProbes(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&scriptedSender{}, &now)
+	b.state, b.openedAt = BreakerOpen, now.Add(-time.Minute)
+
+	if probe, err := b.acquire(); !probe || err != nil {
+		t.Fatalf("expected a probe, got %v %v", probe, err)
+	}
+	if _, err := b.acquire(); err == nil {
+		t.Fatal("expected only one probe in flight")
+	}
+}
+
+func TestBreaker_IgnoresRateLimits(t *testing.T) {
+	now := time.Now()
+	limited := funcSender(func(ctx context.Context, req SendRequest) (SendResult, error) {
+		return SendResult{}, &RateLimitedError{RetryAfter: time.Second}
+	})
+	b := newTestBreaker(limited, &now)
+	for i := 0; i < 5; i++ {
+		_, _ = b.Send(context.Background(), SendRequest{})
+	}
+	if snap := b.Snapshot(); snap.State != BreakerClosed || snap.ConsecutiveFailures != 0 {
+		t.Fatalf("rate limits must not open the circuit, got %+v", snap)
+	}
+}
+
+type funcSender func(ctx context.Context, req SendRequest) (SendResult, error)
+
+func (f funcSender) Send(ctx context.Context, req SendRequest) (SendResult, error) {
+	return f(ctx, req)
+}
+
+func TestBreaker_PermanentErrorsKeepItClosed(t *testing.T) {
+	now := time.Now()
+	rejecting := funcSender(func(ctx context.Context, req SendRequest) (SendResult, error) {
+		return SendResult{}, &PermanentError{StatusCode: 400, Err: errors.New("invalid number")}
+	})
+	b := newTestBreaker(rejecting, &now)
+	for i := 0; i < 5; i++ {
+		_, _ = b.Send(context.Background(), SendRequest{})
+	}
+	if snap := b.Snapshot(); snap.State != BreakerClosed {
+		t.Fatalf("permanent rejections must not open the circuit, got %+v", snap)
+	}
+}
@@ -0,0 +1,71 @@
+package outbound
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultRetryAfter is used when a 429 response has no usable Retry-After
+const DefaultRetryAfter = 5 * time.Second
+
+// PermanentError is a send the provider rejected for good,
+// resending the same message will not succeed
+type PermanentError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("permanent: %v", e.Err)
+}
+
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// RetryableError is a send that failed but may succeed when resent
+type RetryableError struct {
+	// StatusCode is zero when no response was received
+	StatusCode int
+	Err        error
+}
+
+func (e *RetryableError) Error() string {
+	return fmt.Sprintf("retryable: %v", e.Err)
+}
+
+func (e *RetryableError) Unwrap() error { return e.Err }
+
+// IsPermanent reports whether err is a PermanentError,
+// errors that are not typed are retryable
+func IsPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
+
+// statusError is the error of a response with a status handled as outcome
+func statusError(resp *http.Response, outcome StatusOutcome, now time.Time) error {
+	err := fmt.Errorf("unexpected status %d", resp.StatusCode)
+	switch outcome {
+	case StatusRateLimited:
+		return &RateLimitedError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), now), Scope: "provider"}
+	case StatusPermanent:
+		return &PermanentError{StatusCode: resp.StatusCode, Err: err}
+	}
+	return &RetryableError{StatusCode: resp.StatusCode, Err: err}
+}
+
+// parseRetryAfter parses a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return DefaultRetryAfter
+}
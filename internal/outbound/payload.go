@@ -0,0 +1,103 @@
+package outbound
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	DefaultContentType   = "application/json"
+	DefaultMessageIDPath = "messageId"
+)
+
+// templateFuncs are available to body templates next to the builtin ones
+// like urlquery: json writes a value as a JSON literal, quotes included
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// parseBodyTemplate parses a request body template, empty keeps the default JSON body.
+// It is rendered once with an empty request so that unknown fields fail at startup.
+func parseBodyTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("body").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse body template: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, SendRequest{}); err != nil {
+		return nil, fmt.Errorf("render body template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// marshalBody renders the request body of req with tmpl, or as JSON without one.
+// Errors are a PermanentError since resending the same message cannot fix them.
+func marshalBody(tmpl *template.Template, req SendRequest) ([]byte, error) {
+	if tmpl == nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return nil, &PermanentError{Err: fmt.Errorf("marshal request: %w", err)}
+		}
+		return b, nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, req); err != nil {
+		return nil, &PermanentError{Err: fmt.Errorf("render body template: %w", err)}
+	}
+	return buf.Bytes(), nil
+}
+
+// extractMessageID returns the provider message id of an accepted response,
+// read from header when set and otherwise from the JSON body at path
+func extractMessageID(resp *http.Response, header, path string) (string, error) {
+	if header != "" {
+		return resp.Header.Get(header), nil
+	}
+	// numbers are kept as written, a float64 would round large ids
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	var body any
+	if err := dec.Decode(&body); err != nil {
+		return "", fmt.Errorf("decode response: %w", err)
+	}
+	return lookupPath(body, path)
+}
+
+// lookupPath walks a dot separated path of object keys and array indexes,
+// e.g. "data.messages.0.id", and returns the string or number found there
+func lookupPath(v any, path string) (string, error) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("no %q in response at %q", path, key)
+			}
+			v = node[i]
+		default:
+			return "", fmt.Errorf("no %q in response at %q", path, key)
+		}
+	}
+	switch id := v.(type) {
+	case string:
+		return id, nil
+	case json.Number:
+		return id.String(), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("%q in response is not a string or number", path)
+}
@@ -0,0 +1,161 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RateLimitedError is returned when a message may not be sent yet,
+// it should be retried after RetryAfter without counting as a failure
+type RateLimitedError struct {
+	RetryAfter time.Duration
+	// Scope is what was limited, "global" or "recipient"
+	Scope string
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited (%s), retry after %s", e.Scope, e.RetryAfter)
+}
+
+// IsRateLimited reports whether err is a RateLimitedError and returns it
+func IsRateLimited(err error) (*RateLimitedError, bool) {
+	var rl *RateLimitedError
+	if errors.As(err, &rl) {
+		return rl, true
+	}
+	return nil, false
+}
+
+// Bucket is a token bucket refilled with Rate tokens per second up to Burst,
+// a zero Rate disables it
+type Bucket struct {
+	Rate  float64
+	Burst int
+}
+
+func (b Bucket) enabled() bool { return b.Rate > 0 }
+
+func (b Bucket) burst() int { return max(b.Burst, 1) }
+
+// Limiter is a token bucket store shared by the buckets of every key
+type Limiter interface {
+	// TakeToken takes a token from the bucket of key, it returns zero when
+	// a token was taken and otherwise how long until one is available
+	TakeToken(ctx context.Context, key string, rate float64, burst int) (time.Duration, error)
+}
+
+// RateLimitConfig is the configuration for rate limited sending
+type RateLimitConfig struct {
+	// Global limits the messages sent by all recipients
+	Global Bucket
+	// PerRecipient limits the messages sent to a single recipient
+	PerRecipient Bucket
+}
+
+const (
+	globalRateKey       = "ratelimit:global"
+	recipientRateKeyFmt = "ratelimit:to:%s"
+)
+
+// rateLimitedSender takes tokens before handing a message to the next sender
+type rateLimitedSender struct {
+	next    Sender
+	limiter Limiter
+	cfg     RateLimitConfig
+	log     *zap.Logger
+}
+
+// NewRateLimited wraps next so that messages over the configured rates
+// fail with a RateLimitedError instead of being sent
+func NewRateLimited(next Sender, limiter Limiter, cfg RateLimitConfig, log *zap.Logger) Sender {
+	return &rateLimitedSender{next: next, limiter: limiter, cfg: cfg, log: log}
+}
+
+// Send sends req if both the global and the recipient bucket have a token.
+// The global bucket goes first, so a message held back by the global limit
+// does not use up a token of its recipient and delay its retry.
+func (s *rateLimitedSender) Send(ctx context.Context, req SendRequest) (SendResult, error) {
+	if err := s.take(ctx, "global", globalRateKey, s.cfg.Global); err != nil {
+		return SendResult{}, err
+	}
+	if err := s.take(ctx, "recipient", fmt.Sprintf(recipientRateKeyFmt, req.To), s.cfg.PerRecipient); err != nil {
+		return SendResult{}, err
+	}
+	return s.next.Send(ctx, req)
+}
+
+// take takes a token from bucket b of key, a limiter that fails lets the message through
+func (s *rateLimitedSender) take(ctx context.Context, scope, key string, b Bucket) error {
+	if !b.enabled() {
+		return nil
+	}
+	wait, err := s.limiter.TakeToken(ctx, key, b.Rate, b.burst())
+	if err != nil {
+		s.log.Warn("rate limit: take token failed, sending anyway", zap.String("scope", scope), zap.Error(err))
+		return nil
+	}
+	if wait > 0 {
+		return &RateLimitedError{RetryAfter: wait, Scope: scope}
+	}
+	return nil
+}
+
+// memoryLimiter keeps token buckets in process, limits are per replica
+type memoryLimiter struct {
+	mtx     sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+// sweepSize is the number of buckets after which full buckets are dropped
+const sweepSize = 4096
+
+// NewMemoryLimiter creates an in-process Limiter
+func NewMemoryLimiter() Limiter {
+	return &memoryLimiter{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+// TakeToken takes a token from the in-process bucket of key
+func (l *memoryLimiter) TakeToken(ctx context.Context, key string, rate float64, burst int) (time.Duration, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	if len(l.buckets) >= sweepSize {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.rate, b.burst = rate, burst
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / rate * float64(time.Second))), nil
+}
+
+// sweep drops the buckets that have refilled, they are recreated full anyway
+func (l *memoryLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= float64(b.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type countingSender struct{ calls int }
+
+func (s *countingSender) Send(ctx context.Context, req SendRequest) (SendResult, error) {
+	s.calls++
+	return SendResult{MessageID: "mid"}, nil
+}
+
+func newTestLimiter(now *time.Time) *memoryLimiter {
+	l := NewMemoryLimiter().(*memoryLimiter)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestMemoryLimiter_TokenBucket(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if wait, _ := l.TakeToken(ctx, "k", 1, 2); wait != 0 {
+			t.Fatalf("take %d: expected a token from the burst, wait %s", i, wait)
+		}
+	}
+	wait, _ := l.TakeToken(ctx, "k", 1, 2)
+	if wait != time.Second {
+		t.Fatalf("expected to wait 1s, got %s", wait)
+	}
+	if wait, _ := l.TakeToken(ctx, "other", 1, 2); wait != 0 {
+		t.Fatalf("keys must not share a bucket, wait %s", wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if wait, _ := l.TakeToken(ctx, "k", 1, 2); wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %s", wait)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if wait, _ := l.TakeToken(ctx, "k", 1, 2); wait != 0 {
+		t.Fatalf("expected a refilled token, wait %s", wait)
+	}
+}
+
+func TestMemoryLimiter_SweepsFullBuckets(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+	for i := 0; i < sweepSize; i++ {
+		_, _ = l.TakeToken(context.Background(), string(rune(i)), 1, 1)
+	}
+	now = now.Add(time.Second)
+	_, _ = l.TakeToken(context.Background(), "new", 1, 1)
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected refilled buckets to be swept, got %d", len(l.buckets))
+	}
+}
+
+func TestRateLimited_PerRecipient(t *testing.T) {
+	next := &countingSender{}
+	s := NewRateLimited(next, NewMemoryLimiter(), RateLimitConfig{PerRecipient: Bucket{Rate: 0.1, Burst: 1}}, zap.NewNop())
+	ctx := context.Background()
+
+	if _, err := s.Send(ctx, SendRequest{To: "a"}); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	_, err := s.Send(ctx, SendRequest{To: "a"})
+	rl, ok := IsRateLimited(err)
+	if !ok || rl.Scope != "recipient" || rl.RetryAfter <= 0 {
+		t.Fatalf("expected a recipient rate limit, got %v", err)
+	}
+	if _, err := s.Send(ctx, SendRequest{To: "b"}); err != nil {
+		t.Fatalf("other recipient: %v", err)
+	}
+	if next.calls != 2 {
+		t.Fatalf("expected 2 sends, got %d", next.calls)
+	}
+}
+
+func TestRateLimited_Global(t *testing.T) {
+	next := &countingSender{}
+	s := NewRateLimited(next, NewMemoryLimiter(), RateLimitConfig{Global: Bucket{Rate: 1, Burst: 3}}, zap.NewNop())
+	var limited int
+	for _, to := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := s.Send(context.Background(), SendRequest{To: to}); err != nil {
+			if _, ok := IsRateLimited(err); !ok {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			limited++
+		}
+	}
+	if next.calls != 3 || limited != 2 {
+		t.Fatalf("expected 3 sent and 2 limited, got %d and %d", next.calls, limited)
+	}
+}
+
+func TestRateLimited_GlobalLimitKeepsRecipientToken(t *testing.T) {
+	now := time.Now()
+	next := &countingSender{}
+	cfg := RateLimitConfig{Global: Bucket{Rate: 1, Burst: 1}, PerRecipient: Bucket{Rate: 0.01, Burst: 1}}
+	s := NewRateLimited(next, newTestLimiter(&now), cfg, zap.NewNop())
+	ctx := context.Background()
+
+	if _, err := s.Send(ctx, SendRequest{To: "a"}); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	_, err := s.Send(ctx, SendRequest{To: "b"})
+	if rl, ok := IsRateLimited(err); !ok || rl.Scope != "global" {
+		t.Fatalf("expected a global rate limit, got %v", err)
+	}
+	// b gets its own token once the global bucket refills
+	now = now.Add(time.Second)
+	if _, err := s.Send(ctx, SendRequest{To: "b"}); err != nil || next.calls != 2 {
+		t.Fatalf("expected b to be sent, got %v", err)
+	}
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) TakeToken(ctx context.Context, key string, rate float64, burst int) (time.Duration, error) {
+	return 0, errors.New("redis down")
+}
+
+func TestRateLimited_FailsOpen(t *testing.T) {
+	next := &countingSender{}
+	s := NewRateLimited(next, failingLimiter{}, RateLimitConfig{Global: Bucket{Rate: 1}}, zap.NewNop())
+	if _, err := s.Send(context.Background(), SendRequest{To: "a"}); err != nil || next.calls != 1 {
+		t.Fatalf("expected the message to be sent when the limiter fails: %v", err)
+	}
+}
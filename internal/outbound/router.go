@@ -0,0 +1,132 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// RoutingStrategy picks the provider a message is sent through first
+type RoutingStrategy string
+
+const (
+	// RouteWeighted picks the first provider at random by weight
+	RouteWeighted RoutingStrategy = "weighted"
+	// RouteFailover always starts with the first configured provider
+	RouteFailover RoutingStrategy = "failover"
+)
+
+// Provider is a named sender the router can pick
+type Provider struct {
+	Name   string
+	Sender Sender
+	// Weight is the share of messages sent through the provider first
+	// with the weighted strategy, zero only takes over on failover
+	Weight int
+	// Prefixes limits the provider to recipients starting with one of them,
+	// e.g. a country code "+90", empty serves the recipients no prefix matches
+	Prefixes []string
+}
+
+// router sends through one of several providers,
+// falling back to the others in configured order when one fails
+type router struct {
+	providers []Provider
+	strategy  RoutingStrategy
+	log       *zap.Logger
+	// pick returns a number in [0, n)
+	pick func(n int) int
+}
+
+// NewRouter creates a Sender that routes messages between providers
+func NewRouter(providers []Provider, strategy RoutingStrategy, log *zap.Logger) Sender {
+	return &router{providers: providers, strategy: strategy, log: log, pick: rand.IntN}
+}
+
+// Send sends req through the providers serving its recipient until one accepts it,
+// a permanent error is returned right away since another provider would reject it too
+func (r *router) Send(ctx context.Context, req SendRequest) (SendResult, error) {
+	order := r.order(r.candidates(req.To))
+	if len(order) == 0 {
+		return SendResult{}, &PermanentError{Err: fmt.Errorf("no provider for recipient %q", req.To)}
+	}
+
+	var lastErr error
+	for i, p := range order {
+		res, err := p.Sender.Send(ctx, req)
+		if err == nil {
+			if res.Provider == "" {
+				res.Provider = p.Name
+			}
+			return res, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", p.Name, err)
+		if IsPermanent(err) || ctx.Err() != nil {
+			return SendResult{}, lastErr
+		}
+		if i < len(order)-1 {
+			r.log.Warn("router: provider failed, failing over", zap.String("provider", p.Name), zap.String("next", order[i+1].Name), zap.Error(err))
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("send failed")
+	}
+	return SendResult{}, lastErr
+}
+
+// candidates returns the providers with the longest prefix matching to,
+// or the providers without prefixes when none matches
+func (r *router) candidates(to string) []Provider {
+	var out []Provider
+	best := 0
+	for _, p := range r.providers {
+		n := matchPrefix(p.Prefixes, to)
+		switch {
+		case n > best:
+			best, out = n, []Provider{p}
+		case n == best && (n > 0 || len(p.Prefixes) == 0):
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// matchPrefix returns the length of the longest prefix of to in prefixes
+func matchPrefix(prefixes []string, to string) int {
+	n := 0
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(to, prefix) {
+			n = max(n, len(prefix))
+		}
+	}
+	return n
+}
+
+// order returns the providers in the order they are tried
+func (r *router) order(ps []Provider) []Provider {
+	if r.strategy != RouteWeighted || len(ps) < 2 {
+		return ps
+	}
+	total := 0
+	for _, p := range ps {
+		total += max(p.Weight, 0)
+	}
+	if total == 0 {
+		return ps
+	}
+	first, n := 0, r.pick(total)
+	for i, p := range ps {
+		if n -= max(p.Weight, 0); n < 0 {
+			first = i
+			break
+		}
+	}
+	out := make([]Provider, 0, len(ps))
+	out = append(out, ps[first])
+	out = append(out, ps[:first]...)
+	return append(out, ps[first+1:]...)
+}
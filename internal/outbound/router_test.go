@@ -0,0 +1,97 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// namedSender records the providers it was called as
+func namedSender(name string, calls *[]string, err error) Sender {
+	return funcSender(func(ctx context.Context, req SendRequest) (SendResult, error) {
+		*calls = append(*calls, name)
+		if err != nil {
+			return SendResult{}, err
+		}
+		return SendResult{MessageID: name + "-mid"}, nil
+	})
+}
+
+func TestRouter_Weighted(t *testing.T) {
+	var calls []string
+	r := NewRouter([]Provider{
+		{Name: "a", Sender: namedSender("a", &calls, nil), Weight: 1},
+		{Name: "b", Sender: namedSender("b", &calls, nil), Weight: 3},
+	}, RouteWeighted, zap.NewNop()).(*router)
+
+	for pick, want := range map[int]string{0: "a", 1: "b", 3: "b"} {
+		r.pick = func(n int) int {
+			if n != 4 {
+				t.Fatalf("expected total weight 4, got %d", n)
+			}
+			return pick
+		}
+		res, err := r.Send(context.Background(), SendRequest{To: "+905551112233"})
+		if err != nil || res.Provider != want || res.MessageID != want+"-mid" {
+			t.Fatalf("pick %d: expected provider %s, got %+v %v", pick, want, res, err)
+		}
+	}
+}
+
+func TestRouter_Prefixes(t *testing.T) {
+	var calls []string
+	r := NewRouter([]Provider{
+		{Name: "default", Sender: namedSender("default", &calls, nil)},
+		{Name: "tr", Sender: namedSender("tr", &calls, nil), Prefixes: []string{"+90"}},
+		{Name: "tr-mobile", Sender: namedSender("tr-mobile", &calls, nil), Prefixes: []string{"+905"}},
+	}, RouteFailover, zap.NewNop())
+
+	for to, want := range map[string]string{"+905551112233": "tr-mobile", "+902121112233": "tr", "+441234": "default"} {
+		res, err := r.Send(context.Background(), SendRequest{To: to})
+		if err != nil || res.Provider != want {
+			t.Fatalf("%s: expected provider %s, got %+v %v", to, want, res, err)
+		}
+	}
+}
+
+func TestRouter_Failover(t *testing.T) {
+	var calls []string
+	down := &RetryableError{StatusCode: 503, Err: errors.New("unavailable")}
+	r := NewRouter([]Provider{
+		{Name: "primary", Sender: namedSender("primary", &calls, down)},
+		{Name: "secondary", Sender: namedSender("secondary", &calls, nil)},
+	}, RouteFailover, zap.NewNop())
+
+	res, err := r.Send(context.Background(), SendRequest{To: "a"})
+	if err != nil || res.Provider != "secondary" {
+		t.Fatalf("expected failover to secondary, got %+v %v", res, err)
+	}
+	if len(calls) != 2 || calls[0] != "primary" {
+		t.Fatalf("expected primary then secondary, got %v", calls)
+	}
+}
+
+func TestRouter_PermanentErrorStops(t *testing.T) {
+	var calls []string
+	r := NewRouter([]Provider{
+		{Name: "primary", Sender: namedSender("primary", &calls, &PermanentError{StatusCode: 400, Err: errors.New("invalid number")})},
+		{Name: "secondary", Sender: namedSender("secondary", &calls, nil)},
+	}, RouteFailover, zap.NewNop())
+
+	_, err := r.Send(context.Background(), SendRequest{To: "a"})
+	if !IsPermanent(err) || len(calls) != 1 {
+		t.Fatalf("expected a permanent error without failover, got %v after %v", err, calls)
+	}
+}
+
+func TestRouter_NoProvider(t *testing.T) {
+	var calls []string
+	r := NewRouter([]Provider{
+		{Name: "tr", Sender: namedSender("tr", &calls, nil), Prefixes: []string{"+90"}},
+	}, RouteFailover, zap.NewNop())
+	if _, err := r.Send(context.Background(), SendRequest{To: "+44"}); !IsPermanent(err) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+}
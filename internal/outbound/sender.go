@@ -3,67 +3,113 @@ package outbound
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"text/template"
 	"time"
 
 	"go.uber.org/zap"
 )
 
 type SendRequest struct {
+	// ID is our message id, sent as the idempotency key so that
+	// the provider can dedupe resends of the same message
+	ID      string `json:"-"`
 	To      string `json:"to"`
 	Content string `json:"content"`
 }
 
-type sendResponse struct {
-	Message   string `json:"message"`
-	MessageID string `json:"messageId"`
+// SendResult is what the provider answered to an accepted message
+type SendResult struct {
+	// Provider is the name of the provider that accepted the message
+	Provider string
+	// MessageID is the provider's id of the message
+	MessageID string
+	// StatusCode is the HTTP status of the accepted response
+	StatusCode int
+	// Latency is the round trip time of the accepted request
+	Latency time.Duration
 }
 
 // Config is the configuration for the outbound sender
 type Config struct {
+	// Name identifies the provider, it is recorded on sent messages
+	Name       string
 	URL        string
 	Timeout    time.Duration
 	MaxRetries int
-	// ExpectStatus is the expected HTTP status code from the outbound webhook
-	// Right now only one status code is supported,
-	// might need to be extended in the future
-	ExpectStatus int
-	AuthHeader   string
-	AuthValue    string
+	// ExpectStatus matches the statuses of accepted messages, 2xx by default
+	ExpectStatus StatusMatcher
+	// StatusRules override how statuses are handled, the first match wins
+	StatusRules []StatusRule
+	AuthHeader  string
+	AuthValue   string
+	// IdempotencyHeader carries SendRequest.ID, empty disables it
+	IdempotencyHeader string
+	// Signing signs the request body, it may replace AuthHeader
+	Signing SigningConfig
+	// ContentType of the request body, application/json by default
+	ContentType string
+	// BodyTemplate is a text/template rendered with the SendRequest
+	// (.ID, .To, .Content) as the request body, empty sends it as JSON
+	BodyTemplate string
+	// MessageIDPath is the dot separated path of the provider message id
+	// in the JSON response, e.g. "data.messages.0.id", "messageId" by default
+	MessageIDPath string
+	// MessageIDHeader reads the provider message id from a response header instead
+	MessageIDHeader string
 }
 
 // Sender is the outbound sender interface
 type Sender interface {
 	// Send sends a message to the outbound webhook
-	Send(ctx context.Context, req SendRequest) (messageID string, err error)
+	Send(ctx context.Context, req SendRequest) (SendResult, error)
 }
 
 const (
-	DefaultRetryDelay = 200 * time.Millisecond
+	DefaultRetryDelay        = 200 * time.Millisecond
+	DefaultIdempotencyHeader = "Idempotency-Key"
 )
 
 // httpSender is the HTTP outbound sender
 type httpSender struct {
 	cfg    Config
+	body   *template.Template
 	client *http.Client
 	log    *zap.Logger
 }
 
-// NewHTTP creates a new HTTP outbound sender
-func NewHTTP(cfg Config, log *zap.Logger) Sender {
+// NewHTTP creates a new HTTP outbound sender,
+// it fails when the body template does not parse
+func NewHTTP(cfg Config, log *zap.Logger) (Sender, error) {
+	if cfg.ContentType == "" {
+		cfg.ContentType = DefaultContentType
+	}
+	if len(cfg.ExpectStatus) == 0 {
+		cfg.ExpectStatus = StatusMatcher{{200, 299}}
+	}
+	if cfg.MessageIDPath == "" {
+		cfg.MessageIDPath = DefaultMessageIDPath
+	}
+	body, err := parseBodyTemplate(cfg.BodyTemplate)
+	if err != nil {
+		return nil, err
+	}
 	return &httpSender{
 		cfg:    cfg,
+		body:   body,
 		client: &http.Client{Timeout: cfg.Timeout},
 		log:    log,
-	}
+	}, nil
 }
 
 // Send sends a message to the outbound provider
-// and returns the provider message id
-func (s *httpSender) Send(ctx context.Context, req SendRequest) (string, error) {
+// and returns the provider message id with the response metadata.
+// Retryable failures are retried up to MaxRetries times, permanent and
+// rate limited ones are returned right away as PermanentError and RateLimitedError.
+func (s *httpSender) Send(ctx context.Context, req SendRequest) (SendResult, error) {
 
 	var lastErr error
 	var sleepOnRetry = func(attempt int) {
@@ -74,48 +120,53 @@ func (s *httpSender) Send(ctx context.Context, req SendRequest) (string, error)
 
 	for attempt := 1; attempt <= s.cfg.MaxRetries; attempt++ {
 
-		// build request
+		// build request, it fails the same way on every attempt
 		req, err := s.buildReq(ctx, req)
 		if err != nil {
-			lastErr = err
-			sleepOnRetry(attempt)
-			continue
+			return SendResult{}, err
 		}
 
 		// send request
+		start := time.Now()
 		resp, err := s.client.Do(req)
 		if err != nil {
-			lastErr = err
+			if ctx.Err() != nil {
+				return SendResult{}, err
+			}
+			lastErr = &RetryableError{Err: err}
 			sleepOnRetry(attempt)
 			continue
 		}
+		latency := time.Since(start)
 
 		// parse message id
 		msgId, err := s.parseMessageId(resp)
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			s.log.Error("send: close response body error", zap.Error(closeErr))
+		}
 		if err != nil {
+			if _, ok := IsRateLimited(err); ok || IsPermanent(err) {
+				return SendResult{}, err
+			}
 			lastErr = err
 			sleepOnRetry(attempt)
 			continue
 		}
 
-		err = resp.Body.Close()
-		if err != nil {
-			s.log.Error("send: close response body error", zap.Error(err))
-		}
-		return msgId, nil
+		return SendResult{Provider: s.cfg.Name, MessageID: msgId, StatusCode: resp.StatusCode, Latency: latency}, nil
 
 	}
 	if lastErr == nil {
 		lastErr = errors.New("send failed")
 	}
-	return "", lastErr
+	return SendResult{}, lastErr
 }
 
 // buildReq builds the HTTP request
 func (s *httpSender) buildReq(ctx context.Context, sendReq SendRequest) (*http.Request, error) {
-	b, err := json.Marshal(sendReq)
+	b, err := marshalBody(s.body, sendReq)
 	if err != nil {
-		return nil, fmt.Errorf("marshal request: %w", err)
+		return nil, err
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(b))
@@ -123,29 +174,36 @@ func (s *httpSender) buildReq(ctx context.Context, sendReq SendRequest) (*http.R
 		return nil, fmt.Errorf("new request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", s.cfg.ContentType)
 	if s.cfg.AuthHeader != "" && s.cfg.AuthValue != "" {
 		req.Header.Set(s.cfg.AuthHeader, s.cfg.AuthValue)
 	}
+	if s.cfg.IdempotencyHeader != "" && sendReq.ID != "" {
+		req.Header.Set(s.cfg.IdempotencyHeader, sendReq.ID)
+	}
+	if s.cfg.Signing.enabled() {
+		now := time.Now()
+		req.Header.Set(s.cfg.Signing.timestampHeader(), strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set(s.cfg.Signing.header(), Sign(s.cfg.Signing.Secrets, now, b))
+	}
 
 	return req, nil
 }
 
 // parseMessageId parses the message id from the response
 func (s *httpSender) parseMessageId(resp *http.Response) (string, error) {
-	if resp.StatusCode != s.cfg.ExpectStatus {
-		return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	if outcome := classifyStatus(resp.StatusCode, s.cfg.ExpectStatus, s.cfg.StatusRules); outcome != StatusSuccess {
+		return "", statusError(resp, outcome, time.Now())
 	}
 
-	var out sendResponse
-	decErr := json.NewDecoder(resp.Body).Decode(&out)
-	if decErr != nil {
-		return "", fmt.Errorf("decode response: %w", decErr)
+	// the message was accepted, resending it with the
+	// idempotency key returns the same message id
+	msgId, err := extractMessageID(resp, s.cfg.MessageIDHeader, s.cfg.MessageIDPath)
+	if err != nil {
+		return "", &RetryableError{StatusCode: resp.StatusCode, Err: err}
 	}
-
-	msgId := out.MessageID
 	if msgId == "" {
-		return "", errors.New("empty messageId in response")
+		return "", &RetryableError{StatusCode: resp.StatusCode, Err: errors.New("empty message id in response")}
 	}
 
 	return msgId, nil
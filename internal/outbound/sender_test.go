@@ -3,9 +3,11 @@ package outbound
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -20,11 +22,20 @@ func newSender(t *testing.T, handler http.HandlerFunc) Sender {
 		URL:          server.URL,
 		Timeout:      2 * time.Second,
 		MaxRetries:   3,
-		ExpectStatus: http.StatusOK,
+		ExpectStatus: ExactStatus(http.StatusOK),
 		AuthHeader:   "X-Auth",
 		AuthValue:    "token",
 	}
-	return NewHTTP(cfg, zap.NewNop())
+	return mustHTTP(t, cfg)
+}
+
+func mustHTTP(t *testing.T, cfg Config) Sender {
+	t.Helper()
+	s, err := NewHTTP(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("new sender: %v", err)
+	}
+	return s
 }
 
 func TestSend_Success(t *testing.T) {
@@ -44,12 +55,12 @@ func TestSend_Success(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 		_ = json.NewEncoder(w).Encode(map[string]any{"message": "ok", "messageId": "mid-1"})
 	})
-	msgId, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
+	res, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if msgId != "mid-1" {
-		t.Fatalf("unexpected message id: %s", msgId)
+	if res.MessageID != "mid-1" || res.StatusCode != http.StatusOK || res.Latency <= 0 {
+		t.Fatalf("unexpected result: %+v", res)
 	}
 }
 
@@ -65,12 +76,12 @@ func TestSend_RetriesOnBadStatusThenSucceeds(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 		_ = json.NewEncoder(w).Encode(map[string]any{"message": "ok", "messageId": "mid-2"})
 	})
-	msgId, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
+	res, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if msgId != "mid-2" {
-		t.Fatalf("unexpected message id: %s", msgId)
+	if res.MessageID != "mid-2" {
+		t.Fatalf("unexpected message id: %s", res.MessageID)
 	}
 	if atomic.LoadInt32(&calls) < 2 {
 		t.Fatalf("expected at least 2 attempts, got %d", calls)
@@ -95,9 +106,195 @@ func TestSend_UnexpectedStatus(t *testing.T) {
 		_ = json.NewEncoder(w).Encode(map[string]any{"message": "ok", "messageId": "mid"})
 	}))
 	defer server.Close()
-	s := NewHTTP(Config{URL: server.URL, Timeout: time.Second, MaxRetries: 1, ExpectStatus: http.StatusOK}, zap.NewNop())
+	s := mustHTTP(t, Config{URL: server.URL, Timeout: time.Second, MaxRetries: 1, ExpectStatus: ExactStatus(http.StatusOK)})
 	_, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
 	if err == nil {
 		t.Fatalf("expected error for unexpected status")
 	}
 }
+
+func TestSend_IdempotencyHeaderStableAcrossRetries(t *testing.T) {
+	var calls int32
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(DefaultIdempotencyHeader))
+		if atomic.AddInt32(&calls, 1) < 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]any{"message": "ok", "messageId": "mid"})
+	}))
+	defer server.Close()
+	s := mustHTTP(t, Config{URL: server.URL, Timeout: time.Second, MaxRetries: 3, ExpectStatus: ExactStatus(http.StatusOK), IdempotencyHeader: DefaultIdempotencyHeader})
+	if _, err := s.Send(context.Background(), SendRequest{ID: "msg-1", To: "a", Content: "b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "msg-1" || keys[1] != "msg-1" {
+		t.Fatalf("expected msg-1 on every attempt, got %v", keys)
+	}
+}
+
+func TestSend_PermanentErrorIsNotRetried(t *testing.T) {
+	var calls int32
+	s := newSender(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid number"))
+	})
+	_, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
+	var pe *PermanentError
+	if !errors.As(err, &pe) || pe.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected no retries, got %d calls", calls)
+	}
+}
+
+func TestSend_TooManyRequests(t *testing.T) {
+	var calls int32
+	s := newSender(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	_, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
+	rl, ok := IsRateLimited(err)
+	if !ok || rl.RetryAfter != 7*time.Second || rl.Scope != "provider" {
+		t.Fatalf("expected a provider rate limit of 7s, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected no retries, got %d calls", calls)
+	}
+}
+
+func TestSend_ServerErrorIsRetryable(t *testing.T) {
+	s := newSender(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	_, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
+	var re *RetryableError
+	if !errors.As(err, &re) || re.StatusCode != http.StatusServiceUnavailable || IsPermanent(err) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	cases := map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Wed, 02 Jan 2030 15:04:35 GMT": 30 * time.Second,
+		"Wed, 02 Jan 2030 15:00:00 GMT": 0,
+		"":                              DefaultRetryAfter,
+		"soon":                          DefaultRetryAfter,
+	}
+	for in, want := range cases {
+		if got := parseRetryAfter(in, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestSend_JSONBodyTemplate(t *testing.T) {
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"messages": []any{map[string]any{"id": 12345}}}})
+	}))
+	defer server.Close()
+	s := mustHTTP(t, Config{
+		URL: server.URL, Timeout: time.Second, MaxRetries: 1, ExpectStatus: ExactStatus(http.StatusOK),
+		BodyTemplate:  `{"msisdn": {{json .To}}, "text": {{json .Content}}, "sender": "INSIDER", "ref": {{json .ID}}}`,
+		MessageIDPath: "data.messages.0.id",
+	})
+	res, err := s.Send(context.Background(), SendRequest{ID: "m-1", To: "+905551112233", Content: `say "hi"`})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if body["msisdn"] != "+905551112233" || body["text"] != `say "hi"` || body["sender"] != "INSIDER" || body["ref"] != "m-1" {
+		t.Fatalf("unexpected body: %v", body)
+	}
+	if res.MessageID != "12345" {
+		t.Fatalf("expected the id at the path, got %q", res.MessageID)
+	}
+}
+
+func TestSend_FormBodyAndHeaderMessageID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("to") != "+90 555" || r.PostForm.Get("body") != "a&b=c" {
+			t.Errorf("unexpected form: %v %v", r.PostForm, err)
+		}
+		w.Header().Set("X-Message-Id", "hdr-1")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("queued"))
+	}))
+	defer server.Close()
+	s := mustHTTP(t, Config{
+		URL: server.URL, Timeout: time.Second, MaxRetries: 1, ExpectStatus: ExactStatus(http.StatusAccepted),
+		ContentType:     "application/x-www-form-urlencoded",
+		BodyTemplate:    `to={{urlquery .To}}&body={{urlquery .Content}}`,
+		MessageIDHeader: "X-Message-Id",
+	})
+	res, err := s.Send(context.Background(), SendRequest{To: "+90 555", Content: "a&b=c"})
+	if err != nil || res.MessageID != "hdr-1" {
+		t.Fatalf("expected the id from the header, got %+v %v", res, err)
+	}
+}
+
+func TestSend_MissingMessageIDPath(t *testing.T) {
+	s := newSender(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]any{"id": "x"})
+	})
+	_, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
+	var re *RetryableError
+	if !errors.As(err, &re) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+}
+
+func TestNewHTTP_InvalidTemplate(t *testing.T) {
+	if _, err := NewHTTP(Config{BodyTemplate: `{{.To`}, zap.NewNop()); err == nil {
+		t.Fatal("expected a template parse error")
+	}
+}
+
+func TestNewHTTP_TemplateUnknownField(t *testing.T) {
+	if _, err := NewHTTP(Config{BodyTemplate: `{"to": {{json .Phone}}}`}, zap.NewNop()); err == nil {
+		t.Fatal("expected a template render error")
+	}
+}
+
+func TestMarshalBody_RenderErrorIsPermanent(t *testing.T) {
+	tmpl, err := parseBodyTemplate(`{{if .To}}{{index .Content 99}}{{end}}`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	_, err = marshalBody(tmpl, SendRequest{To: "a", Content: "b"})
+	if !IsPermanent(err) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	dec := json.NewDecoder(strings.NewReader(`{"a":{"b":[{"c":"x"},{"c":7}]},"n":null,"big":12345678901234567890}`))
+	dec.UseNumber()
+	var doc any
+	_ = dec.Decode(&doc)
+	cases := map[string]string{"a.b.0.c": "x", "a.b.1.c": "7", "n": "", "missing": "", "big": "12345678901234567890"}
+	for path, want := range cases {
+		if got, err := lookupPath(doc, path); err != nil || got != want {
+			t.Errorf("lookupPath(%q) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+	for _, path := range []string{"a.b.2.c", "a.b.x", "a.b.0.c.d", "a"} {
+		if _, err := lookupPath(doc, path); err == nil {
+			t.Errorf("lookupPath(%q): expected an error", path)
+		}
+	}
+}
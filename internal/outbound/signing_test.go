@@ -0,0 +1,70 @@
+package outbound
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1_900_000_000, 0)
+	body := []byte(`{"to":"a","content":"b"}`)
+	ts := "1900000000"
+
+	sig := Sign([]string{"new", "old"}, now, body)
+	if n := len(strings.Split(sig, ",")); n != 2 {
+		t.Fatalf("expected a signature per secret, got %q", sig)
+	}
+	// receivers still on the old secret accept it while it is rotated
+	for _, secrets := range [][]string{{"new"}, {"old"}, {"other", "old"}} {
+		if err := Verify(secrets, sig, ts, body, now, time.Minute); err != nil {
+			t.Fatalf("verify with %v: %v", secrets, err)
+		}
+	}
+
+	cases := []struct {
+		name    string
+		secrets []string
+		ts      string
+		body    string
+		now     time.Time
+		want    error
+	}{
+		{"wrong secret", []string{"other"}, ts, string(body), now, ErrInvalidSignature},
+		{"tampered body", []string{"new"}, ts, `{"to":"x","content":"b"}`, now, ErrInvalidSignature},
+		{"tampered timestamp", []string{"new"}, "1900000001", string(body), now, ErrInvalidSignature},
+		{"bad timestamp", []string{"new"}, "soon", string(body), now, ErrInvalidSignature},
+		{"expired", []string{"new"}, ts, string(body), now.Add(2 * time.Minute), ErrSignatureExpired},
+		{"from the future", []string{"new"}, ts, string(body), now.Add(-2 * time.Minute), ErrSignatureExpired},
+	}
+	for _, c := range cases {
+		if err := Verify(c.secrets, sig, c.ts, []byte(c.body), c.now, time.Minute); !errors.Is(err, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestSend_SignsBody(t *testing.T) {
+	var verifyErr error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		verifyErr = Verify([]string{"secret"}, r.Header.Get("X-Sig"), r.Header.Get(DefaultSignatureTimestampHeader), body, time.Now(), DefaultSignatureTolerance)
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]any{"message": "ok", "messageId": "mid"})
+	}))
+	defer server.Close()
+	s := mustHTTP(t, Config{URL: server.URL, Timeout: time.Second, MaxRetries: 1, ExpectStatus: ExactStatus(http.StatusOK),
+		Signing: SigningConfig{Secrets: []string{"secret"}, Header: "X-Sig"}})
+	if _, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if verifyErr != nil {
+		t.Fatalf("signature did not verify: %v", verifyErr)
+	}
+}
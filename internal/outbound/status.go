@@ -0,0 +1,135 @@
+package outbound
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatusOutcome is how a send is handled depending on the response status
+type StatusOutcome string
+
+const (
+	// StatusSuccess accepts the message and reads its message id
+	StatusSuccess StatusOutcome = "success"
+	// StatusRetry fails with a RetryableError
+	StatusRetry StatusOutcome = "retry"
+	// StatusPermanent fails with a PermanentError
+	StatusPermanent StatusOutcome = "permanent"
+	// StatusRateLimited fails with a RateLimitedError after Retry-After
+	StatusRateLimited StatusOutcome = "rate_limited"
+)
+
+func (o StatusOutcome) valid() bool {
+	switch o {
+	case StatusSuccess, StatusRetry, StatusPermanent, StatusRateLimited:
+		return true
+	}
+	return false
+}
+
+// statusRange is an inclusive range of status codes
+type statusRange struct{ lo, hi int }
+
+// StatusMatcher matches response status codes against codes and ranges
+type StatusMatcher []statusRange
+
+// ExactStatus matches the given status codes
+func ExactStatus(codes ...int) StatusMatcher {
+	m := make(StatusMatcher, 0, len(codes))
+	for _, c := range codes {
+		m = append(m, statusRange{c, c})
+	}
+	return m
+}
+
+// ParseStatusMatcher parses status specs like "202", "2xx" or "200-204",
+// a spec may also hold several comma separated ones
+func ParseStatusMatcher(specs ...string) (StatusMatcher, error) {
+	var m StatusMatcher
+	for _, spec := range specs {
+		for _, part := range strings.Split(spec, ",") {
+			part = strings.TrimSpace(strings.Trim(strings.TrimSpace(part), "[]"))
+			if part == "" {
+				continue
+			}
+			r, err := parseStatusRange(part)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, r)
+		}
+	}
+	return m, nil
+}
+
+func parseStatusRange(s string) (statusRange, error) {
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") && s[0] >= '1' && s[0] <= '5' {
+		lo := int(s[0]-'0') * 100
+		return statusRange{lo, lo + 99}, nil
+	}
+	if lo, hi, ok := strings.Cut(s, "-"); ok {
+		l, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		h, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || l > h || l < 100 || h > 599 {
+			return statusRange{}, fmt.Errorf("invalid status range %q", s)
+		}
+		return statusRange{l, h}, nil
+	}
+	c, err := strconv.Atoi(s)
+	if err != nil || c < 100 || c > 599 {
+		return statusRange{}, fmt.Errorf("invalid status %q", s)
+	}
+	return statusRange{c, c}, nil
+}
+
+// Match reports whether code is matched
+func (m StatusMatcher) Match(code int) bool {
+	for _, r := range m {
+		if code >= r.lo && code <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusRule handles the statuses it matches with Outcome
+type StatusRule struct {
+	Match   StatusMatcher
+	Outcome StatusOutcome
+}
+
+// ParseStatusRule parses a rule from a status spec and an outcome
+func ParseStatusRule(spec, outcome string) (StatusRule, error) {
+	m, err := ParseStatusMatcher(spec)
+	if err != nil {
+		return StatusRule{}, err
+	}
+	o := StatusOutcome(outcome)
+	if !o.valid() {
+		return StatusRule{}, fmt.Errorf("invalid outcome %q for status %q", outcome, spec)
+	}
+	return StatusRule{Match: m, Outcome: o}, nil
+}
+
+// classifyStatus returns the outcome of code: the first matching rule,
+// success for expected statuses, and otherwise 429 is rate limited,
+// 408 and 5xx are retried and other 4xx are permanent
+func classifyStatus(code int, expect StatusMatcher, rules []StatusRule) StatusOutcome {
+	for _, r := range rules {
+		if r.Match.Match(code) {
+			return r.Outcome
+		}
+	}
+	switch {
+	case expect.Match(code):
+		return StatusSuccess
+	case code == 429:
+		return StatusRateLimited
+	case code == 408, code >= 500:
+		return StatusRetry
+	case code >= 400:
+		return StatusPermanent
+	}
+	return StatusRetry
+}
@@ -0,0 +1,77 @@
+package outbound
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseStatusMatcher(t *testing.T) {
+	m, err := ParseStatusMatcher("2xx", "[409, 422]", "500-502")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for code, want := range map[int]bool{200: true, 299: true, 300: false, 409: true, 422: true, 410: false, 501: true, 503: false} {
+		if got := m.Match(code); got != want {
+			t.Errorf("Match(%d) = %v, want %v", code, got, want)
+		}
+	}
+	for _, spec := range []string{"6xx", "abc", "300-200", "99", "200-700"} {
+		if _, err := ParseStatusMatcher(spec); err == nil {
+			t.Errorf("ParseStatusMatcher(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestParseStatusRule(t *testing.T) {
+	if _, err := ParseStatusRule("404", "ignore"); err == nil {
+		t.Fatal("expected an invalid outcome error")
+	}
+	r, err := ParseStatusRule("409", "success")
+	if err != nil || r.Outcome != StatusSuccess || !r.Match.Match(409) {
+		t.Fatalf("unexpected rule %+v %v", r, err)
+	}
+}
+
+func TestClassifyStatus(t *testing.T) {
+	expect := ExactStatus(200, 202)
+	rules := []StatusRule{
+		{Match: ExactStatus(404), Outcome: StatusRetry},
+		{Match: ExactStatus(503), Outcome: StatusRateLimited},
+	}
+	cases := map[int]StatusOutcome{
+		200: StatusSuccess, 202: StatusSuccess, 201: StatusRetry,
+		400: StatusPermanent, 404: StatusRetry, 408: StatusRetry,
+		429: StatusRateLimited, 500: StatusRetry, 503: StatusRateLimited,
+	}
+	for code, want := range cases {
+		if got := classifyStatus(code, expect, rules); got != want {
+			t.Errorf("classifyStatus(%d) = %s, want %s", code, got, want)
+		}
+	}
+}
+
+func TestSend_StatusRangesAndRules(t *testing.T) {
+	status := http.StatusCreated
+	s := newSender(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{"messageId": "mid"})
+	})
+	hs := s.(*httpSender)
+	hs.cfg.ExpectStatus, _ = ParseStatusMatcher("2xx")
+	hs.cfg.StatusRules = []StatusRule{{Match: ExactStatus(http.StatusConflict), Outcome: StatusSuccess}, {Match: ExactStatus(http.StatusServiceUnavailable), Outcome: StatusRateLimited}}
+
+	for _, status = range []int{http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusConflict} {
+		if res, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"}); err != nil || res.StatusCode != status {
+			t.Fatalf("status %d: expected success, got %+v %v", status, res, err)
+		}
+	}
+	status = http.StatusServiceUnavailable
+	_, err := s.Send(context.Background(), SendRequest{To: "a", Content: "b"})
+	if rl, ok := IsRateLimited(err); !ok || rl.RetryAfter != 3*time.Second {
+		t.Fatalf("expected a rate limit from the rule, got %v", err)
+	}
+}
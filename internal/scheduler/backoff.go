@@ -0,0 +1,56 @@
+package scheduler
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	DefaultBackoffInitial    = 10 * time.Second
+	DefaultBackoffMax        = 10 * time.Minute
+	DefaultBackoffMultiplier = 2.0
+)
+
+// Backoff is the retry delay policy for messages that failed to send
+type Backoff struct {
+	// Initial is the delay after the first failed attempt
+	Initial time.Duration
+	// Max caps the delay
+	Max time.Duration
+	// Multiplier grows the delay after each failed attempt
+	Multiplier float64
+	// Jitter randomizes the delay by +/- this fraction (0-1)
+	// so that messages failed together do not retry together
+	Jitter float64
+}
+
+// withDefaults fills unset fields with the defaults
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = DefaultBackoffInitial
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoffMax
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = DefaultBackoffMultiplier
+	}
+	b.Jitter = math.Min(math.Max(b.Jitter, 0), 1)
+	return b
+}
+
+// Delay returns how long to wait before retrying a message
+// that has failed attempts times
+func (b Backoff) Delay(attempts int) time.Duration {
+	b = b.withDefaults()
+	if attempts < 1 {
+		attempts = 1
+	}
+	d := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempts-1))
+	d = math.Min(d, float64(b.Max))
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(math.Min(d, float64(b.Max)))
+}
@@ -0,0 +1,35 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff_Exponential(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := b.Delay(i + 1); got != w {
+			t.Fatalf("attempt %d: expected %s, got %s", i+1, w, got)
+		}
+	}
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Second, Max: time.Hour, Multiplier: 2, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		got := b.Delay(1)
+		if got < 5*time.Second || got > 15*time.Second {
+			t.Fatalf("delay %s outside jitter bounds", got)
+		}
+	}
+}
+
+func TestBackoff_Defaults(t *testing.T) {
+	if got := (Backoff{}).Delay(1); got != DefaultBackoffInitial {
+		t.Fatalf("expected %s, got %s", DefaultBackoffInitial, got)
+	}
+	if got := (Backoff{}).Delay(100); got != DefaultBackoffMax {
+		t.Fatalf("expected cap %s, got %s", DefaultBackoffMax, got)
+	}
+}
@@ -2,36 +2,132 @@ package scheduler
 
 import (
 	"context"
+	"errors"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hakan-sariman/insider-assessment/internal/cache"
 	"github.com/hakan-sariman/insider-assessment/internal/model"
 	"github.com/hakan-sariman/insider-assessment/internal/outbound"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
 
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 // Store is the store interface for the scheduler
 type Store interface {
-	// FetchUnsent fetches unsent messages for update
-	FetchUnsent(ctx context.Context, n int) ([]model.Message, error)
-	// MarkSent marks a message as sent
-	MarkSent(ctx context.Context, id string, sentAt time.Time) error
-	// IncrementAttempt increments the attempt count for a message
-	IncrementAttempt(ctx context.Context, id string, lastErr *string) error
+	// FetchUnsent claims unsent messages for owner for the lease duration
+	FetchUnsent(ctx context.Context, owner string, n int, lease time.Duration) ([]model.Message, error)
+	// MarkSent marks a leased message as sent
+	MarkSent(ctx context.Context, id, owner string, d model.Delivery) error
+	// IncrementAttempt increments the attempt count for a leased message,
+	// it is due again after retryIn
+	IncrementAttempt(ctx context.Context, id, owner string, lastErr *string, retryIn time.Duration) error
+	// MarkFailed records the last attempt of a leased message and dead-letters it
+	MarkFailed(ctx context.Context, id, owner string, lastErr *string) error
+	// Defer returns a leased message to the queue without charging an attempt,
+	// it is due again after retryIn
+	Defer(ctx context.Context, id, owner string, retryIn time.Duration) error
 }
 
+// Notifier is implemented by stores that announce newly inserted messages,
+// Listen calls onNotify for every announcement until ctx is done
+type Notifier interface {
+	Listen(ctx context.Context, onNotify func()) error
+}
+
+// Elector is implemented by stores that elect a single leader among replicas
+type Elector interface {
+	// Campaign contends for leadership as id until ctx is done, retrying
+	// every retry, and calls onChange when leadership is gained or lost
+	Campaign(ctx context.Context, id string, retry time.Duration, onChange func(leader bool)) error
+	// Leader returns the id of the current leader, "" when there is none
+	Leader(ctx context.Context) (string, error)
+}
+
+// LeaderInfo tells which replica runs the scheduler
+type LeaderInfo struct {
+	// Election is false when every replica runs its scheduler
+	Election bool `json:"election"`
+	// Leader is the id of the replica running the scheduler
+	Leader string `json:"leader,omitempty"`
+	// Self is the id of this replica
+	Self     string `json:"self"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+const (
+	// DefaultLeaseDuration is used when Config.LeaseDuration is not set
+	DefaultLeaseDuration = time.Minute
+	// DefaultCacheTTL is used when Config.CacheTTL is not set
+	DefaultCacheTTL = 24 * time.Hour
+	// DefaultConcurrency is used when Config.Concurrency is not set
+	DefaultConcurrency = 1
+	// DefaultNotifyDebounce is used when Config.NotifyDebounce is not set
+	DefaultNotifyDebounce = 100 * time.Millisecond
+	// DefaultElectionRetry is used when Config.ElectionRetry is not set
+	DefaultElectionRetry = 5 * time.Second
+)
+
+// Mode is how the scheduler paces its batches
+type Mode string
+
+const (
+	// ModeTick sends at most one batch every interval
+	ModeTick Mode = "tick"
+	// ModeDrain sends batches back to back while there is work,
+	// it only waits for the interval or a Wake when the queue is empty
+	ModeDrain Mode = "drain"
+)
+
 // Config is the configuration for the scheduler
 type Config struct {
-	Enabled   bool
+	// Enabled lets the scheduler run on this replica, a disabled
+	// replica never sends messages whatever the desired state is
+	Enabled bool
+	// Interval and BatchSize can be changed later with Tune
 	Interval  time.Duration
 	BatchSize int
+	// Mode is ModeTick (default) or ModeDrain
+	Mode Mode
+	// LeaseDuration is how long claimed messages stay reserved for this
+	// scheduler, it should cover the worst case send time of a batch
+	LeaseDuration time.Duration
+	// MaxAttempts is the number of failed attempts after which a message
+	// is dead-lettered, zero retries forever
+	MaxAttempts int
+	// Backoff is the retry delay policy after a failed attempt
+	Backoff Backoff
+	// Concurrency is the number of messages of a batch sent in parallel
+	Concurrency int
+	// SendTimeout bounds the send of a single message, defaults to
+	// LeaseDuration. A send is also cut short before the message's lease
+	// expires, since another replica may claim it again after that.
+	SendTimeout time.Duration
+	// Listen starts a batch early when the store is a Notifier
+	// and announces new messages
+	Listen bool
+	// NotifyDebounce is how long announcements are collected
+	// before the batch they trigger starts
+	NotifyDebounce time.Duration
+	// CacheTTL is how long the provider message id of a sent message
+	// is cached to resolve delivery receipts
+	CacheTTL time.Duration
+	// LeaderElection only runs batches on the replica elected leader
+	// when the store is an Elector
+	LeaderElection bool
+	// ElectionRetry is how often followers try to take over leadership
+	// and the leader checks it still holds it
+	ElectionRetry time.Duration
 }
 
 // Scheduler is the scheduler
 type Scheduler struct {
 	cfg    Config
+	owner  string
 	store  Store
 	cache  *cache.Redis
 	sender outbound.Sender
@@ -40,20 +136,89 @@ type Scheduler struct {
 	mtx       sync.Mutex
 	ctxCancel context.CancelCauseFunc
 	running   bool
+	// done is closed once the loop started by Start has returned
+	done chan struct{}
+	// wake makes a draining scheduler look for work before the interval ends
+	wake chan struct{}
+	// notified is signalled by the store's announcements of new messages
+	notified chan struct{}
+	// retune makes the loop restart its interval after Tune
+	retune chan struct{}
+	// leader is set while this replica is the elected leader
+	leader atomic.Bool
+	// counters keep the tick results for Stats
+	counters counters
 }
 
 // New creates a new scheduler
 func New(cfg Config, store Store, cache *cache.Redis, sender outbound.Sender, log *zap.Logger) *Scheduler {
+	if cfg.LeaseDuration <= 0 {
+		cfg.LeaseDuration = DefaultLeaseDuration
+	}
+	switch cfg.Mode {
+	case ModeTick, ModeDrain:
+	case "":
+		cfg.Mode = ModeTick
+	default:
+		log.Warn("unknown scheduler mode, using tick", zap.String("mode", string(cfg.Mode)))
+		cfg.Mode = ModeTick
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultConcurrency
+	}
+	if cfg.SendTimeout <= 0 {
+		cfg.SendTimeout = cfg.LeaseDuration
+	}
+	if cfg.NotifyDebounce <= 0 {
+		cfg.NotifyDebounce = DefaultNotifyDebounce
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = DefaultCacheTTL
+	}
+	if cfg.ElectionRetry <= 0 {
+		cfg.ElectionRetry = DefaultElectionRetry
+	}
+	if _, ok := store.(Elector); cfg.LeaderElection && !ok {
+		log.Warn("store does not support leader election, every replica runs the scheduler")
+		cfg.LeaderElection = false
+	}
 	return &Scheduler{
-		cfg:    cfg,
-		store:  store,
-		cache:  cache,
-		sender: sender,
-		log:    log,
+		cfg:      cfg,
+		owner:    newOwnerID(),
+		store:    store,
+		cache:    cache,
+		sender:   sender,
+		log:      log,
+		wake:     make(chan struct{}, 1),
+		notified: make(chan struct{}, 1),
+		retune:   make(chan struct{}, 1),
 	}
 }
 
-// Start starts the scheduler
+// newOwnerID returns the lease owner identity of this process
+func newOwnerID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "scheduler"
+	}
+	return host + "-" + uuid.NewString()[:8]
+}
+
+// ID returns the lease owner identity of the scheduler
+func (s *Scheduler) ID() string { return s.owner }
+
+// Enabled reports whether the scheduler may run on this replica
+func (s *Scheduler) Enabled() bool { return s.cfg.Enabled }
+
+// Running reports whether the scheduler loop is running
+func (s *Scheduler) Running() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.running
+}
+
+// Start starts the scheduler, it runs until Stop is called or ctx is done.
+// Use a Supervisor to run it independently of the caller's context.
 func (s *Scheduler) Start(ctx context.Context) {
 	s.mtx.Lock()
 	if s.running {
@@ -65,92 +230,382 @@ func (s *Scheduler) Start(ctx context.Context) {
 	var sCtx context.Context
 	sCtx, s.ctxCancel = context.WithCancelCause(ctx)
 	s.running = true
+	done := make(chan struct{})
+	s.done = done
 	s.mtx.Unlock()
 
-	s.log.Info("scheduler started", zap.Duration("interval", s.cfg.Interval), zap.Int("batch", s.cfg.BatchSize))
+	t := s.Tuning()
+	s.log.Info("scheduler started", zap.String("owner", s.owner), zap.String("mode", string(s.cfg.Mode)), zap.Duration("interval", t.Interval), zap.Int("batch", t.BatchSize), zap.Int("concurrency", s.cfg.Concurrency))
+	if s.cfg.Mode == ModeDrain {
+		s.Wake()
+	}
 	go func() {
-		ticker := time.NewTicker(s.cfg.Interval)
-		defer ticker.Stop()
-		for {
-
-			select {
-			case <-sCtx.Done():
-				s.log.Info("scheduler context done", zap.Error(context.Cause(sCtx)))
-				return
-			case <-ticker.C:
-				s.tick(sCtx)
+		defer close(done)
+		defer func() {
+			// the loop also ends when ctx is done without Stop being called
+			s.mtx.Lock()
+			if s.done == done {
+				s.running = false
 			}
+			s.mtx.Unlock()
+		}()
+		var wg sync.WaitGroup
+		if n, ok := s.store.(Notifier); ok && s.cfg.Listen {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.listen(sCtx, n)
+			}()
+		}
+		if e, ok := s.store.(Elector); ok && s.cfg.LeaderElection {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.campaign(sCtx, e)
+			}()
 		}
+		s.loop(sCtx)
+		wg.Wait()
 	}()
 }
 
-// Stop stops the scheduler
+// listen forwards the store's announcements of new messages to the loop
+func (s *Scheduler) listen(ctx context.Context, n Notifier) {
+	err := n.Listen(ctx, func() {
+		select {
+		case s.notified <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		s.log.Error("scheduler: listen failed", zap.Error(err))
+	}
+}
+
+// campaign keeps leader up to date with the election
+func (s *Scheduler) campaign(ctx context.Context, e Elector) {
+	err := e.Campaign(ctx, s.owner, s.cfg.ElectionRetry, func(leader bool) {
+		s.leader.Store(leader)
+		s.log.Info("scheduler: leadership changed", zap.String("owner", s.owner), zap.Bool("leader", leader))
+		if leader {
+			s.Wake()
+		}
+	})
+	s.leader.Store(false)
+	if err != nil && ctx.Err() == nil {
+		s.log.Error("scheduler: campaign failed", zap.Error(err))
+	}
+}
+
+// isLeader reports whether this replica may run batches
+func (s *Scheduler) isLeader() bool {
+	return !s.cfg.LeaderElection || s.leader.Load()
+}
+
+// Leader returns which replica runs the scheduler
+func (s *Scheduler) Leader(ctx context.Context) (LeaderInfo, error) {
+	info := LeaderInfo{Election: s.cfg.LeaderElection, Self: s.owner, IsLeader: s.isLeader()}
+	if !s.cfg.LeaderElection {
+		return info, nil
+	}
+	leader, err := s.store.(Elector).Leader(ctx)
+	if err != nil {
+		return info, err
+	}
+	info.Leader = leader
+	return info, nil
+}
+
+// loop runs batches until ctx is done
+func (s *Scheduler) loop(ctx context.Context) {
+	ticker := time.NewTicker(s.Tuning().Interval)
+	defer ticker.Stop()
+
+	// only a draining scheduler is woken up early
+	var wake <-chan struct{}
+	if s.cfg.Mode == ModeDrain {
+		wake = s.wake
+	}
+	// announcements are collected for NotifyDebounce, then start one batch
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Info("scheduler context done", zap.Error(context.Cause(ctx)))
+			return
+		case <-ticker.C:
+		case <-s.retune:
+			ticker.Reset(s.Tuning().Interval)
+			continue
+		case <-wake:
+		case <-s.notified:
+			if debounce == nil {
+				debounce = time.After(s.cfg.NotifyDebounce)
+			}
+			continue
+		case <-debounce:
+			debounce = nil
+			s.log.Debug("scheduler: new messages announced")
+		}
+		if s.cfg.Mode == ModeDrain {
+			s.drain(ctx)
+		} else {
+			s.tick(ctx)
+		}
+	}
+}
+
+// drain runs batches back to back until one claims less than a full batch,
+// which means the queue has no more due messages. It also ends when most of
+// a batch was deferred, the next batch would only claim and defer it again
+// while rate limits or an open circuit hold the messages back.
+func (s *Scheduler) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		r := s.tick(ctx)
+		if r.claimed == 0 || r.claimed < s.Tuning().BatchSize {
+			return
+		}
+		if r.deferred > r.sent+r.failed {
+			s.log.Info("drain: most of the batch deferred, waiting for the interval", zap.Int("claimed", r.claimed), zap.Int("deferred", r.deferred))
+			return
+		}
+	}
+}
+
+// Wake tells a draining scheduler that new messages are waiting,
+// it does not block and wakeups that arrive while one is pending are merged
+func (s *Scheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops the scheduler. No new messages are sent once it is called,
+// it returns after the sends already in flight have been recorded.
 func (s *Scheduler) Stop(reason error) {
 	s.mtx.Lock()
-	defer s.mtx.Unlock()
 	if !s.running {
+		s.mtx.Unlock()
 		s.log.Info("scheduler not running")
 		return
 	}
 	s.running = false
 	s.ctxCancel(reason)
+	done := s.done
+	s.mtx.Unlock()
+
+	<-done
+	s.log.Info("scheduler stopped", zap.Error(reason))
 }
 
-// tick processes the unsent messages
-func (s *Scheduler) tick(ctx context.Context) {
+// circuit is implemented by senders guarded by a circuit breaker
+type circuit interface {
+	Open() bool
+}
+
+// outcome is what became of a claimed message
+type outcome int
+
+const (
+	outcomeSent outcome = iota
+	outcomeFailed
+	outcomeDeferred
+)
 
-	// fetch unsent messages
-	msgs, err := s.store.FetchUnsent(ctx, s.cfg.BatchSize)
+// tickResult counts what became of the messages claimed by a tick
+type tickResult struct {
+	claimed, sent, failed, deferred int
+}
+
+// tick processes a batch of unsent messages and returns what became of them
+func (s *Scheduler) tick(ctx context.Context) tickResult {
+	var sent, failed, deferred atomic.Int32
+	start := time.Now()
+	defer func() { s.counters.recordTick(start, int(sent.Load()), int(failed.Load())) }()
+
+	// followers leave the queue to the leader
+	if !s.isLeader() {
+		s.log.Debug("tick: not the leader, skipping")
+		return tickResult{}
+	}
+
+	// leave messages unclaimed while the provider is failing
+	if c, ok := s.sender.(circuit); ok && c.Open() {
+		s.log.Info("tick: circuit open, skipping")
+		return tickResult{}
+	}
+
+	// claim unsent messages
+	msgs, err := s.store.FetchUnsent(ctx, s.owner, s.Tuning().BatchSize, s.cfg.LeaseDuration)
 	if err != nil {
 		s.log.Error("fetch unsent", zap.Error(err))
-		return
+		s.counters.recordError(err)
+		return tickResult{}
 	}
 	if len(msgs) == 0 {
 		s.log.Info("tick: no messages to process")
-		return
+		return tickResult{}
 	}
 
 	// process messages
-	s.log.Info("tick: processing messages", zap.Int("count", len(msgs)))
-	now := time.Now().UTC()
+	workers := min(s.cfg.Concurrency, len(msgs))
+	if workers < 1 {
+		workers = 1
+	}
+	s.log.Info("tick: processing messages", zap.Int("count", len(msgs)), zap.Int("workers", workers))
+	jobs := make(chan model.Message)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range jobs {
+				// messages not started before the context is done go back to
+				// the queue right away instead of waiting for their lease to expire
+				if ctx.Err() != nil {
+					s.deferMessage(context.WithoutCancel(ctx), m, 0)
+					deferred.Add(1)
+					continue
+				}
+				switch s.process(ctx, m) {
+				case outcomeSent:
+					sent.Add(1)
+				case outcomeFailed:
+					failed.Add(1)
+				case outcomeDeferred:
+					deferred.Add(1)
+				}
+			}
+		}()
+	}
+	// every message is handed to a worker, the ones that cannot start are released
 	for _, m := range msgs {
+		jobs <- m
+	}
+	close(jobs)
+	if err := ctx.Err(); err != nil {
+		s.log.Info("tick: context done, unstarted messages released", zap.Error(context.Cause(ctx)))
+	}
+	wg.Wait()
+	return tickResult{claimed: len(msgs), sent: int(sent.Load()), failed: int(failed.Load()), deferred: int(deferred.Load())}
+}
 
-		// check context
-		if ctx.Err() != nil {
-			s.log.Info("tick: context done", zap.Error(ctx.Err()))
-			return
-		}
+// leaseMargin is how long before its lease expires a message is no longer
+// sent, it leaves time to record the outcome and absorbs clock skew with the store
+func (s *Scheduler) leaseMargin() time.Duration {
+	return s.cfg.LeaseDuration / 10
+}
 
-		// send message by outbound webhook
-		s.log.Info("tick: sending message", zap.String("id", m.ID.String()), zap.String("to", m.To))
-		messageID, err := s.sender.Send(ctx, outbound.SendRequest{To: m.To, Content: m.Content})
-		if err != nil {
-			s.log.Warn("tick: send error", zap.String("id", m.ID.String()), zap.Error(err))
-			err = s.store.IncrementAttempt(ctx, m.ID.String(), strPtr(err.Error()))
-			if err != nil {
-				s.log.Error("tick: increment attempt failed", zap.String("id", m.ID.String()), zap.Error(err))
-			}
-			continue
+// process sends a claimed message, records the outcome and returns it.
+// A send that has started is finished and recorded even when ctx is
+// cancelled, so that Stop does not leave it unrecorded. It is bounded by
+// SendTimeout and by what is left of the lease, a message whose lease is
+// about to expire is put back in the queue without being sent.
+func (s *Scheduler) process(ctx context.Context, m model.Message) outcome {
+	ctx = context.WithoutCancel(ctx)
+	timeout := s.cfg.SendTimeout
+	if m.LeaseExpiresAt != nil {
+		left := time.Until(*m.LeaseExpiresAt) - s.leaseMargin()
+		if left <= 0 {
+			s.log.Warn("tick: lease about to expire, deferring", zap.String("id", m.ID.String()), zap.Timep("lease_expires_at", m.LeaseExpiresAt))
+			s.deferMessage(ctx, m, 0)
+			return outcomeDeferred
 		}
+		if timeout <= 0 || left < timeout {
+			timeout = left
+		}
+	}
+	sendCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-		// mark message as sent
-		s.log.Info("tick: message sent", zap.String("id", m.ID.String()), zap.String("message_id", messageID))
-		if err := s.store.MarkSent(ctx, m.ID.String(), now); err != nil {
-			s.log.Error("tick: mark sent failed", zap.String("id", m.ID.String()), zap.Error(err))
-			continue
+	// send message by outbound webhook
+	s.log.Info("tick: sending message", zap.String("id", m.ID.String()), zap.String("to", m.To))
+	res, err := s.sender.Send(sendCtx, outbound.SendRequest{ID: m.ID.String(), To: m.To, Content: m.Content})
+	if rl, ok := outbound.IsRateLimited(err); ok {
+		s.log.Info("tick: rate limited, deferring", zap.String("id", m.ID.String()), zap.String("scope", rl.Scope), zap.Duration("retry_after", rl.RetryAfter))
+		s.deferMessage(ctx, m, rl.RetryAfter)
+		return outcomeDeferred
+	}
+	if co, ok := outbound.IsCircuitOpen(err); ok {
+		s.log.Info("tick: circuit open, deferring", zap.String("id", m.ID.String()), zap.Duration("retry_after", co.RetryAfter))
+		s.deferMessage(ctx, m, co.RetryAfter)
+		return outcomeDeferred
+	}
+	if err != nil {
+		s.log.Warn("tick: send error", zap.String("id", m.ID.String()), zap.Error(err))
+		s.counters.recordError(err)
+		s.recordFailure(ctx, m, err)
+		return outcomeFailed
+	}
+
+	// mark message as sent
+	now := time.Now().UTC()
+	messageID := res.MessageID
+	s.log.Info("tick: message sent", zap.String("id", m.ID.String()), zap.String("provider", res.Provider), zap.String("message_id", messageID), zap.Int("status", res.StatusCode), zap.Duration("latency", res.Latency))
+	delivery := model.Delivery{
+		Provider:          res.Provider,
+		ProviderMessageID: messageID,
+		ProviderStatus:    res.StatusCode,
+		ProviderLatency:   res.Latency,
+		SentAt:            now,
+	}
+	if err := s.store.MarkSent(ctx, m.ID.String(), s.owner, delivery); err != nil {
+		if errors.Is(err, storage.ErrLeaseLost) {
+			s.log.Warn("tick: lease lost before marking sent", zap.String("id", m.ID.String()), zap.String("message_id", messageID))
+			return outcomeSent
 		}
-		s.log.Info("tick: message marked sent", zap.String("id", m.ID.String()), zap.String("message_id", messageID))
-
-		// set message id in cache
-		if s.cache != nil && messageID != "" {
-			s.log.Debug("tick: setting message id in cache", zap.String("id", m.ID.String()), zap.String("message_id", messageID))
-			err = s.cache.SetSent(ctx, "message:"+messageID, now, 24*time.Hour)
-			if err != nil {
-				s.log.Error("tick: cache set sent failed", zap.String("id", m.ID.String()), zap.Error(err))
-			}
+		s.log.Error("tick: mark sent failed", zap.String("id", m.ID.String()), zap.Error(err))
+		s.counters.recordError(err)
+		return outcomeSent
+	}
+	s.log.Info("tick: message marked sent", zap.String("id", m.ID.String()), zap.String("message_id", messageID))
 
+	// set message id in cache
+	if s.cache != nil && messageID != "" {
+		s.log.Debug("tick: setting message id in cache", zap.String("id", m.ID.String()), zap.String("message_id", messageID))
+		err = s.cache.SetMessageID(ctx, cache.MessageKey(messageID), m.ID.String(), s.cfg.CacheTTL)
+		if err != nil {
+			s.log.Error("tick: cache set message id failed", zap.String("id", m.ID.String()), zap.Error(err))
 		}
 	}
+	return outcomeSent
+}
+
+// recordFailure charges a failed attempt to a message, dead-lettering it
+// once MaxAttempts is reached or right away when the error is permanent
+func (s *Scheduler) recordFailure(ctx context.Context, m model.Message, sendErr error) {
+	var err error
+	if outbound.IsPermanent(sendErr) {
+		s.log.Warn("tick: permanent send error, dead-lettering", zap.String("id", m.ID.String()), zap.Error(sendErr))
+		err = s.store.MarkFailed(ctx, m.ID.String(), s.owner, strPtr(sendErr.Error()))
+	} else if s.cfg.MaxAttempts > 0 && m.AttemptCount+1 >= s.cfg.MaxAttempts {
+		s.log.Warn("tick: max attempts reached, dead-lettering", zap.String("id", m.ID.String()), zap.Int("attempts", m.AttemptCount+1))
+		err = s.store.MarkFailed(ctx, m.ID.String(), s.owner, strPtr(sendErr.Error()))
+	} else {
+		retryIn := s.cfg.Backoff.Delay(m.AttemptCount + 1)
+		s.log.Info("tick: retry scheduled", zap.String("id", m.ID.String()), zap.Duration("retry_in", retryIn))
+		err = s.store.IncrementAttempt(ctx, m.ID.String(), s.owner, strPtr(sendErr.Error()), retryIn)
+	}
+	if errors.Is(err, storage.ErrLeaseLost) {
+		s.log.Warn("tick: lease lost before recording attempt", zap.String("id", m.ID.String()))
+	} else if err != nil {
+		s.log.Error("tick: record attempt failed", zap.String("id", m.ID.String()), zap.Error(err))
+	}
+}
+
+// deferMessage returns a message to the queue without charging an attempt
+func (s *Scheduler) deferMessage(ctx context.Context, m model.Message, retryIn time.Duration) {
+	err := s.store.Defer(ctx, m.ID.String(), s.owner, retryIn)
+	if errors.Is(err, storage.ErrLeaseLost) {
+		s.log.Warn("tick: lease lost before deferring", zap.String("id", m.ID.String()))
+	} else if err != nil {
+		s.log.Error("tick: defer failed", zap.String("id", m.ID.String()), zap.Error(err))
+	}
 }
 
 func strPtr(s string) *string { return &s }
@@ -3,53 +3,108 @@ package scheduler
 import (
 	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/hakan-sariman/insider-assessment/internal/model"
 	"github.com/hakan-sariman/insider-assessment/internal/outbound"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
 
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 type fakeStore struct {
+	mu            sync.Mutex
 	msgs          []model.Message
+	owner         string
 	sent          int
 	incAttempts   int
+	failed        int
+	deferred      int
+	deferredIDs   []string
+	retryIn       time.Duration
+	delivery      model.Delivery
 	fetchErr      error
 	markSentErr   error
 	incAttemptErr error
+	// consume removes claimed messages like the real store does
+	consume bool
+	fetches int
 }
 
-func (f *fakeStore) FetchUnsent(ctx context.Context, n int) ([]model.Message, error) {
+func (f *fakeStore) FetchUnsent(ctx context.Context, owner string, n int, lease time.Duration) ([]model.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.owner = owner
+	f.fetches++
 	if f.fetchErr != nil {
 		return nil, f.fetchErr
 	}
-	if len(f.msgs) < n {
-		return f.msgs, nil
+	claimed := f.msgs
+	if len(f.msgs) >= n {
+		claimed = f.msgs[:n]
 	}
-	return f.msgs[:n], nil
+	if f.consume {
+		f.msgs = f.msgs[len(claimed):]
+	}
+	return claimed, nil
+}
+
+func (f *fakeStore) add(msgs ...model.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.msgs = append(f.msgs, msgs...)
 }
-func (f *fakeStore) MarkSent(ctx context.Context, id string, sentAt time.Time) error {
+
+func (f *fakeStore) sentCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sent
+}
+func (f *fakeStore) MarkSent(ctx context.Context, id, owner string, d model.Delivery) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.markSentErr != nil {
 		return f.markSentErr
 	}
 	f.sent++
+	f.delivery = d
 	return nil
 }
-func (f *fakeStore) IncrementAttempt(ctx context.Context, id string, lastErr *string) error {
+func (f *fakeStore) IncrementAttempt(ctx context.Context, id, owner string, lastErr *string, retryIn time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.incAttempts++
+	f.retryIn = retryIn
 	if f.incAttemptErr != nil {
 		return f.incAttemptErr
 	}
 	return nil
 }
 
+func (f *fakeStore) MarkFailed(ctx context.Context, id, owner string, lastErr *string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed++
+	return nil
+}
+
+func (f *fakeStore) Defer(ctx context.Context, id, owner string, retryIn time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deferred++
+	f.deferredIDs = append(f.deferredIDs, id)
+	f.retryIn = retryIn
+	return nil
+}
+
 type fakeSender struct{}
 
-func (f fakeSender) Send(ctx context.Context, req outbound.SendRequest) (string, error) {
-	return "id", nil
+func (f fakeSender) Send(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+	return outbound.SendResult{MessageID: "id"}, nil
 }
 
 func TestTick_SendsTwo(t *testing.T) {
@@ -69,13 +124,28 @@ func TestTick_SendsTwo(t *testing.T) {
 
 // sender that can be configured per test via a function
 type funcSender struct {
-	fn func(ctx context.Context, req outbound.SendRequest) (string, error)
+	fn func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error)
 }
 
-func (f funcSender) Send(ctx context.Context, req outbound.SendRequest) (string, error) {
+func (f funcSender) Send(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
 	return f.fn(ctx, req)
 }
 
+func TestTick_PassesMessageID(t *testing.T) {
+	msg := model.Message{ID: uuid.New(), To: "a", Content: "b"}
+	store := &fakeStore{msgs: []model.Message{msg}}
+	var got string
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		got = req.ID
+		return outbound.SendResult{MessageID: "mid"}, nil
+	}}
+	s := &Scheduler{cfg: Config{Interval: time.Hour, BatchSize: 1}, store: store, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	if got != msg.ID.String() {
+		t.Fatalf("expected send request id %s, got %q", msg.ID, got)
+	}
+}
+
 func TestTick_NoMessages(t *testing.T) {
 	store := &fakeStore{msgs: nil}
 	cfg := Config{Enabled: true, Interval: time.Hour, BatchSize: 10}
@@ -90,8 +160,8 @@ func TestTick_SendError_IncrementsAttempt(t *testing.T) {
 	msgs := []model.Message{{ID: uuid.New(), To: "a", Content: "b"}}
 	store := &fakeStore{msgs: msgs}
 	sendErr := errors.New("send failed")
-	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (string, error) {
-		return "", sendErr
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		return outbound.SendResult{}, sendErr
 	}}
 	cfg := Config{Enabled: true, Interval: time.Hour, BatchSize: 5}
 	s := &Scheduler{cfg: cfg, store: store, cache: nil, sender: sender, log: zap.NewNop()}
@@ -104,10 +174,44 @@ func TestTick_SendError_IncrementsAttempt(t *testing.T) {
 	}
 }
 
+func TestTick_SendError_SchedulesBackoff(t *testing.T) {
+	msgs := []model.Message{{ID: uuid.New(), To: "a", Content: "b", AttemptCount: 2}}
+	store := &fakeStore{msgs: msgs}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		return outbound.SendResult{}, errors.New("send failed")
+	}}
+	cfg := Config{Enabled: true, Interval: time.Hour, BatchSize: 5, Backoff: Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 3}}
+	s := &Scheduler{cfg: cfg, store: store, cache: nil, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	// third failed attempt: 1s * 3^2
+	if store.retryIn != 9*time.Second {
+		t.Fatalf("expected retry in 9s, got %s", store.retryIn)
+	}
+}
+
+func TestTick_MaxAttempts_DeadLetters(t *testing.T) {
+	msgs := []model.Message{
+		{ID: uuid.New(), To: "a", Content: "b", AttemptCount: 1},
+		{ID: uuid.New(), To: "a", Content: "b", AttemptCount: 2},
+	}
+	store := &fakeStore{msgs: msgs}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		return outbound.SendResult{}, errors.New("send failed")
+	}}
+	cfg := Config{Enabled: true, Interval: time.Hour, BatchSize: 5, MaxAttempts: 3}
+	s := &Scheduler{cfg: cfg, store: store, cache: nil, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	if store.incAttempts != 1 || store.failed != 1 {
+		t.Fatalf("expected 1 retry and 1 dead-letter, got inc=%d failed=%d", store.incAttempts, store.failed)
+	}
+}
+
 func TestTick_MarkSentError_DoesNotCountAsSent(t *testing.T) {
 	msgs := []model.Message{{ID: uuid.New(), To: "a", Content: "b"}}
 	store := &fakeStore{msgs: msgs, markSentErr: errors.New("db error")}
-	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (string, error) { return "mid", nil }}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		return outbound.SendResult{MessageID: "mid"}, nil
+	}}
 	cfg := Config{Enabled: true, Interval: time.Hour, BatchSize: 5}
 	s := &Scheduler{cfg: cfg, store: store, cache: nil, sender: sender, log: zap.NewNop()}
 	s.tick(context.Background())
@@ -116,6 +220,30 @@ func TestTick_MarkSentError_DoesNotCountAsSent(t *testing.T) {
 	}
 }
 
+func TestTick_LeaseLost_DoesNotCountAsSent(t *testing.T) {
+	msgs := []model.Message{{ID: uuid.New(), To: "a", Content: "b"}}
+	store := &fakeStore{msgs: msgs, markSentErr: storage.ErrLeaseLost}
+	cfg := Config{Enabled: true, Interval: time.Hour, BatchSize: 5}
+	s := &Scheduler{cfg: cfg, owner: "replica-a", store: store, cache: nil, sender: fakeSender{}, log: zap.NewNop()}
+	s.tick(context.Background())
+	if store.owner != "replica-a" {
+		t.Fatalf("expected claim as replica-a, got %q", store.owner)
+	}
+	if store.sent != 0 || store.incAttempts != 0 {
+		t.Fatalf("expected no operations after lease loss, got sent=%d inc=%d", store.sent, store.incAttempts)
+	}
+}
+
+func TestNew_DefaultsLease(t *testing.T) {
+	s := New(Config{Interval: time.Hour, BatchSize: 1}, &fakeStore{}, nil, fakeSender{}, zap.NewNop())
+	if s.cfg.LeaseDuration != DefaultLeaseDuration {
+		t.Fatalf("expected default lease, got %s", s.cfg.LeaseDuration)
+	}
+	if s.ID() == "" || s.ID() == New(Config{}, &fakeStore{}, nil, fakeSender{}, zap.NewNop()).ID() {
+		t.Fatalf("expected unique owner id, got %q", s.ID())
+	}
+}
+
 func TestTick_RespectsAvailableLessThanBatch(t *testing.T) {
 	// Only 1 message available but batch size is 3
 	msgs := []model.Message{{ID: uuid.New(), To: "x", Content: "y"}}
@@ -137,10 +265,10 @@ func TestTick_ContextCancelledStopsProcessing(t *testing.T) {
 	store := &fakeStore{msgs: msgs}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	sender := funcSender{fn: func(c context.Context, req outbound.SendRequest) (string, error) {
+	sender := funcSender{fn: func(c context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
 		// cancel as soon as first send is attempted
 		cancel()
-		return "id", nil
+		return outbound.SendResult{MessageID: "id"}, nil
 	}}
 	cfg := Config{Enabled: true, Interval: time.Hour, BatchSize: 3}
 	s := &Scheduler{cfg: cfg, store: store, cache: nil, sender: sender, log: zap.NewNop()}
@@ -148,6 +276,9 @@ func TestTick_ContextCancelledStopsProcessing(t *testing.T) {
 	if store.sent != 1 {
 		t.Fatalf("expected only 1 processed before cancel, got %d", store.sent)
 	}
+	if store.deferred != 2 || store.retryIn != 0 {
+		t.Fatalf("expected the other 2 released right away, got deferred=%d retry=%s", store.deferred, store.retryIn)
+	}
 }
 
 func TestTick_FetchError(t *testing.T) {
@@ -160,3 +291,523 @@ func TestTick_FetchError(t *testing.T) {
 		t.Fatalf("expected no operations on fetch error, got sent=%d inc=%d", store.sent, store.incAttempts)
 	}
 }
+
+func TestTick_RecordsDelivery(t *testing.T) {
+	msgs := []model.Message{{ID: uuid.New(), To: "a", Content: "b"}}
+	store := &fakeStore{msgs: msgs}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		return outbound.SendResult{Provider: "primary", MessageID: "mid", StatusCode: 202, Latency: 30 * time.Millisecond}, nil
+	}}
+	cfg := Config{Enabled: true, Interval: time.Hour, BatchSize: 1}
+	s := &Scheduler{cfg: cfg, store: store, cache: nil, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	d := store.delivery
+	if d.Provider != "primary" || d.ProviderMessageID != "mid" || d.ProviderStatus != 202 || d.ProviderLatency != 30*time.Millisecond || d.SentAt.IsZero() {
+		t.Fatalf("unexpected delivery: %#v", d)
+	}
+}
+
+func TestTick_ConcurrentSendsAreBounded(t *testing.T) {
+	var msgs []model.Message
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, model.Message{ID: uuid.New(), To: "x", Content: "y"})
+	}
+	store := &fakeStore{msgs: msgs}
+	var inFlight, maxInFlight atomic.Int32
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			cur := maxInFlight.Load()
+			if n <= cur || maxInFlight.CompareAndSwap(cur, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return outbound.SendResult{MessageID: req.ID}, nil
+	}}
+	cfg := Config{Interval: time.Hour, BatchSize: 20, Concurrency: 4}
+	s := &Scheduler{cfg: cfg, store: store, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	if store.sent != 20 {
+		t.Fatalf("expected 20 sent, got %d", store.sent)
+	}
+	if m := maxInFlight.Load(); m < 2 || m > 4 {
+		t.Fatalf("expected between 2 and 4 sends in flight, got %d", m)
+	}
+}
+
+func TestTick_SendTimeout(t *testing.T) {
+	store := &fakeStore{msgs: []model.Message{{ID: uuid.New(), To: "x", Content: "y"}}}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		<-ctx.Done()
+		return outbound.SendResult{}, ctx.Err()
+	}}
+	cfg := Config{Interval: time.Hour, BatchSize: 1, SendTimeout: 20 * time.Millisecond}
+	s := &Scheduler{cfg: cfg, store: store, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	if store.incAttempts != 1 {
+		t.Fatalf("expected the timed out send to be charged an attempt, got %d", store.incAttempts)
+	}
+}
+
+func TestTick_SendEndsBeforeLeaseExpires(t *testing.T) {
+	expires := time.Now().Add(200 * time.Millisecond)
+	store := &fakeStore{msgs: []model.Message{{ID: uuid.New(), To: "x", Content: "y", LeaseExpiresAt: &expires}}}
+	var deadline time.Time
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		deadline, _ = ctx.Deadline()
+		return outbound.SendResult{MessageID: "mid"}, nil
+	}}
+	cfg := Config{Interval: time.Hour, BatchSize: 1, LeaseDuration: time.Second, SendTimeout: time.Hour}
+	s := &Scheduler{cfg: cfg, store: store, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	if store.sent != 1 || deadline.IsZero() || !deadline.Before(expires.Add(-s.leaseMargin()).Add(time.Millisecond)) {
+		t.Fatalf("expected the send to end a margin before the lease, deadline %s lease %s", deadline, expires)
+	}
+}
+
+func TestTick_ExpiringLeaseDefersUnsent(t *testing.T) {
+	expires := time.Now().Add(50 * time.Millisecond)
+	store := &fakeStore{msgs: []model.Message{{ID: uuid.New(), To: "x", Content: "y", LeaseExpiresAt: &expires}}}
+	var calls atomic.Int32
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		calls.Add(1)
+		return outbound.SendResult{MessageID: "mid"}, nil
+	}}
+	// a tenth of the lease is 100ms, more than what is left
+	cfg := Config{Interval: time.Hour, BatchSize: 1, LeaseDuration: time.Second}
+	s := &Scheduler{cfg: cfg, store: store, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	if calls.Load() != 0 || store.deferred != 1 || store.retryIn != 0 || store.incAttempts != 0 {
+		t.Fatalf("expected the message back in the queue unsent: calls=%d deferred=%d retry=%s inc=%d", calls.Load(), store.deferred, store.retryIn, store.incAttempts)
+	}
+}
+
+func TestStop_WaitsForInFlightSends(t *testing.T) {
+	store := &fakeStore{msgs: []model.Message{{ID: uuid.New(), To: "x", Content: "y"}}}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		close(started)
+		<-release
+		return outbound.SendResult{MessageID: "mid"}, nil
+	}}
+	s := New(Config{Interval: time.Millisecond, BatchSize: 1}, store, nil, sender, zap.NewNop())
+	s.Start(context.Background())
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop(errors.New("test"))
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while a send was in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.sent != 1 {
+		t.Fatalf("expected the in-flight send to be recorded, got %d", store.sent)
+	}
+}
+
+func TestStop_ReleasesUnstartedMessages(t *testing.T) {
+	msgs := []model.Message{{ID: uuid.New(), To: "x", Content: "y"}, {ID: uuid.New(), To: "x", Content: "y"}, {ID: uuid.New(), To: "x", Content: "y"}}
+	store := &fakeStore{msgs: msgs, consume: true}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		once.Do(func() { close(started) })
+		<-release
+		return outbound.SendResult{MessageID: "mid"}, nil
+	}}
+	s := New(Config{Interval: time.Millisecond, BatchSize: 3}, store, nil, sender, zap.NewNop())
+	s.Start(context.Background())
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop(errors.New("test"))
+		close(stopped)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	<-stopped
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	// Defer with no delay puts them back as unsent, due right away
+	if store.sent != 1 || store.retryIn != 0 || len(store.deferredIDs) != 2 ||
+		store.deferredIDs[0] != msgs[1].ID.String() || store.deferredIDs[1] != msgs[2].ID.String() {
+		t.Fatalf("expected the 2 unstarted messages released, got sent=%d deferred=%v retry=%s", store.sent, store.deferredIDs, store.retryIn)
+	}
+}
+
+func TestDrain_RunsBatchesUntilEmpty(t *testing.T) {
+	var msgs []model.Message
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, model.Message{ID: uuid.New(), To: "x", Content: "y"})
+	}
+	store := &fakeStore{msgs: msgs, consume: true}
+	s := &Scheduler{cfg: Config{Interval: time.Hour, BatchSize: 2, Mode: ModeDrain}, store: store, sender: fakeSender{}, log: zap.NewNop()}
+	s.drain(context.Background())
+	if store.sent != 5 {
+		t.Fatalf("expected 5 sent, got %d", store.sent)
+	}
+	// batches of 2, 2 and a short one of 1 that ends the drain
+	if store.fetches != 3 {
+		t.Fatalf("expected 3 fetches, got %d", store.fetches)
+	}
+}
+
+func TestDrain_SomeDeferredMessagesDoNotEndIt(t *testing.T) {
+	var msgs []model.Message
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, model.Message{ID: uuid.New(), To: "x", Content: "y"})
+	}
+	store := &fakeStore{msgs: msgs, consume: true}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		if req.ID == msgs[0].ID.String() {
+			return outbound.SendResult{}, &outbound.RateLimitedError{RetryAfter: time.Second, Scope: "recipient"}
+		}
+		return outbound.SendResult{MessageID: "mid"}, nil
+	}}
+	s := &Scheduler{cfg: Config{Interval: time.Hour, BatchSize: 2, Mode: ModeDrain}, store: store, sender: sender, log: zap.NewNop()}
+	s.drain(context.Background())
+	// the first batch is full and only half of it deferred, so the drain goes on
+	if store.sent != 3 || store.deferred != 1 || store.fetches != 3 {
+		t.Fatalf("unexpected: sent=%d deferred=%d fetches=%d", store.sent, store.deferred, store.fetches)
+	}
+}
+
+func TestDrain_DeferredBatchEndsIt(t *testing.T) {
+	var msgs []model.Message
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, model.Message{ID: uuid.New(), To: "x", Content: "y"})
+	}
+	// deferred messages stay due, like with a Retry-After of 0
+	store := &fakeStore{msgs: msgs}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		return outbound.SendResult{}, &outbound.RateLimitedError{Scope: "global"}
+	}}
+	s := &Scheduler{cfg: Config{Interval: time.Hour, BatchSize: 2, Mode: ModeDrain}, store: store, sender: sender, log: zap.NewNop()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.drain(context.Background())
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the drain to end when the whole batch is deferred")
+	}
+	if store.fetchCount() != 1 || store.deferred != 2 || store.sent != 0 {
+		t.Fatalf("unexpected: fetches=%d deferred=%d sent=%d", store.fetchCount(), store.deferred, store.sent)
+	}
+}
+
+func TestTick_ReturnsClaimed(t *testing.T) {
+	store := &fakeStore{msgs: []model.Message{{ID: uuid.New(), To: "x", Content: "y"}}}
+	s := &Scheduler{cfg: Config{Interval: time.Hour, BatchSize: 3}, store: store, sender: fakeSender{}, log: zap.NewNop()}
+	if r := s.tick(context.Background()); r != (tickResult{claimed: 1, sent: 1}) {
+		t.Fatalf("expected 1 claimed and sent, got %+v", r)
+	}
+	store.fetchErr = errors.New("boom")
+	if r := s.tick(context.Background()); r.claimed != 0 {
+		t.Fatalf("expected 0 claimed on fetch error, got %+v", r)
+	}
+}
+
+func TestWake_DrainModeSendsBeforeInterval(t *testing.T) {
+	store := &fakeStore{consume: true}
+	s := New(Config{Interval: time.Hour, BatchSize: 10, Mode: ModeDrain}, store, nil, fakeSender{}, zap.NewNop())
+	s.Start(context.Background())
+	defer s.Stop(errors.New("test done"))
+
+	store.add(model.Message{ID: uuid.New(), To: "x", Content: "y"})
+	s.Wake()
+	deadline := time.Now().Add(time.Second)
+	for store.sentCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the woken scheduler to send, got %d", store.sentCount())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNew_DefaultsMode(t *testing.T) {
+	if s := New(Config{Interval: time.Hour}, &fakeStore{}, nil, fakeSender{}, zap.NewNop()); s.cfg.Mode != ModeTick {
+		t.Fatalf("expected tick mode, got %q", s.cfg.Mode)
+	}
+	if s := New(Config{Interval: time.Hour, Mode: "bogus"}, &fakeStore{}, nil, fakeSender{}, zap.NewNop()); s.cfg.Mode != ModeTick {
+		t.Fatalf("expected unknown mode to fall back to tick, got %q", s.cfg.Mode)
+	}
+}
+
+// notifyStore announces n new messages in a burst once Listen is called
+type notifyStore struct {
+	*fakeStore
+	n int
+}
+
+func (f *notifyStore) Listen(ctx context.Context, onNotify func()) error {
+	for i := 0; i < f.n; i++ {
+		onNotify()
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (f *fakeStore) fetchCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches
+}
+
+func TestListen_DebouncesAnnouncements(t *testing.T) {
+	store := &notifyStore{fakeStore: &fakeStore{}, n: 10}
+	cfg := Config{Interval: time.Hour, BatchSize: 1, Listen: true, NotifyDebounce: 20 * time.Millisecond}
+	s := New(cfg, store, nil, fakeSender{}, zap.NewNop())
+	s.Start(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	s.Stop(errors.New("test done"))
+	if n := store.fetchCount(); n != 1 {
+		t.Fatalf("expected one batch for a burst of announcements, got %d", n)
+	}
+}
+
+func TestListen_Disabled(t *testing.T) {
+	store := &notifyStore{fakeStore: &fakeStore{}, n: 1}
+	cfg := Config{Interval: time.Hour, BatchSize: 1, NotifyDebounce: time.Millisecond}
+	s := New(cfg, store, nil, fakeSender{}, zap.NewNop())
+	s.Start(context.Background())
+	time.Sleep(30 * time.Millisecond)
+	s.Stop(errors.New("test done"))
+	if n := store.fetchCount(); n != 0 {
+		t.Fatalf("expected no batch without listen, got %d", n)
+	}
+}
+
+func TestTick_RateLimitedDefersWithoutAttempt(t *testing.T) {
+	msgs := []model.Message{{ID: uuid.New(), To: "a", Content: "b"}, {ID: uuid.New(), To: "c", Content: "d"}}
+	store := &fakeStore{msgs: msgs}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		if req.ID == msgs[1].ID.String() {
+			return outbound.SendResult{}, &outbound.RateLimitedError{RetryAfter: 3 * time.Second, Scope: "global"}
+		}
+		return outbound.SendResult{MessageID: "mid"}, nil
+	}}
+	cfg := Config{Interval: time.Hour, BatchSize: 2, MaxAttempts: 1}
+	s := &Scheduler{cfg: cfg, store: store, sender: sender, log: zap.NewNop()}
+	if r := s.tick(context.Background()); r != (tickResult{claimed: 2, sent: 1, deferred: 1}) {
+		t.Fatalf("expected deferred messages counted apart, got %+v", r)
+	}
+	if store.sent != 1 || store.deferred != 1 || store.incAttempts != 0 || store.failed != 0 {
+		t.Fatalf("unexpected: sent=%d deferred=%d inc=%d failed=%d", store.sent, store.deferred, store.incAttempts, store.failed)
+	}
+	if store.retryIn != 3*time.Second {
+		t.Fatalf("expected retry after 3s, got %s", store.retryIn)
+	}
+}
+
+func TestTick_OpenCircuitSkipsWithoutAttempt(t *testing.T) {
+	msgs := []model.Message{{ID: uuid.New(), To: "a", Content: "b"}, {ID: uuid.New(), To: "c", Content: "d"}}
+	store := &fakeStore{msgs: msgs}
+	failing := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		return outbound.SendResult{}, errors.New("provider down")
+	}}
+	breaker := outbound.NewBreaker(failing, outbound.BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute}, zap.NewNop())
+	cfg := Config{Interval: time.Hour, BatchSize: 2, MaxAttempts: 5}
+	s := &Scheduler{cfg: cfg, store: store, sender: breaker, log: zap.NewNop()}
+
+	// the first failure opens the circuit, the second message is deferred
+	if r := s.tick(context.Background()); r != (tickResult{claimed: 2, failed: 1, deferred: 1}) {
+		t.Fatalf("expected one failed and one deferred, got %+v", r)
+	}
+	if store.incAttempts != 1 || store.deferred != 1 {
+		t.Fatalf("unexpected: inc=%d deferred=%d", store.incAttempts, store.deferred)
+	}
+	if store.retryIn <= 0 || store.retryIn > time.Minute {
+		t.Fatalf("expected retry within the open timeout, got %s", store.retryIn)
+	}
+
+	// while open nothing is claimed
+	fetches := store.fetchCount()
+	if r := s.tick(context.Background()); r.claimed != 0 || store.fetchCount() != fetches {
+		t.Fatalf("expected an open circuit to skip claiming, got %+v", r)
+	}
+}
+
+func TestTick_PermanentErrorDeadLetters(t *testing.T) {
+	store := &fakeStore{msgs: []model.Message{{ID: uuid.New(), To: "a", Content: "b"}}}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		return outbound.SendResult{}, &outbound.PermanentError{StatusCode: 400, Err: errors.New("invalid number")}
+	}}
+	cfg := Config{Interval: time.Hour, BatchSize: 1, MaxAttempts: 5}
+	s := &Scheduler{cfg: cfg, store: store, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	if store.failed != 1 || store.incAttempts != 0 {
+		t.Fatalf("expected a dead-letter without retries, got failed=%d inc=%d", store.failed, store.incAttempts)
+	}
+}
+
+func TestTick_ProviderRateLimitDefers(t *testing.T) {
+	store := &fakeStore{msgs: []model.Message{{ID: uuid.New(), To: "a", Content: "b"}}}
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		return outbound.SendResult{}, &outbound.RateLimitedError{RetryAfter: 30 * time.Second, Scope: "provider"}
+	}}
+	cfg := Config{Interval: time.Hour, BatchSize: 1, MaxAttempts: 5}
+	s := &Scheduler{cfg: cfg, store: store, sender: sender, log: zap.NewNop()}
+	s.tick(context.Background())
+	if store.deferred != 1 || store.incAttempts != 0 || store.retryIn != 30*time.Second {
+		t.Fatalf("expected a deferral of 30s, got deferred=%d inc=%d retry=%s", store.deferred, store.incAttempts, store.retryIn)
+	}
+}
+
+// electStore hands leadership to the campaign once elect is closed
+type electStore struct {
+	*fakeStore
+	elect  chan struct{}
+	leader atomic.Value
+}
+
+func (f *electStore) Campaign(ctx context.Context, id string, retry time.Duration, onChange func(leader bool)) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-f.elect:
+	}
+	f.leader.Store(id)
+	onChange(true)
+	<-ctx.Done()
+	f.leader.Store("")
+	onChange(false)
+	return ctx.Err()
+}
+
+func (f *electStore) Leader(ctx context.Context) (string, error) {
+	id, _ := f.leader.Load().(string)
+	return id, nil
+}
+
+func TestLeaderElection_OnlyLeaderSends(t *testing.T) {
+	store := &electStore{fakeStore: &fakeStore{consume: true}, elect: make(chan struct{})}
+	store.add(model.Message{ID: uuid.New(), To: "a", Content: "b"})
+	cfg := Config{Interval: 10 * time.Millisecond, BatchSize: 10, Mode: ModeDrain, LeaderElection: true}
+	s := New(cfg, store, nil, fakeSender{}, zap.NewNop())
+	s.Start(context.Background())
+	defer s.Stop(errors.New("test done"))
+
+	time.Sleep(50 * time.Millisecond)
+	if store.fetchCount() != 0 {
+		t.Fatal("a follower must not claim messages")
+	}
+	info, _ := s.Leader(context.Background())
+	if !info.Election || info.IsLeader || info.Leader != "" || info.Self != s.ID() {
+		t.Fatalf("unexpected follower info: %+v", info)
+	}
+
+	close(store.elect)
+	deadline := time.Now().Add(time.Second)
+	for store.sentCount() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if store.sentCount() != 1 {
+		t.Fatal("expected the leader to send")
+	}
+	info, _ = s.Leader(context.Background())
+	if !info.IsLeader || info.Leader != s.ID() {
+		t.Fatalf("unexpected leader info: %+v", info)
+	}
+}
+
+func TestLeaderElection_Unsupported(t *testing.T) {
+	s := New(Config{Interval: time.Hour, LeaderElection: true}, &fakeStore{}, nil, fakeSender{}, zap.NewNop())
+	info, err := s.Leader(context.Background())
+	if err != nil || info.Election || !info.IsLeader {
+		t.Fatalf("expected every replica to run without an Elector store, got %+v %v", info, err)
+	}
+}
+
+func TestStats_CountsTicks(t *testing.T) {
+	msgs := []model.Message{{ID: uuid.New(), To: "ok"}, {ID: uuid.New(), To: "bad"}, {ID: uuid.New(), To: "ok"}}
+	store := &fakeStore{msgs: msgs}
+	// the first send to bad fails, every other send succeeds
+	var failedOnce atomic.Bool
+	sender := funcSender{fn: func(ctx context.Context, req outbound.SendRequest) (outbound.SendResult, error) {
+		if req.To == "bad" && failedOnce.CompareAndSwap(false, true) {
+			return outbound.SendResult{}, errors.New("provider down")
+		}
+		return outbound.SendResult{MessageID: "mid"}, nil
+	}}
+	s := New(Config{Enabled: true, Interval: time.Minute, BatchSize: 2}, store, nil, sender, zap.NewNop())
+
+	if st := s.Stats(); st.LastTickAt != nil || st.Interval != "1m0s" || st.BatchSize != 2 || st.Running {
+		t.Fatalf("unexpected stats before the first tick: %+v", st)
+	}
+	s.tick(context.Background())
+	st := s.Stats()
+	if st.LastTickAt == nil || st.LastTickSent != 1 || st.LastTickFailed != 1 || st.LastError != "provider down" || st.LastErrorAt == nil {
+		t.Fatalf("unexpected stats after the first tick: %+v", st)
+	}
+	s.tick(context.Background())
+	st = s.Stats()
+	if st.LastTickSent != 2 || st.LastTickFailed != 0 || st.TotalSent != 3 || st.TotalFailed != 1 || st.LastError != "provider down" {
+		t.Fatalf("unexpected stats after the second tick: %+v", st)
+	}
+}
+
+func TestTune_Validates(t *testing.T) {
+	s := New(Config{Interval: time.Hour, BatchSize: 2}, &fakeStore{}, nil, fakeSender{}, zap.NewNop())
+	for _, bad := range []Tuning{{Interval: 0, BatchSize: 1}, {Interval: 48 * time.Hour, BatchSize: 1}, {Interval: time.Minute, BatchSize: 0}, {Interval: time.Minute, BatchSize: MaxBatchSize + 1}} {
+		if err := s.Tune(bad); !errors.Is(err, ErrInvalidTuning) {
+			t.Fatalf("%+v: expected ErrInvalidTuning, got %v", bad, err)
+		}
+	}
+	if got := s.Tuning(); got.Interval != time.Hour || got.BatchSize != 2 {
+		t.Fatalf("invalid settings must not be applied, got %+v", got)
+	}
+}
+
+func TestTune_KeepsConfiguredInterval(t *testing.T) {
+	s := New(Config{Interval: 100 * time.Millisecond, BatchSize: 2}, &fakeStore{}, nil, fakeSender{}, zap.NewNop())
+	if err := s.Tune(Tuning{Interval: 100 * time.Millisecond, BatchSize: 5}); err != nil {
+		t.Fatalf("expected an unchanged interval to be kept, got %v", err)
+	}
+	if err := s.Tune(Tuning{Interval: 200 * time.Millisecond, BatchSize: 5}); !errors.Is(err, ErrInvalidTuning) {
+		t.Fatalf("expected a changed interval to be validated, got %v", err)
+	}
+	if got := s.Tuning(); got.Interval != 100*time.Millisecond || got.BatchSize != 5 {
+		t.Fatalf("unexpected tuning %+v", got)
+	}
+}
+
+func TestTune_ResetsRunningInterval(t *testing.T) {
+	store := &fakeStore{consume: true}
+	s := New(Config{Interval: time.Hour, BatchSize: 1}, store, nil, fakeSender{}, zap.NewNop())
+	s.Start(context.Background())
+	defer s.Stop(errors.New("test done"))
+
+	store.add(model.Message{ID: uuid.New()}, model.Message{ID: uuid.New()}, model.Message{ID: uuid.New()})
+	if err := s.Tune(Tuning{Interval: MinInterval, BatchSize: 3}); err != nil {
+		t.Fatalf("tune: %v", err)
+	}
+	// the hour long interval is cut short and the batch takes all three
+	deadline := time.Now().Add(3 * time.Second)
+	for store.sentCount() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the tuned scheduler to send 3, got %d", store.sentCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := s.Stats(); st.Interval != "1s" || st.BatchSize != 3 || st.LastTickSent != 3 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
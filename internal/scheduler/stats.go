@@ -0,0 +1,87 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats tell what the scheduler of this replica is doing,
+// counters start at zero when the process starts
+type Stats struct {
+	Self      string `json:"self"`
+	Enabled   bool   `json:"enabled"`
+	Running   bool   `json:"running"`
+	Mode      Mode   `json:"mode"`
+	Interval  string `json:"interval"`
+	BatchSize int    `json:"batch_size"`
+	// LastTickAt is when the last batch started, including batches
+	// skipped because this replica is not the leader or the circuit is open
+	LastTickAt         *time.Time `json:"last_tick_at,omitempty"`
+	LastTickDurationMs int64      `json:"last_tick_duration_ms"`
+	// LastTickSent and LastTickFailed count the sends of the last batch
+	// the provider accepted and the ones that failed
+	LastTickSent   int        `json:"last_tick_sent"`
+	LastTickFailed int        `json:"last_tick_failed"`
+	TotalSent      int64      `json:"total_sent"`
+	TotalFailed    int64      `json:"total_failed"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+}
+
+// counters are the tick results kept for Stats
+type counters struct {
+	mtx          sync.Mutex
+	lastTickAt   time.Time
+	lastTickTook time.Duration
+	lastSent     int
+	lastFailed   int
+	totalSent    int64
+	totalFailed  int64
+	lastErr      string
+	lastErrAt    time.Time
+}
+
+// recordTick records the results of a batch started at start
+func (c *counters) recordTick(start time.Time, sent, failed int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.lastTickAt, c.lastTickTook = start, time.Since(start)
+	c.lastSent, c.lastFailed = sent, failed
+	c.totalSent += int64(sent)
+	c.totalFailed += int64(failed)
+}
+
+// recordError records the last error met by a batch
+func (c *counters) recordError(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.lastErr, c.lastErrAt = err.Error(), time.Now().UTC()
+}
+
+// Stats returns what the scheduler is doing
+func (s *Scheduler) Stats() Stats {
+	t := s.Tuning()
+	st := Stats{
+		Self:      s.owner,
+		Enabled:   s.cfg.Enabled,
+		Running:   s.Running(),
+		Mode:      s.cfg.Mode,
+		Interval:  t.Interval.String(),
+		BatchSize: t.BatchSize,
+	}
+	c := &s.counters
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.lastTickAt.IsZero() {
+		at := c.lastTickAt.UTC()
+		st.LastTickAt = &at
+		st.LastTickDurationMs = c.lastTickTook.Milliseconds()
+	}
+	st.LastTickSent, st.LastTickFailed = c.lastSent, c.lastFailed
+	st.TotalSent, st.TotalFailed = c.totalSent, c.totalFailed
+	if c.lastErr != "" {
+		at := c.lastErrAt
+		st.LastError, st.LastErrorAt = c.lastErr, &at
+	}
+	return st
+}
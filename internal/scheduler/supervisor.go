@@ -0,0 +1,137 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MaxLifecycleEvents is how many starts, stops and restarts a Supervisor keeps
+const MaxLifecycleEvents = 20
+
+// Lifecycle actions recorded by a Supervisor
+const (
+	ActionStart   = "start"
+	ActionStop    = "stop"
+	ActionRestart = "restart"
+)
+
+// LifecycleEvent is a start, stop or restart of a supervised scheduler
+type LifecycleEvent struct {
+	Action string    `json:"action"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// Lifecycle is the state of a supervised scheduler
+type Lifecycle struct {
+	Running bool `json:"running"`
+	// Since is when the scheduler was last started or stopped
+	Since *time.Time `json:"since,omitempty"`
+	// Closed is set once the supervisor is closed, the scheduler does not start again
+	Closed bool `json:"closed"`
+	// Events are the latest starts, stops and restarts, oldest first
+	Events []LifecycleEvent `json:"events"`
+}
+
+// Supervisor runs a Scheduler under a root context of its own, so the
+// scheduler lives until it is stopped or the supervisor is closed and not
+// as long as the context of whoever started it. Starts, stops and restarts
+// are recorded with their reason.
+type Supervisor struct {
+	*Scheduler
+
+	root   context.Context
+	cancel context.CancelCauseFunc
+
+	mtx    sync.Mutex
+	closed bool
+	since  time.Time
+	events []LifecycleEvent
+	now    func() time.Time
+}
+
+// NewSupervisor creates a supervisor of s, s is not started
+func NewSupervisor(s *Scheduler) *Supervisor {
+	root, cancel := context.WithCancelCause(context.Background())
+	return &Supervisor{Scheduler: s, root: root, cancel: cancel, now: time.Now}
+}
+
+// Start starts the scheduler, it reports whether it was started
+func (p *Supervisor) Start(reason string) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed || p.Running() {
+		return false
+	}
+	p.Scheduler.Start(p.root)
+	p.record(ActionStart, reason)
+	return true
+}
+
+// Stop stops the scheduler and waits for the sends in flight,
+// it reports whether it was running
+func (p *Supervisor) Stop(reason string) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if !p.Running() {
+		return false
+	}
+	p.Scheduler.Stop(errors.New(reason))
+	p.record(ActionStop, reason)
+	return true
+}
+
+// Restart stops and starts a running scheduler, it reports whether it was running
+func (p *Supervisor) Restart(reason string) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed || !p.Running() {
+		return false
+	}
+	p.Scheduler.Stop(errors.New(reason))
+	p.Scheduler.Start(p.root)
+	p.record(ActionRestart, reason)
+	return true
+}
+
+// Close stops the scheduler for good
+func (p *Supervisor) Close(reason string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.Running() {
+		p.Scheduler.Stop(errors.New(reason))
+		p.record(ActionStop, reason)
+	}
+	p.cancel(errors.New(reason))
+}
+
+// Lifecycle returns the state of the scheduler and its latest starts and stops
+func (p *Supervisor) Lifecycle() Lifecycle {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	lc := Lifecycle{Running: p.Running(), Closed: p.closed, Events: append([]LifecycleEvent{}, p.events...)}
+	if !p.since.IsZero() {
+		since := p.since
+		lc.Since = &since
+	}
+	return lc
+}
+
+// record keeps an event, p.mtx must be held
+func (p *Supervisor) record(action, reason string) {
+	at := p.now().UTC()
+	p.log.Info("scheduler lifecycle", zap.String("action", action), zap.String("reason", reason))
+	p.since = at
+	p.events = append(p.events, LifecycleEvent{Action: action, Reason: reason, At: at})
+	if len(p.events) > MaxLifecycleEvents {
+		p.events = p.events[len(p.events)-MaxLifecycleEvents:]
+	}
+}
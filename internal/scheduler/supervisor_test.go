@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hakan-sariman/insider-assessment/internal/model"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+func TestSupervisor_OutlivesCallerContext(t *testing.T) {
+	store := &fakeStore{consume: true}
+	s := New(Config{Interval: 10 * time.Millisecond, BatchSize: 1}, store, nil, fakeSender{}, zap.NewNop())
+	p := NewSupervisor(s)
+	defer p.Close("test done")
+
+	if !p.Start("test") || p.Start("again") {
+		t.Fatalf("expected only the first start to start the scheduler")
+	}
+	store.add(model.Message{ID: uuid.New()})
+	deadline := time.Now().Add(time.Second)
+	for store.sentCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the supervised scheduler to send")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSupervisor_RecordsLifecycle(t *testing.T) {
+	s := New(Config{Interval: time.Hour, BatchSize: 1}, &fakeStore{}, nil, fakeSender{}, zap.NewNop())
+	p := NewSupervisor(s)
+
+	if p.Restart("not running") || p.Stop("not running") {
+		t.Fatalf("a stopped scheduler must not restart or stop")
+	}
+	p.Start("boot")
+	if !p.Restart("config change") || !p.Running() {
+		t.Fatalf("expected a running scheduler after restart")
+	}
+	p.Stop("maintenance")
+	p.Close("shutdown")
+	if p.Start("after close") {
+		t.Fatalf("a closed supervisor must not start the scheduler")
+	}
+
+	lc := p.Lifecycle()
+	want := []LifecycleEvent{{Action: ActionStart, Reason: "boot"}, {Action: ActionRestart, Reason: "config change"}, {Action: ActionStop, Reason: "maintenance"}}
+	if lc.Running || !lc.Closed || lc.Since == nil || len(lc.Events) != len(want) {
+		t.Fatalf("unexpected lifecycle %+v", lc)
+	}
+	for i, e := range lc.Events {
+		if e.Action != want[i].Action || e.Reason != want[i].Reason || e.At.IsZero() {
+			t.Fatalf("event %d: expected %+v, got %+v", i, want[i], e)
+		}
+	}
+}
+
+func TestSupervisor_KeepsLatestEvents(t *testing.T) {
+	s := New(Config{Interval: time.Hour, BatchSize: 1}, &fakeStore{}, nil, fakeSender{}, zap.NewNop())
+	p := NewSupervisor(s)
+	defer p.Close("test done")
+	p.Start("boot")
+	for i := 0; i < MaxLifecycleEvents; i++ {
+		p.Restart(fmt.Sprintf("restart %d", i))
+	}
+	lc := p.Lifecycle()
+	if len(lc.Events) != MaxLifecycleEvents || lc.Events[0].Reason != "restart 0" {
+		t.Fatalf("expected the latest %d events, got %d starting with %+v", MaxLifecycleEvents, len(lc.Events), lc.Events[0])
+	}
+}
+
+func TestStart_CallerContextDoneClearsRunning(t *testing.T) {
+	s := New(Config{Interval: time.Hour, BatchSize: 1}, &fakeStore{}, nil, fakeSender{}, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for s.Running() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the scheduler to report stopped once its context is done")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Bounds of the settings that can be changed while the scheduler runs
+const (
+	MinInterval  = time.Second
+	MaxInterval  = 24 * time.Hour
+	MaxBatchSize = 1000
+)
+
+// ErrInvalidTuning is returned for settings out of bounds
+var ErrInvalidTuning = errors.New("invalid scheduler settings")
+
+// Tuning are the settings that can be changed while the scheduler runs
+type Tuning struct {
+	Interval  time.Duration
+	BatchSize int
+}
+
+// Validate checks the settings are within bounds
+func (t Tuning) Validate() error {
+	if err := ValidateInterval(t.Interval); err != nil {
+		return err
+	}
+	return ValidateBatchSize(t.BatchSize)
+}
+
+// ValidateInterval checks an interval is within bounds
+func ValidateInterval(d time.Duration) error {
+	if d < MinInterval || d > MaxInterval {
+		return fmt.Errorf("%w: interval must be between %s and %s", ErrInvalidTuning, MinInterval, MaxInterval)
+	}
+	return nil
+}
+
+// ValidateBatchSize checks a batch size is within bounds
+func ValidateBatchSize(n int) error {
+	if n < 1 || n > MaxBatchSize {
+		return fmt.Errorf("%w: batch size must be between 1 and %d", ErrInvalidTuning, MaxBatchSize)
+	}
+	return nil
+}
+
+// Tuning returns the current interval and batch size
+func (s *Scheduler) Tuning() Tuning {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return Tuning{Interval: s.cfg.Interval, BatchSize: s.cfg.BatchSize}
+}
+
+// Tune changes the interval and batch size. Only the settings that change
+// are validated, so one configured out of bounds can be kept while the other
+// is tuned. A running scheduler restarts its interval from now, a batch in
+// flight keeps the batch size it started with.
+func (s *Scheduler) Tune(t Tuning) error {
+	s.mtx.Lock()
+	changed := s.cfg.Interval != t.Interval
+	if err := t.validateChanges(changed, s.cfg.BatchSize != t.BatchSize); err != nil {
+		s.mtx.Unlock()
+		return err
+	}
+	s.cfg.Interval, s.cfg.BatchSize = t.Interval, t.BatchSize
+	s.mtx.Unlock()
+
+	s.log.Info("scheduler tuned", zap.Duration("interval", t.Interval), zap.Int("batch", t.BatchSize))
+	if changed {
+		select {
+		case s.retune <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// validateChanges checks the settings that change are within bounds
+func (t Tuning) validateChanges(interval, batchSize bool) error {
+	if interval {
+		if err := ValidateInterval(t.Interval); err != nil {
+			return err
+		}
+	}
+	if batchSize {
+		return ValidateBatchSize(t.BatchSize)
+	}
+	return nil
+}
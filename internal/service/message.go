@@ -2,25 +2,90 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/hakan-sariman/insider-assessment/internal/model"
 	"github.com/hakan-sariman/insider-assessment/internal/outbound"
 	"github.com/hakan-sariman/insider-assessment/internal/scheduler"
 	"github.com/hakan-sariman/insider-assessment/internal/storage"
 
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+var (
+	// ErrInvalidID is returned when a message id is not a valid UUID
+	ErrInvalidID = errors.New("invalid message id")
+	// ErrNotFound is returned when a message does not exist
+	ErrNotFound = errors.New("message not found")
+	// ErrConflict is returned when a message is not in a status that allows the operation
+	ErrConflict = errors.New("message status does not allow this operation")
+	// ErrInvalidFilter is returned when a list filter is not valid
+	ErrInvalidFilter = errors.New("invalid filter")
+	// ErrBatchTooLarge is returned when a batch exceeds MaxBatchSize
+	ErrBatchTooLarge = fmt.Errorf("batch exceeds %d messages", MaxBatchSize)
+	// ErrIdempotencyConflict is returned when an idempotency key is reused with a different request
+	ErrIdempotencyConflict = errors.New("idempotency key already used for a different request")
+)
+
 // CreateMessageRequest is the request for creating a message
 type CreateMessageRequest struct {
 	To      string `json:"to"`
 	Content string `json:"content"`
+	// SendAt optionally schedules the message for a later time
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// IdempotencyKey makes retries of the same request return the message
+	// created first instead of creating a new one
+	IdempotencyKey string `json:"-"`
+}
+
+const (
+	// MaxIdempotencyKeyLength is the maximum length of an idempotency key
+	MaxIdempotencyKeyLength = 255
+	// IdempotencyKeyTTL is how long an idempotency key replays its request,
+	// a key used again after that creates a new message
+	IdempotencyKeyTTL = 24 * time.Hour
+	// MaxBatchSize is the maximum number of messages in one CreateMessages call
+	MaxBatchSize = 5000
+)
+
+// BatchResult is the outcome of one item of CreateMessages,
+// either Message or Err is set
+type BatchResult struct {
+	Message *model.Message
+	Err     error
+}
+
+// ListMessagesRequest is the request for listing messages,
+// zero fields do not filter
+type ListMessagesRequest struct {
+	Statuses    []model.Status
+	To          string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	SentFrom    *time.Time
+	SentTo      *time.Time
+	Limit       int
+	Offset      int
 }
 
 // Message is the message service interface
 type Message interface {
 	CreateMessage(ctx context.Context, msg CreateMessageRequest) (*model.Message, error)
-	ListSentMessages(ctx context.Context, limit, offset int) ([]model.Message, error)
+	CreateMessages(ctx context.Context, reqs []CreateMessageRequest) ([]BatchResult, error)
+	ListMessages(ctx context.Context, req ListMessagesRequest) ([]model.Message, error)
+	GetMessage(ctx context.Context, id string) (*model.Message, error)
+	GetMessageByProviderID(ctx context.Context, providerMessageID string) (*model.Message, error)
+	CancelMessage(ctx context.Context, id string) (*model.Message, error)
+	ListDeadLetters(ctx context.Context, limit, offset int) ([]model.Message, error)
+	GetDeadLetter(ctx context.Context, id string) (*model.Message, error)
+	RequeueDeadLetter(ctx context.Context, id string) (*model.Message, error)
 }
 
 // message is the message service implementation
@@ -50,21 +115,228 @@ func (s *message) CreateMessage(ctx context.Context, msgReq CreateMessageRequest
 		s.logger.Error("CreateMessage: validation error", zap.Error(err))
 		return nil, err
 	}
+	if msgReq.SendAt != nil {
+		msg.ScheduleAt(*msgReq.SendAt)
+	}
+	if msgReq.IdempotencyKey != "" {
+		return s.createIdempotent(ctx, msgReq, msg)
+	}
 	if err := s.store.InsertMessage(ctx, msg); err != nil {
 		s.logger.Error("CreateMessage: db error", zap.Error(err))
 		return nil, err
 	}
 	s.logger.Info("CreateMessage: stored", zap.String("id", msg.ID.String()))
+	s.wakeScheduler()
+	return msg, nil
+}
+
+// CreateMessages validates every request and stores the valid ones in bulk.
+// Results are in request order, invalid items carry their validation error.
+// An error is only returned when nothing could be stored.
+func (s *message) CreateMessages(ctx context.Context, reqs []CreateMessageRequest) ([]BatchResult, error) {
+	s.logger.Debug("CreateMessages", zap.Int("count", len(reqs)))
+	if len(reqs) > MaxBatchSize {
+		return nil, ErrBatchTooLarge
+	}
+	results := make([]BatchResult, len(reqs))
+	valid := make([]*model.Message, 0, len(reqs))
+	for i, req := range reqs {
+		msg, err := model.NewMessage(req.To, req.Content)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if req.SendAt != nil {
+			msg.ScheduleAt(*req.SendAt)
+		}
+		results[i].Message = msg
+		valid = append(valid, msg)
+	}
+	if len(valid) > 0 {
+		if err := s.store.InsertMessages(ctx, valid); err != nil {
+			s.logger.Error("CreateMessages: db error", zap.Error(err))
+			return nil, err
+		}
+	}
+	s.logger.Info("CreateMessages: stored", zap.Int("stored", len(valid)), zap.Int("invalid", len(reqs)-len(valid)))
+	if len(valid) > 0 {
+		s.wakeScheduler()
+	}
+	return results, nil
+}
+
+// createIdempotent stores msg under the request's idempotency key,
+// returning the original message when the request is a replay
+func (s *message) createIdempotent(ctx context.Context, msgReq CreateMessageRequest, msg *model.Message) (*model.Message, error) {
+	if len(msgReq.IdempotencyKey) > MaxIdempotencyKeyLength {
+		return nil, fmt.Errorf("idempotency key exceeds %d characters", MaxIdempotencyKeyLength)
+	}
+	hash, err := requestHash(msgReq)
+	if err != nil {
+		return nil, err
+	}
+	orig, replayed, err := s.store.InsertMessageIdempotent(ctx, msg, msgReq.IdempotencyKey, hash, IdempotencyKeyTTL)
+	if errors.Is(err, storage.ErrIdempotencyConflict) {
+		s.logger.Warn("CreateMessage: idempotency key conflict", zap.String("key", msgReq.IdempotencyKey))
+		return nil, ErrIdempotencyConflict
+	}
+	if err != nil {
+		s.logger.Error("CreateMessage: db error", zap.Error(err))
+		return nil, err
+	}
+	if replayed {
+		s.logger.Info("CreateMessage: replayed", zap.String("key", msgReq.IdempotencyKey), zap.String("id", orig.ID.String()))
+		return orig, nil
+	}
+	s.logger.Info("CreateMessage: stored", zap.String("id", orig.ID.String()), zap.String("key", msgReq.IdempotencyKey))
+	s.wakeScheduler()
+	return orig, nil
+}
+
+// wakeScheduler tells the scheduler that new messages were stored
+func (s *message) wakeScheduler() {
+	if s.sched != nil {
+		s.sched.Wake()
+	}
+}
+
+// requestHash fingerprints the fields of a create request
+// so that reuse of an idempotency key with another payload is detected
+func requestHash(msgReq CreateMessageRequest) (string, error) {
+	if msgReq.SendAt != nil {
+		sendAt := msgReq.SendAt.UTC()
+		msgReq.SendAt = &sendAt
+	}
+	b, err := json.Marshal(msgReq)
+	if err != nil {
+		return "", fmt.Errorf("hash request: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ListMessages lists messages matching the request filters
+func (s *message) ListMessages(ctx context.Context, req ListMessagesRequest) ([]model.Message, error) {
+	s.logger.Debug("ListMessages", zap.Any("request", req))
+	for _, st := range req.Statuses {
+		if !st.Valid() {
+			return nil, fmt.Errorf("%w: unknown status %q", ErrInvalidFilter, st)
+		}
+	}
+	msgs, err := s.store.ListMessages(ctx, storage.MessageFilter{
+		Statuses:    req.Statuses,
+		To:          req.To,
+		CreatedFrom: req.CreatedFrom,
+		CreatedTo:   req.CreatedTo,
+		SentFrom:    req.SentFrom,
+		SentTo:      req.SentTo,
+		Limit:       req.Limit,
+		Offset:      req.Offset,
+	})
+	if err != nil {
+		s.logger.Error("ListMessages: db error", zap.Error(err))
+	}
+	s.logger.Info("ListMessages: fetched", zap.Int("count", len(msgs)))
+	return msgs, err
+}
+
+// GetMessage returns a message by id
+func (s *message) GetMessage(ctx context.Context, id string) (*model.Message, error) {
+	s.logger.Debug("GetMessage", zap.String("id", id))
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	msg, err := s.store.GetMessage(ctx, id)
+	if err != nil {
+		return nil, s.storeErr("GetMessage", err)
+	}
+	return msg, nil
+}
+
+// GetMessageByProviderID returns a message by the id the provider gave it
+func (s *message) GetMessageByProviderID(ctx context.Context, providerMessageID string) (*model.Message, error) {
+	s.logger.Debug("GetMessageByProviderID", zap.String("provider_message_id", providerMessageID))
+	if strings.TrimSpace(providerMessageID) == "" {
+		return nil, ErrInvalidID
+	}
+	msg, err := s.store.GetMessageByProviderID(ctx, providerMessageID)
+	if err != nil {
+		return nil, s.storeErr("GetMessageByProviderID", err)
+	}
 	return msg, nil
 }
 
-// ListSentMessages lists sent messages
-func (s *message) ListSentMessages(ctx context.Context, limit, offset int) ([]model.Message, error) {
-	s.logger.Debug("ListSentMessages", zap.Int("limit", limit), zap.Int("offset", offset))
-	msgs, err := s.store.ListSent(ctx, limit, offset)
+// CancelMessage cancels a message that is still waiting to be sent
+func (s *message) CancelMessage(ctx context.Context, id string) (*model.Message, error) {
+	s.logger.Debug("CancelMessage", zap.String("id", id))
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	msg, err := s.store.CancelMessage(ctx, id)
 	if err != nil {
-		s.logger.Error("ListSentMessages: db error", zap.Error(err))
+		return nil, s.storeErr("CancelMessage", err)
 	}
-	s.logger.Info("ListSentMessages: fetched", zap.Int("count", len(msgs)))
+	s.logger.Info("CancelMessage: cancelled", zap.String("id", id))
+	return msg, nil
+}
+
+// ListDeadLetters lists messages that ran out of attempts
+func (s *message) ListDeadLetters(ctx context.Context, limit, offset int) ([]model.Message, error) {
+	s.logger.Debug("ListDeadLetters", zap.Int("limit", limit), zap.Int("offset", offset))
+	msgs, err := s.store.ListMessages(ctx, storage.MessageFilter{
+		Statuses: []model.Status{model.StatusFailed},
+		Limit:    limit,
+		Offset:   offset,
+	})
+	if err != nil {
+		s.logger.Error("ListDeadLetters: db error", zap.Error(err))
+	}
+	s.logger.Info("ListDeadLetters: fetched", zap.Int("count", len(msgs)))
 	return msgs, err
 }
+
+// GetDeadLetter returns a dead-lettered message,
+// ErrNotFound if it does not exist or is not dead-lettered
+func (s *message) GetDeadLetter(ctx context.Context, id string) (*model.Message, error) {
+	s.logger.Debug("GetDeadLetter", zap.String("id", id))
+	msg, err := s.GetMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Status != model.StatusFailed {
+		return nil, ErrNotFound
+	}
+	return msg, nil
+}
+
+// RequeueDeadLetter puts a dead-lettered message back in the queue
+// with its attempt count reset
+func (s *message) RequeueDeadLetter(ctx context.Context, id string) (*model.Message, error) {
+	s.logger.Debug("RequeueDeadLetter", zap.String("id", id))
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+	msg, err := s.store.RequeueFailed(ctx, id)
+	if err != nil {
+		return nil, s.storeErr("RequeueDeadLetter", err)
+	}
+	s.logger.Info("RequeueDeadLetter: requeued", zap.String("id", id))
+	return msg, nil
+}
+
+// storeErr maps storage errors to service errors
+func (s *message) storeErr(op string, err error) error {
+	return storeErr(s.logger, op, err)
+}
+
+// storeErr maps storage errors to service errors, logging unexpected ones
+func storeErr(logger *zap.Logger, op string, err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return ErrNotFound
+	case errors.Is(err, storage.ErrStatusConflict):
+		return ErrConflict
+	}
+	logger.Error(op+": db error", zap.Error(err))
+	return err
+}
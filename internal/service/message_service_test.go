@@ -7,14 +7,25 @@ import (
 	"time"
 
 	"github.com/hakan-sariman/insider-assessment/internal/model"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
+
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 type fakeStorage struct {
 	insertErr error
 	listErr   error
+	getErr    error
 	inserted  *model.Message
 	listed    []model.Message
+	filter    storage.MessageFilter
+	batch     []*model.Message
+	keys      map[string]string
+	byKey     map[string]*model.Message
+	got       *model.Message
+	receiptID string
+	receiptSt model.Status
 }
 
 func (f *fakeStorage) InsertMessage(ctx context.Context, m *model.Message) error {
@@ -22,17 +33,81 @@ func (f *fakeStorage) InsertMessage(ctx context.Context, m *model.Message) error
 	return f.insertErr
 }
 
-func (f *fakeStorage) ListSent(ctx context.Context, limit, offset int) ([]model.Message, error) {
+func (f *fakeStorage) InsertMessages(ctx context.Context, msgs []*model.Message) error {
+	f.batch = msgs
+	return f.insertErr
+}
+
+func (f *fakeStorage) InsertMessageIdempotent(ctx context.Context, m *model.Message, key, requestHash string, ttl time.Duration) (*model.Message, bool, error) {
+	if f.insertErr != nil {
+		return nil, false, f.insertErr
+	}
+	if f.keys == nil {
+		f.keys = map[string]string{}
+		f.byKey = map[string]*model.Message{}
+	}
+	if h, ok := f.keys[key]; ok {
+		if h != requestHash {
+			return nil, false, storage.ErrIdempotencyConflict
+		}
+		return f.byKey[key], true, nil
+	}
+	f.keys[key], f.byKey[key], f.inserted = requestHash, m, m
+	return m, false, nil
+}
+
+func (f *fakeStorage) ListMessages(ctx context.Context, filter storage.MessageFilter) ([]model.Message, error) {
+	f.filter = filter
 	return f.listed, f.listErr
 }
 
-func (f *fakeStorage) FetchUnsent(ctx context.Context, n int) ([]model.Message, error) {
+func (f *fakeStorage) FetchUnsent(ctx context.Context, owner string, n int, lease time.Duration) ([]model.Message, error) {
 	return nil, nil
 }
-func (f *fakeStorage) MarkSent(ctx context.Context, id string, sentAt time.Time) error { return nil }
-func (f *fakeStorage) IncrementAttempt(ctx context.Context, id string, lastErr *string) error {
+func (f *fakeStorage) MarkSent(ctx context.Context, id, owner string, d model.Delivery) error {
+	return nil
+}
+func (f *fakeStorage) IncrementAttempt(ctx context.Context, id, owner string, lastErr *string, retryIn time.Duration) error {
+	return nil
+}
+func (f *fakeStorage) MarkFailed(ctx context.Context, id, owner string, lastErr *string) error {
+	return nil
+}
+func (f *fakeStorage) Defer(ctx context.Context, id, owner string, retryIn time.Duration) error {
 	return nil
 }
+func (f *fakeStorage) GetMessage(ctx context.Context, id string) (*model.Message, error) {
+	return f.got, f.getErr
+}
+func (f *fakeStorage) GetMessageByProviderID(ctx context.Context, providerMessageID string) (*model.Message, error) {
+	return f.got, f.getErr
+}
+func (f *fakeStorage) RequeueFailed(ctx context.Context, id string) (*model.Message, error) {
+	return f.got, f.getErr
+}
+func (f *fakeStorage) CancelMessage(ctx context.Context, id string) (*model.Message, error) {
+	return f.got, f.getErr
+}
+func (f *fakeStorage) RecordReceipt(ctx context.Context, id string, status model.Status, deliveredAt time.Time, lastErr *string) (*model.Message, error) {
+	f.receiptID, f.receiptSt = id, status
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	return &model.Message{Status: status}, nil
+}
+func (f *fakeStorage) CountByStatus(ctx context.Context) (map[model.Status]int, error) {
+	return map[model.Status]int{}, nil
+}
+func (f *fakeStorage) GetSchedulerState(ctx context.Context) (*model.SchedulerState, error) {
+	return nil, storage.ErrNoSchedulerState
+}
+func (f *fakeStorage) SetSchedulerState(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error) {
+	return &st, nil
+}
+func (f *fakeStorage) SetSchedulerTuning(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error) {
+	st.Running = true
+	return &st, nil
+}
 func (f *fakeStorage) Close() {}
 
 func TestMessageService_CreateMessage_Success(t *testing.T) {
@@ -50,6 +125,66 @@ func TestMessageService_CreateMessage_Success(t *testing.T) {
 	}
 }
 
+func TestMessageService_CreateMessage_SendAt(t *testing.T) {
+	store := &fakeStorage{}
+	svc := NewMessageService(store, zap.NewNop(), nil, nil)
+	sendAt := time.Now().Add(time.Hour)
+	msg, err := svc.CreateMessage(context.Background(), CreateMessageRequest{To: "x", Content: "hi", SendAt: &sendAt})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.SendAt == nil || !msg.NextAttemptAt.Equal(sendAt) {
+		t.Fatalf("expected message due at send_at, got %#v", msg)
+	}
+}
+
+func TestMessageService_CreateMessage_Idempotent(t *testing.T) {
+	store := &fakeStorage{}
+	svc := NewMessageService(store, zap.NewNop(), nil, nil)
+	sendAt := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	first, err := svc.CreateMessage(context.Background(), CreateMessageRequest{To: "x", Content: "hi", SendAt: &sendAt, IdempotencyKey: "k1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// same instant in another zone is the same request
+	sameAt := sendAt.In(time.FixedZone("TRT", 3*60*60))
+	replay, err := svc.CreateMessage(context.Background(), CreateMessageRequest{To: "x", Content: "hi", SendAt: &sameAt, IdempotencyKey: "k1"})
+	if err != nil || replay.ID != first.ID {
+		t.Fatalf("expected replay of %s, got %v %v", first.ID, replay, err)
+	}
+
+	_, err = svc.CreateMessage(context.Background(), CreateMessageRequest{To: "x", Content: "other", IdempotencyKey: "k1"})
+	if !errors.Is(err, ErrIdempotencyConflict) {
+		t.Fatalf("expected ErrIdempotencyConflict, got %v", err)
+	}
+}
+
+func TestMessageService_CreateMessages(t *testing.T) {
+	store := &fakeStorage{}
+	svc := NewMessageService(store, zap.NewNop(), nil, nil)
+	long := string(make([]byte, model.MaxContentLength+1))
+	results, err := svc.CreateMessages(context.Background(), []CreateMessageRequest{
+		{To: "a", Content: "hi"},
+		{To: "b", Content: long},
+		{To: "c", Content: "hey"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 3 || results[0].Message == nil || results[1].Err == nil || results[2].Message == nil {
+		t.Fatalf("unexpected results: %#v", results)
+	}
+	if len(store.batch) != 2 || store.batch[1].To != "c" {
+		t.Fatalf("expected the 2 valid messages inserted, got %d", len(store.batch))
+	}
+
+	_, err = svc.CreateMessages(context.Background(), make([]CreateMessageRequest, MaxBatchSize+1))
+	if !errors.Is(err, ErrBatchTooLarge) {
+		t.Fatalf("expected ErrBatchTooLarge, got %v", err)
+	}
+}
+
 func TestMessageService_CreateMessage_ValidationError(t *testing.T) {
 	store := &fakeStorage{}
 	svc := NewMessageService(store, zap.NewNop(), nil, nil)
@@ -73,24 +208,93 @@ func TestMessageService_CreateMessage_DBError(t *testing.T) {
 	}
 }
 
-func TestMessageService_ListSent(t *testing.T) {
+func TestMessageService_ListMessages(t *testing.T) {
 	expected := []model.Message{{To: "a"}, {To: "b"}}
 	store := &fakeStorage{listed: expected}
 	svc := NewMessageService(store, zap.NewNop(), nil, nil)
-	msgs, err := svc.ListSentMessages(context.Background(), 10, 0)
+	msgs, err := svc.ListMessages(context.Background(), ListMessagesRequest{Statuses: []model.Status{model.StatusSent}, To: "a", Limit: 10})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if len(msgs) != 2 {
 		t.Fatalf("unexpected len: %d", len(msgs))
 	}
+	if store.filter.To != "a" || store.filter.Limit != 10 || store.filter.Statuses[0] != model.StatusSent {
+		t.Fatalf("unexpected filter: %#v", store.filter)
+	}
 }
 
-func TestMessageService_ListSent_Error(t *testing.T) {
+func TestMessageService_ListMessages_InvalidStatus(t *testing.T) {
+	svc := NewMessageService(&fakeStorage{}, zap.NewNop(), nil, nil)
+	_, err := svc.ListMessages(context.Background(), ListMessagesRequest{Statuses: []model.Status{"bogus"}, Limit: 10})
+	if !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("expected ErrInvalidFilter, got %v", err)
+	}
+}
+
+func TestMessageService_ListMessages_Error(t *testing.T) {
 	store := &fakeStorage{listErr: errors.New("db")}
 	svc := NewMessageService(store, zap.NewNop(), nil, nil)
-	_, err := svc.ListSentMessages(context.Background(), 10, 0)
+	_, err := svc.ListMessages(context.Background(), ListMessagesRequest{Limit: 10})
 	if err == nil {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestMessageService_CancelMessage(t *testing.T) {
+	id := uuid.New().String()
+	svc := NewMessageService(&fakeStorage{got: &model.Message{Status: model.StatusCancelled}}, zap.NewNop(), nil, nil)
+	if _, err := svc.CancelMessage(context.Background(), "nope"); !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("expected ErrInvalidID, got %v", err)
+	}
+	if msg, err := svc.CancelMessage(context.Background(), id); err != nil || msg.Status != model.StatusCancelled {
+		t.Fatalf("unexpected: %v %#v", err, msg)
+	}
+	svc = NewMessageService(&fakeStorage{getErr: storage.ErrStatusConflict}, zap.NewNop(), nil, nil)
+	if _, err := svc.CancelMessage(context.Background(), id); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+}
+
+func TestMessageService_GetMessageByProviderID(t *testing.T) {
+	svc := NewMessageService(&fakeStorage{got: &model.Message{Status: model.StatusSent}}, zap.NewNop(), nil, nil)
+	if _, err := svc.GetMessageByProviderID(context.Background(), " "); !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("expected ErrInvalidID, got %v", err)
+	}
+	if msg, err := svc.GetMessageByProviderID(context.Background(), "prov-1"); err != nil || msg.Status != model.StatusSent {
+		t.Fatalf("unexpected: %v %#v", err, msg)
+	}
+	svc = NewMessageService(&fakeStorage{getErr: storage.ErrNotFound}, zap.NewNop(), nil, nil)
+	if _, err := svc.GetMessageByProviderID(context.Background(), "prov-1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMessageService_GetDeadLetter(t *testing.T) {
+	id := uuid.New().String()
+	svc := NewMessageService(&fakeStorage{got: &model.Message{Status: model.StatusFailed}}, zap.NewNop(), nil, nil)
+	if _, err := svc.GetDeadLetter(context.Background(), "not-a-uuid"); !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("expected ErrInvalidID, got %v", err)
+	}
+	if _, err := svc.GetDeadLetter(context.Background(), id); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// messages that are not dead-lettered are not exposed
+	svc = NewMessageService(&fakeStorage{got: &model.Message{Status: model.StatusSent}}, zap.NewNop(), nil, nil)
+	if _, err := svc.GetDeadLetter(context.Background(), id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMessageService_RequeueDeadLetter_MapsErrors(t *testing.T) {
+	id := uuid.New().String()
+	svc := NewMessageService(&fakeStorage{getErr: storage.ErrStatusConflict}, zap.NewNop(), nil, nil)
+	if _, err := svc.RequeueDeadLetter(context.Background(), id); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	svc = NewMessageService(&fakeStorage{getErr: storage.ErrNotFound}, zap.NewNop(), nil, nil)
+	if _, err := svc.RequeueDeadLetter(context.Background(), id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
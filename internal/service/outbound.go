@@ -0,0 +1,30 @@
+package service
+
+import (
+	"github.com/hakan-sariman/insider-assessment/internal/outbound"
+)
+
+// Outbound is the outbound provider service interface
+type Outbound interface {
+	// Circuit returns the state of the circuit breaker around the provider
+	Circuit() outbound.BreakerSnapshot
+}
+
+// outboundSvc is the outbound service implementation
+type outboundSvc struct {
+	breaker *outbound.Breaker
+}
+
+// NewOutboundService creates a new outbound service,
+// breaker is nil when the circuit breaker is disabled
+func NewOutboundService(breaker *outbound.Breaker) Outbound {
+	return &outboundSvc{breaker: breaker}
+}
+
+// Circuit returns the state of the circuit breaker
+func (s *outboundSvc) Circuit() outbound.BreakerSnapshot {
+	if s.breaker == nil {
+		return outbound.BreakerSnapshot{State: outbound.BreakerDisabled}
+	}
+	return s.breaker.Snapshot()
+}
@@ -0,0 +1,19 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/hakan-sariman/insider-assessment/internal/outbound"
+
+	"go.uber.org/zap"
+)
+
+func TestOutboundCircuit(t *testing.T) {
+	if got := NewOutboundService(nil).Circuit(); got.State != outbound.BreakerDisabled {
+		t.Fatalf("expected disabled without a breaker, got %s", got.State)
+	}
+	b := outbound.NewBreaker(nil, outbound.BreakerConfig{}, zap.NewNop())
+	if got := NewOutboundService(b).Circuit(); got.State != outbound.BreakerClosed {
+		t.Fatalf("expected closed, got %s", got.State)
+	}
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/hakan-sariman/insider-assessment/internal/cache"
+	"github.com/hakan-sariman/insider-assessment/internal/model"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// ErrInvalidReceipt is returned when a delivery receipt is not valid
+var ErrInvalidReceipt = errors.New("invalid delivery receipt")
+
+// ReceiptRequest is a delivery report from the provider
+type ReceiptRequest struct {
+	// ProviderMessageID is the messageId the provider returned when the message was sent
+	ProviderMessageID string
+	// Status is either delivered or undelivered
+	Status model.Status
+	// Timestamp is when the provider delivered or gave up on the message, now if not set
+	Timestamp *time.Time
+	// Error is the provider's reason for an undelivered message
+	Error string
+}
+
+// MessageIDCache resolves provider message ids to our message ids
+type MessageIDCache interface {
+	GetMessageID(ctx context.Context, key string) (string, error)
+}
+
+// Receipt is the delivery receipt service interface
+type Receipt interface {
+	RecordReceipt(ctx context.Context, req ReceiptRequest) (*model.Message, error)
+}
+
+// receipt is the delivery receipt service implementation
+type receipt struct {
+	store  storage.Storage
+	cache  MessageIDCache
+	logger *zap.Logger
+}
+
+// NewReceiptService creates a new delivery receipt service,
+// cache is optional and falls back to the database
+func NewReceiptService(store storage.Storage, cache MessageIDCache, logger *zap.Logger) Receipt {
+	return &receipt{store: store, cache: cache, logger: logger}
+}
+
+// RecordReceipt moves the sent message the receipt is for to delivered or undelivered
+func (s *receipt) RecordReceipt(ctx context.Context, req ReceiptRequest) (*model.Message, error) {
+	s.logger.Debug("RecordReceipt", zap.String("provider_message_id", req.ProviderMessageID), zap.String("status", string(req.Status)))
+	if strings.TrimSpace(req.ProviderMessageID) == "" {
+		return nil, ErrInvalidReceipt
+	}
+	if req.Status != model.StatusDelivered && req.Status != model.StatusUndelivered {
+		return nil, ErrInvalidReceipt
+	}
+
+	id, err := s.resolve(ctx, req.ProviderMessageID)
+	if err != nil {
+		return nil, err
+	}
+
+	at := time.Now().UTC()
+	if req.Timestamp != nil {
+		at = req.Timestamp.UTC()
+	}
+	var lastErr *string
+	if req.Error != "" {
+		lastErr = &req.Error
+	}
+	msg, err := s.store.RecordReceipt(ctx, id, req.Status, at, lastErr)
+	if err != nil {
+		return nil, storeErr(s.logger, "RecordReceipt", err)
+	}
+	s.logger.Info("RecordReceipt: recorded", zap.String("id", id), zap.String("status", string(msg.Status)))
+	return msg, nil
+}
+
+// resolve returns our message id for a provider message id,
+// from the cache first and from the database on a miss
+func (s *receipt) resolve(ctx context.Context, providerMessageID string) (string, error) {
+	if s.cache != nil {
+		id, err := s.cache.GetMessageID(ctx, cache.MessageKey(providerMessageID))
+		if err != nil {
+			s.logger.Warn("RecordReceipt: cache get failed", zap.String("provider_message_id", providerMessageID), zap.Error(err))
+		} else if id != "" {
+			return id, nil
+		}
+	}
+	msg, err := s.store.GetMessageByProviderID(ctx, providerMessageID)
+	if err != nil {
+		return "", storeErr(s.logger, "RecordReceipt", err)
+	}
+	return msg.ID.String(), nil
+}
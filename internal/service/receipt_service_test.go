@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hakan-sariman/insider-assessment/internal/model"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type fakeIDCache struct {
+	ids map[string]string
+	err error
+}
+
+func (f fakeIDCache) GetMessageID(ctx context.Context, key string) (string, error) {
+	return f.ids[key], f.err
+}
+
+func TestReceiptService_Validation(t *testing.T) {
+	svc := NewReceiptService(&fakeStorage{}, nil, zap.NewNop())
+	for _, req := range []ReceiptRequest{
+		{ProviderMessageID: "", Status: model.StatusDelivered},
+		{ProviderMessageID: "p1", Status: model.StatusSent},
+	} {
+		if _, err := svc.RecordReceipt(context.Background(), req); !errors.Is(err, ErrInvalidReceipt) {
+			t.Fatalf("expected ErrInvalidReceipt for %#v, got %v", req, err)
+		}
+	}
+}
+
+func TestReceiptService_ResolvesFromCache(t *testing.T) {
+	id := uuid.New().String()
+	store := &fakeStorage{}
+	svc := NewReceiptService(store, fakeIDCache{ids: map[string]string{"message:p1": id}}, zap.NewNop())
+	msg, err := svc.RecordReceipt(context.Background(), ReceiptRequest{ProviderMessageID: "p1", Status: model.StatusDelivered})
+	if err != nil || msg.Status != model.StatusDelivered {
+		t.Fatalf("unexpected: %v %#v", err, msg)
+	}
+	if store.receiptID != id || store.receiptSt != model.StatusDelivered {
+		t.Fatalf("unexpected receipt: %q %q", store.receiptID, store.receiptSt)
+	}
+}
+
+func TestReceiptService_FallsBackToDB(t *testing.T) {
+	id := uuid.New()
+	store := &fakeStorage{got: &model.Message{ID: id, Status: model.StatusSent}}
+	svc := NewReceiptService(store, fakeIDCache{err: errors.New("redis down")}, zap.NewNop())
+	if _, err := svc.RecordReceipt(context.Background(), ReceiptRequest{ProviderMessageID: "p1", Status: model.StatusUndelivered, Error: "absent subscriber"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if store.receiptID != id.String() || store.receiptSt != model.StatusUndelivered {
+		t.Fatalf("unexpected receipt: %q %q", store.receiptID, store.receiptSt)
+	}
+}
+
+func TestReceiptService_MapsErrors(t *testing.T) {
+	svc := NewReceiptService(&fakeStorage{getErr: storage.ErrNotFound}, nil, zap.NewNop())
+	if _, err := svc.RecordReceipt(context.Background(), ReceiptRequest{ProviderMessageID: "p1", Status: model.StatusDelivered}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	svc = NewReceiptService(&fakeStorage{getErr: storage.ErrStatusConflict}, fakeIDCache{ids: map[string]string{"message:p1": uuid.New().String()}}, zap.NewNop())
+	if _, err := svc.RecordReceipt(context.Background(), ReceiptRequest{ProviderMessageID: "p1", Status: model.StatusDelivered}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+}
@@ -2,35 +2,266 @@ package service
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"github.com/hakan-sariman/insider-assessment/internal/model"
 	"github.com/hakan-sariman/insider-assessment/internal/scheduler"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
 
 	"go.uber.org/zap"
 )
 
+// DefaultStateSync is used when the state sync interval is not set
+const DefaultStateSync = 10 * time.Second
+
+var (
+	// ErrInvalidTuning is returned when an interval or batch size is out of bounds
+	ErrInvalidTuning = scheduler.ErrInvalidTuning
+	// ErrSchedulerNotRunning is returned when restarting a scheduler that is not running
+	ErrSchedulerNotRunning = errors.New("scheduler is not running on this replica")
+)
+
 // Scheduler is the scheduler service interface
 type Scheduler interface {
-	Start(ctx context.Context)
-	Stop(reason error)
+	// Start sets the desired state of every replica to running
+	Start(ctx context.Context, reason string) error
+	// Stop sets the desired state of every replica to stopped
+	Stop(ctx context.Context, reason string) error
+	// Restart restarts the scheduler of this replica,
+	// ErrSchedulerNotRunning if it is not running
+	Restart(ctx context.Context, reason string) error
+	// Run keeps the scheduler of this replica in the desired state
+	// until ctx is done, then stops it for good
+	Run(ctx context.Context)
+	// Leader returns which replica runs the scheduler
+	Leader(ctx context.Context) (scheduler.LeaderInfo, error)
+	// Status returns what the scheduler of this replica is doing and the queue depth
+	Status(ctx context.Context) (*SchedulerStatus, error)
+	// Tune changes the interval and batch size of every replica
+	Tune(ctx context.Context, req SchedulerTuning) (*SchedulerStatus, error)
+}
+
+// SchedulerTuning changes the interval and batch size, unset fields are kept
+type SchedulerTuning struct {
+	Interval  *time.Duration
+	BatchSize *int
+}
+
+// SchedulerStore is the storage used by the scheduler service
+type SchedulerStore interface {
+	// GetSchedulerState returns the desired state shared by all replicas,
+	// storage.ErrNoSchedulerState if it was never set
+	GetSchedulerState(ctx context.Context) (*model.SchedulerState, error)
+	SetSchedulerState(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error)
+	SetSchedulerTuning(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error)
+	CountByStatus(ctx context.Context) (map[model.Status]int, error)
+}
+
+// SchedulerStatus is what the scheduler of this replica is doing
+type SchedulerStatus struct {
+	scheduler.Stats
+	// Lifecycle has the latest starts, stops and restarts of this replica's scheduler
+	Lifecycle scheduler.Lifecycle `json:"lifecycle"`
+	// Desired is the running state replicas converge on, unset until it is first set
+	Desired *model.SchedulerState `json:"desired,omitempty"`
+	// QueueDepth is the number of unsent messages
+	QueueDepth int `json:"queue_depth"`
+	// Counts is the number of messages by status
+	Counts map[model.Status]int `json:"counts"`
+}
+
+// localScheduler is the supervised scheduler of this replica
+type localScheduler interface {
+	ID() string
+	Enabled() bool
+	Running() bool
+	Start(reason string) bool
+	Stop(reason string) bool
+	Restart(reason string) bool
+	Close(reason string)
+	Lifecycle() scheduler.Lifecycle
+	Leader(ctx context.Context) (scheduler.LeaderInfo, error)
+	Stats() scheduler.Stats
+	Tuning() scheduler.Tuning
+	Tune(t scheduler.Tuning) error
 }
 
 // sched is the scheduler service wrapper
 type sched struct {
-	sched *scheduler.Scheduler
-	log   *zap.Logger
+	sched     localScheduler
+	store     SchedulerStore
+	syncEvery time.Duration
+	// kick makes Run apply a state change right away
+	kick chan struct{}
+	log  *zap.Logger
+}
+
+// NewScheduler creates a new scheduler service wrapper, the desired state
+// in store is checked every syncEvery
+func NewScheduler(s *scheduler.Supervisor, store SchedulerStore, syncEvery time.Duration, log *zap.Logger) Scheduler {
+	if syncEvery <= 0 {
+		syncEvery = DefaultStateSync
+	}
+	return &sched{sched: s, store: store, syncEvery: syncEvery, kick: make(chan struct{}, 1), log: log}
+}
+
+// Start sets the desired state to running
+func (s *sched) Start(ctx context.Context, reason string) error {
+	return s.setState(ctx, true, reason)
+}
+
+// Stop sets the desired state to stopped
+func (s *sched) Stop(ctx context.Context, reason string) error {
+	return s.setState(ctx, false, reason)
+}
+
+func (s *sched) setState(ctx context.Context, running bool, reason string) error {
+	_, err := s.store.SetSchedulerState(ctx, model.SchedulerState{Running: running, Reason: reason, UpdatedBy: s.sched.ID()})
+	if err != nil {
+		s.log.Error("scheduler state update failed", zap.Bool("running", running), zap.Error(err))
+		return err
+	}
+	if !s.sched.Enabled() {
+		s.log.Warn("scheduler disabled on this replica, desired state only applies to the others", zap.Bool("running", running))
+	}
+	s.syncNow()
+	return nil
+}
+
+// Restart restarts the scheduler of this replica, the desired state is left as it is
+func (s *sched) Restart(ctx context.Context, reason string) error {
+	if !s.sched.Restart(reason) {
+		return ErrSchedulerNotRunning
+	}
+	return nil
+}
+
+// syncNow makes Run apply the desired state without waiting for syncEvery
+func (s *sched) syncNow() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Tune validates and stores the supplied interval and batch size, the
+// others are kept as stored. The stored settings are applied here right
+// away and on the other replicas within syncEvery.
+func (s *sched) Tune(ctx context.Context, req SchedulerTuning) (*SchedulerStatus, error) {
+	st := model.SchedulerState{UpdatedBy: s.sched.ID()}
+	if req.Interval != nil {
+		if err := scheduler.ValidateInterval(*req.Interval); err != nil {
+			return nil, err
+		}
+		st.IntervalMs = req.Interval.Milliseconds()
+	}
+	if req.BatchSize != nil {
+		if err := scheduler.ValidateBatchSize(*req.BatchSize); err != nil {
+			return nil, err
+		}
+		st.BatchSize = *req.BatchSize
+	}
+	stored, err := s.store.SetSchedulerTuning(ctx, st)
+	if err != nil {
+		s.log.Error("scheduler tuning update failed", zap.Error(err))
+		return nil, err
+	}
+	if err := s.applyTuning(stored); err != nil {
+		return nil, err
+	}
+	s.syncNow()
+	return s.Status(ctx)
+}
+
+// Run applies the desired state every syncEvery and after every change
+// made through this replica. The scheduler runs when no state was set yet.
+func (s *sched) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.syncEvery)
+	defer ticker.Stop()
+	for {
+		s.sync(ctx)
+		select {
+		case <-ctx.Done():
+			s.sched.Close(context.Cause(ctx).Error())
+			return
+		case <-ticker.C:
+		case <-s.kick:
+		}
+	}
+}
+
+// sync starts or stops the scheduler of this replica to match the desired state
+func (s *sched) sync(ctx context.Context) {
+	if !s.sched.Enabled() {
+		return
+	}
+	running, reason := true, "no desired state set"
+	st, err := s.store.GetSchedulerState(ctx)
+	switch {
+	case errors.Is(err, storage.ErrNoSchedulerState):
+	case err != nil:
+		if ctx.Err() == nil {
+			s.log.Error("scheduler state lookup failed, keeping the current state", zap.Error(err))
+		}
+		return
+	default:
+		running, reason = st.Running, st.Reason
+		if err := s.applyTuning(st); err != nil {
+			s.log.Warn("stored scheduler tuning ignored", zap.Int64("interval_ms", st.IntervalMs), zap.Int("batch_size", st.BatchSize), zap.Error(err))
+		}
+	}
+	if running == s.sched.Running() || ctx.Err() != nil {
+		return
+	}
+	s.log.Info("scheduler converging on desired state", zap.Bool("running", running), zap.String("reason", reason))
+	if running {
+		s.sched.Start("desired state running: " + reason)
+	} else {
+		s.sched.Stop("desired state stopped: " + reason)
+	}
 }
 
-// NewScheduler creates a new scheduler service wrapper
-func NewScheduler(s *scheduler.Scheduler, log *zap.Logger) Scheduler {
-	return &sched{sched: s, log: log}
+// applyTuning tunes the scheduler of this replica with the stored interval
+// and batch size, the ones never stored are kept as configured
+func (s *sched) applyTuning(st *model.SchedulerState) error {
+	cur := s.sched.Tuning()
+	t := cur
+	if st.IntervalMs > 0 {
+		t.Interval = time.Duration(st.IntervalMs) * time.Millisecond
+	}
+	if st.BatchSize > 0 {
+		t.BatchSize = st.BatchSize
+	}
+	if t == cur {
+		return nil
+	}
+	return s.sched.Tune(t)
 }
 
-// Start starts the scheduler
-func (s *sched) Start(ctx context.Context) {
-	s.sched.Start(ctx)
+// Leader returns which replica runs the scheduler
+func (s *sched) Leader(ctx context.Context) (scheduler.LeaderInfo, error) {
+	info, err := s.sched.Leader(ctx)
+	if err != nil {
+		s.log.Error("scheduler leader lookup failed", zap.Error(err))
+	}
+	return info, err
 }
 
-// Stop stops the scheduler
-func (s *sched) Stop(reason error) {
-	s.sched.Stop(reason)
+// Status returns what the scheduler of this replica is doing
+func (s *sched) Status(ctx context.Context) (*SchedulerStatus, error) {
+	st := &SchedulerStatus{Stats: s.sched.Stats(), Lifecycle: s.sched.Lifecycle()}
+	desired, err := s.store.GetSchedulerState(ctx)
+	if err != nil && !errors.Is(err, storage.ErrNoSchedulerState) {
+		s.log.Error("scheduler state lookup failed", zap.Error(err))
+		return nil, err
+	}
+	st.Desired = desired
+	st.Counts, err = s.store.CountByStatus(ctx)
+	if err != nil {
+		s.log.Error("message count failed", zap.Error(err))
+		return nil, err
+	}
+	st.QueueDepth = st.Counts[model.StatusUnsent]
+	return st, nil
 }
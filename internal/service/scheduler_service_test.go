@@ -3,33 +3,309 @@ package service
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/hakan-sariman/insider-assessment/internal/model"
 	"github.com/hakan-sariman/insider-assessment/internal/scheduler"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
+
 	"go.uber.org/zap"
 )
 
-type fakeSched struct{ started, stopped bool }
-
-func (f *fakeSched) Start(ctx context.Context) { f.started = true }
-func (f *fakeSched) Stop(reason error)         { f.stopped = true }
-
-func TestSchedulerWrapper_StartStop(t *testing.T) {
-	under := &scheduler.Scheduler{} // only for type; we won't call methods
-	_ = under
-	fake := &fakeSched{}
-	s := NewScheduler((*scheduler.Scheduler)(nil), zap.NewNop())
-	// Replace internal with fake via type assertion
-	ss := s.(*sched)
-	ss.sched = (*scheduler.Scheduler)(nil) // not used directly
-	// monkey-patch methods via embedding fake through interface on wrapper methods
-	// Instead, directly test wrapper calls our fake
-	ssStart := func(ctx context.Context) { fake.Start(ctx) }
-	ssStop := func(err error) { fake.Stop(err) }
-	// invoke through functions
-	ssStart(context.Background())
-	ssStop(errors.New("x"))
-	if !fake.started || !fake.stopped {
-		t.Fatalf("wrapper did not delegate start/stop")
+type fakeSched struct {
+	mtx              sync.Mutex
+	enabled, running bool
+	starts, stops    int
+	tuning           scheduler.Tuning
+}
+
+func (f *fakeSched) ID() string    { return "replica-a" }
+func (f *fakeSched) Enabled() bool { return f.enabled }
+func (f *fakeSched) Running() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.running
+}
+func (f *fakeSched) Start(reason string) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.running {
+		return false
+	}
+	f.running = true
+	f.starts++
+	return true
+}
+func (f *fakeSched) Stop(reason string) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if !f.running {
+		return false
+	}
+	f.running = false
+	f.stops++
+	return true
+}
+func (f *fakeSched) Restart(reason string) bool {
+	return f.Stop(reason) && f.Start(reason)
+}
+func (f *fakeSched) Close(reason string) { f.Stop(reason) }
+func (f *fakeSched) Lifecycle() scheduler.Lifecycle {
+	return scheduler.Lifecycle{Running: f.Running()}
+}
+func (f *fakeSched) Leader(ctx context.Context) (scheduler.LeaderInfo, error) {
+	return scheduler.LeaderInfo{Self: f.ID(), IsLeader: true}, nil
+}
+func (f *fakeSched) Stats() scheduler.Stats {
+	t := f.Tuning()
+	return scheduler.Stats{Self: f.ID(), Enabled: f.enabled, Running: f.Running(), Interval: t.Interval.String(), BatchSize: t.BatchSize, TotalSent: 3}
+}
+func (f *fakeSched) Tuning() scheduler.Tuning {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.tuning
+}
+func (f *fakeSched) Tune(t scheduler.Tuning) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if t.Interval != f.tuning.Interval {
+		if err := scheduler.ValidateInterval(t.Interval); err != nil {
+			return err
+		}
+	}
+	if t.BatchSize != f.tuning.BatchSize {
+		if err := scheduler.ValidateBatchSize(t.BatchSize); err != nil {
+			return err
+		}
+	}
+	f.tuning = t
+	return nil
+}
+
+type fakeStateStore struct {
+	mtx    sync.Mutex
+	st     *model.SchedulerState
+	err    error
+	counts map[model.Status]int
+}
+
+func (f *fakeStateStore) GetSchedulerState(ctx context.Context) (*model.SchedulerState, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.st == nil {
+		return nil, storage.ErrNoSchedulerState
+	}
+	return f.st, nil
+}
+
+func (f *fakeStateStore) SetSchedulerState(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.st = &st
+	return &st, nil
+}
+
+func (f *fakeStateStore) SetSchedulerTuning(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.st == nil {
+		f.st = &model.SchedulerState{Running: true}
+	}
+	if st.IntervalMs > 0 {
+		f.st.IntervalMs = st.IntervalMs
+	}
+	if st.BatchSize > 0 {
+		f.st.BatchSize = st.BatchSize
+	}
+	return f.st, nil
+}
+
+func (f *fakeStateStore) CountByStatus(ctx context.Context) (map[model.Status]int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.counts, nil
+}
+
+func newTestSched(local *fakeSched, store *fakeStateStore) *sched {
+	return &sched{sched: local, store: store, syncEvery: time.Hour, kick: make(chan struct{}, 1), log: zap.NewNop()}
+}
+
+func TestScheduler_ConvergesOnDesiredState(t *testing.T) {
+	ctx := context.Background()
+	local, store := &fakeSched{enabled: true}, &fakeStateStore{}
+	s := newTestSched(local, store)
+
+	// runs until a state is set
+	s.sync(ctx)
+	if !local.Running() {
+		t.Fatalf("expected the scheduler to run without a desired state")
+	}
+
+	if err := s.Stop(ctx, "maintenance"); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if store.st == nil || store.st.Running || store.st.Reason != "maintenance" || store.st.UpdatedBy != "replica-a" {
+		t.Fatalf("unexpected stored state %#v", store.st)
+	}
+	s.sync(ctx)
+	if local.Running() {
+		t.Fatalf("expected the scheduler to stop")
+	}
+
+	// a state set by another replica is picked up
+	store.st = &model.SchedulerState{Running: true}
+	s.sync(ctx)
+	s.sync(ctx)
+	if !local.Running() || local.starts != 2 {
+		t.Fatalf("expected one more start, got running=%v starts=%d", local.Running(), local.starts)
+	}
+}
+
+func TestScheduler_DisabledNeverRuns(t *testing.T) {
+	ctx := context.Background()
+	local, store := &fakeSched{}, &fakeStateStore{}
+	s := newTestSched(local, store)
+
+	if err := s.Start(ctx, "test"); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	s.sync(ctx)
+	if local.Running() || !store.st.Running {
+		t.Fatalf("expected the desired state stored but a disabled scheduler")
+	}
+}
+
+func TestScheduler_StoreErrors(t *testing.T) {
+	ctx := context.Background()
+	local, store := &fakeSched{enabled: true, running: true}, &fakeStateStore{err: errors.New("db")}
+	s := newTestSched(local, store)
+
+	if err := s.Stop(ctx, "test"); err == nil {
+		t.Fatalf("expected the store error")
+	}
+	s.sync(ctx)
+	if !local.Running() {
+		t.Fatalf("expected the scheduler to keep running when the state cannot be read")
+	}
+}
+
+func TestScheduler_RunAppliesChangesAndStops(t *testing.T) {
+	local, store := &fakeSched{enabled: true}, &fakeStateStore{st: &model.SchedulerState{Running: false}}
+	s := newTestSched(local, store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+
+	// the change is applied right away, not after syncEvery
+	if err := s.Start(context.Background(), "test"); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !local.Running() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the scheduler to start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+	if local.Running() || !store.st.Running {
+		t.Fatalf("expected Run to stop the scheduler and keep the desired state")
+	}
+}
+
+func TestScheduler_Status(t *testing.T) {
+	ctx := context.Background()
+	local := &fakeSched{enabled: true, running: true}
+	store := &fakeStateStore{counts: map[model.Status]int{model.StatusUnsent: 7, model.StatusSent: 2}}
+	s := newTestSched(local, store)
+
+	st, err := s.Status(ctx)
+	if err != nil || !st.Running || st.TotalSent != 3 || st.QueueDepth != 7 || st.Counts[model.StatusSent] != 2 || st.Desired != nil {
+		t.Fatalf("unexpected status %#v %v", st, err)
+	}
+
+	_ = s.Stop(ctx, "maintenance")
+	if st, err = s.Status(ctx); err != nil || st.Desired == nil || st.Desired.Running {
+		t.Fatalf("expected the desired state, got %#v %v", st, err)
+	}
+
+	store.err = errors.New("db")
+	if _, err := s.Status(ctx); err == nil {
+		t.Fatalf("expected the store error")
+	}
+}
+
+func TestScheduler_Tune(t *testing.T) {
+	ctx := context.Background()
+	// the configured interval is below MinInterval, a batch size change keeps it
+	local := &fakeSched{enabled: true, tuning: scheduler.Tuning{Interval: 500 * time.Millisecond, BatchSize: 2}}
+	store := &fakeStateStore{}
+	s := newTestSched(local, store)
+
+	batch := 50
+	st, err := s.Tune(ctx, SchedulerTuning{BatchSize: &batch})
+	if err != nil || st.Interval != "500ms" || st.BatchSize != 50 {
+		t.Fatalf("unexpected status %#v %v", st, err)
+	}
+	if store.st == nil || !store.st.Running || store.st.IntervalMs != 0 || store.st.BatchSize != 50 {
+		t.Fatalf("expected only the batch size stored, got %#v", store.st)
+	}
+
+	interval := time.Millisecond
+	if _, err := s.Tune(ctx, SchedulerTuning{Interval: &interval}); !errors.Is(err, ErrInvalidTuning) {
+		t.Fatalf("expected ErrInvalidTuning, got %v", err)
+	}
+	if store.st.IntervalMs != 0 || local.Tuning().Interval != 500*time.Millisecond {
+		t.Fatalf("invalid settings must not be stored or applied")
+	}
+}
+
+func TestScheduler_TuneAppliesStoredSettings(t *testing.T) {
+	ctx := context.Background()
+	local := &fakeSched{enabled: true, tuning: scheduler.Tuning{Interval: time.Minute, BatchSize: 2}}
+	// another replica stored a batch size this one has not picked up yet
+	store := &fakeStateStore{st: &model.SchedulerState{Running: true, BatchSize: 20}}
+	s := newTestSched(local, store)
+
+	interval := 5 * time.Second
+	if _, err := s.Tune(ctx, SchedulerTuning{Interval: &interval}); err != nil {
+		t.Fatalf("tune: %v", err)
+	}
+	if store.st.IntervalMs != 5_000 || store.st.BatchSize != 20 {
+		t.Fatalf("unexpected stored state %#v", store.st)
+	}
+	if got := local.Tuning(); got.Interval != 5*time.Second || got.BatchSize != 20 {
+		t.Fatalf("expected the stored settings to be applied, got %+v", got)
+	}
+}
+
+func TestScheduler_SyncAppliesStoredTuning(t *testing.T) {
+	local := &fakeSched{enabled: true, tuning: scheduler.Tuning{Interval: time.Minute, BatchSize: 2}}
+	store := &fakeStateStore{st: &model.SchedulerState{Running: true, IntervalMs: 5_000}}
+	s := newTestSched(local, store)
+
+	s.sync(context.Background())
+	if got := local.Tuning(); got.Interval != 5*time.Second || got.BatchSize != 2 || !local.Running() {
+		t.Fatalf("expected the stored interval to be applied, got %+v", got)
 	}
 }
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_messages_sending_lease;
+
+UPDATE messages SET status = 'unsent' WHERE status = 'sending';
+
+ALTER TABLE messages DROP COLUMN IF EXISTS lease_expires_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS lease_owner;
+
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_status_check;
+ALTER TABLE messages ADD CONSTRAINT messages_status_check CHECK (status IN ('unsent','sent'));
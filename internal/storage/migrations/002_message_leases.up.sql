@@ -0,0 +1,7 @@
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_status_check;
+ALTER TABLE messages ADD CONSTRAINT messages_status_check CHECK (status IN ('unsent','sending','sent'));
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS lease_owner TEXT NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMPTZ NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_sending_lease ON messages (lease_expires_at) WHERE status = 'sending';
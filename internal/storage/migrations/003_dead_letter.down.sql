@@ -0,0 +1,4 @@
+UPDATE messages SET status = 'unsent' WHERE status = 'failed';
+
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_status_check;
+ALTER TABLE messages ADD CONSTRAINT messages_status_check CHECK (status IN ('unsent','sending','sent'));
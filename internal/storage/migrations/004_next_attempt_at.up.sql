@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ NULL;
+UPDATE messages SET next_attempt_at = created_at WHERE next_attempt_at IS NULL;
+ALTER TABLE messages ALTER COLUMN next_attempt_at SET DEFAULT now();
+ALTER TABLE messages ALTER COLUMN next_attempt_at SET NOT NULL;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_messages_unsent_due;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS send_at;
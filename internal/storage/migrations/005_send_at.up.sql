@@ -0,0 +1,6 @@
+-- send_at is the requested delivery time, the scheduler only looks at
+-- next_attempt_at which starts at send_at and is pushed back by retries
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS send_at TIMESTAMPTZ NULL;
+
+-- serves FetchUnsent: due unsent messages in due order
+CREATE INDEX IF NOT EXISTS idx_messages_unsent_due ON messages (next_attempt_at, created_at) WHERE status = 'unsent';
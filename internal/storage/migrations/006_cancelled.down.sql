@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_messages_to_created;
+
+UPDATE messages SET status = 'failed', last_error = 'cancelled' WHERE status = 'cancelled';
+
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_status_check;
+ALTER TABLE messages ADD CONSTRAINT messages_status_check CHECK (status IN ('unsent','sending','sent','failed'));
@@ -0,0 +1,4 @@
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_status_check;
+ALTER TABLE messages ADD CONSTRAINT messages_status_check CHECK (status IN ('unsent','sending','sent','failed','cancelled'));
+
+CREATE INDEX IF NOT EXISTS idx_messages_to_created ON messages ("to", created_at);
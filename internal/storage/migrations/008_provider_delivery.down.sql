@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_messages_provider_message_id;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS provider_latency_ms;
+ALTER TABLE messages DROP COLUMN IF EXISTS provider_status;
+ALTER TABLE messages DROP COLUMN IF EXISTS provider_message_id;
@@ -0,0 +1,5 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS provider_message_id TEXT NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS provider_status INT NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS provider_latency_ms INT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_provider_message_id ON messages (provider_message_id) WHERE provider_message_id IS NOT NULL;
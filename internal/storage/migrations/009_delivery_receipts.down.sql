@@ -0,0 +1,7 @@
+ALTER TABLE messages DROP COLUMN IF EXISTS receipt_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS delivered_at;
+
+UPDATE messages SET status = 'sent' WHERE status IN ('delivered','undelivered');
+
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_status_check;
+ALTER TABLE messages ADD CONSTRAINT messages_status_check CHECK (status IN ('unsent','sending','sent','failed','cancelled'));
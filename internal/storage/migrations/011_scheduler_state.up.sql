@@ -0,0 +1,9 @@
+-- scheduler_state holds the desired running state every replica converges on,
+-- the single row is created the first time the scheduler is started or stopped
+CREATE TABLE IF NOT EXISTS scheduler_state (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    running BOOLEAN NOT NULL,
+    reason TEXT NULL,
+    updated_by TEXT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
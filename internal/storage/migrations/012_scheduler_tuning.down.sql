@@ -0,0 +1,2 @@
+ALTER TABLE scheduler_state DROP COLUMN IF EXISTS batch_size;
+ALTER TABLE scheduler_state DROP COLUMN IF EXISTS interval_ms;
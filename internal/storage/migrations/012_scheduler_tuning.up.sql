@@ -0,0 +1,3 @@
+-- interval and batch size set at runtime, NULL keeps the configured values
+ALTER TABLE scheduler_state ADD COLUMN IF NOT EXISTS interval_ms BIGINT NULL;
+ALTER TABLE scheduler_state ADD COLUMN IF NOT EXISTS batch_size INT NULL;
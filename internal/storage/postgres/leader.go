@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+// LeaderLockKey is the advisory lock held by the scheduler leader
+const LeaderLockKey int64 = 720_401
+
+// Campaign contends for leadership as id until ctx is done. The advisory lock
+// is taken on a dedicated connection named id, every retry while another
+// replica leads, and held for as long as the connection lives, so a leader
+// that dies hands over to the next replica to retry. onChange is called when
+// leadership is gained or lost.
+func (p *Postgres) Campaign(ctx context.Context, id string, retry time.Duration, onChange func(leader bool)) error {
+	for {
+		err := p.campaign(ctx, id, retry, onChange)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.logger.Warn("Campaign: connection lost, reconnecting", zap.Error(err), zap.Duration("retry_in", retry))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+// campaign contends for the lock on a new connection until it fails,
+// closing the connection releases the lock
+func (p *Postgres) campaign(ctx context.Context, id string, retry time.Duration, onChange func(leader bool)) error {
+	cfg := p.pool.Config().ConnConfig.Copy()
+	cfg.RuntimeParams["application_name"] = id
+	conn, err := pgx.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	leader := false
+	defer func() {
+		_ = conn.Close(context.Background())
+		if leader {
+			p.logger.Info("Campaign: stepped down", zap.String("id", id))
+			onChange(false)
+		}
+	}()
+
+	ticker := time.NewTicker(retry)
+	defer ticker.Stop()
+	for {
+		if leader {
+			// the lock may be gone with a session that does not answer
+			if err := conn.Ping(ctx); err != nil {
+				return err
+			}
+		} else {
+			if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, LeaderLockKey).Scan(&leader); err != nil {
+				return err
+			}
+			if leader {
+				p.logger.Info("Campaign: elected leader", zap.String("id", id))
+				onChange(true)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Leader returns the id of the replica holding the leader lock, "" when none does
+func (p *Postgres) Leader(ctx context.Context) (string, error) {
+	var id string
+	// a bigint advisory key is split into classid (high) and objid (low bits)
+	err := p.pool.QueryRow(ctx, `
+		SELECT a.application_name
+		FROM pg_locks l
+		JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted
+			AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+			AND l.classid = 0 AND l.objid::bigint = $1 AND l.objsubid = 1
+	`, LeaderLockKey).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		p.logger.Error("Leader query fail", zap.Error(err))
+		return "", err
+	}
+	return id, nil
+}
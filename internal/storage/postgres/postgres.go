@@ -2,12 +2,18 @@ package postgres
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hakan-sariman/insider-assessment/internal/model"
 	"github.com/hakan-sariman/insider-assessment/internal/storage"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 )
@@ -15,6 +21,53 @@ import (
 // Ensure Postgres implements Storage interface
 var _ storage.Storage = (*Postgres)(nil)
 
+// messageColumns is the column list scanned by scanMessage
+const messageColumns = `id, "to", content, status, provider, provider_message_id, provider_status, provider_latency_ms, attempt_count, send_at, next_attempt_at, created_at, updated_at, sent_at, delivered_at, receipt_at, last_error, lease_owner, lease_expires_at`
+
+// insertMessageSQL inserts a message with the values of insertMessageArgs
+const insertMessageSQL = `
+	INSERT INTO messages (id, "to", content, status, attempt_count, send_at, next_attempt_at, created_at, updated_at)
+	VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+`
+
+// NotifyChannel is notified when messages that are already due are inserted
+const NotifyChannel = "messages_new"
+
+// insertMessageNotifySQL is insertMessageSQL that also notifies NotifyChannel
+// when $10 is set, the notification is only delivered on commit. Whether the
+// message is due is decided by the caller with isDue, next_attempt_at is set
+// by the application clock and would miss a database clock running behind.
+const insertMessageNotifySQL = `
+	WITH inserted AS (` + insertMessageSQL + ` RETURNING id)
+	SELECT pg_notify('` + NotifyChannel + `', '') FROM inserted WHERE $10::boolean
+`
+
+const (
+	// listenRetryMin and listenRetryMax bound the delay between LISTEN reconnects
+	listenRetryMin = time.Second
+	listenRetryMax = 30 * time.Second
+)
+
+// insertMessageArgs returns the insertMessageSQL arguments for m
+func insertMessageArgs(m *model.Message) []any {
+	return []any{m.ID, m.To, m.Content, m.Status, m.AttemptCount, m.SendAt, m.NextAttemptAt, m.CreatedAt, m.UpdatedAt}
+}
+
+// insertMessageNotifyArgs returns the insertMessageNotifySQL arguments for m
+func insertMessageNotifyArgs(m *model.Message) []any {
+	return append(insertMessageArgs(m), isDue(m))
+}
+
+// isDue reports whether m can be sent right away
+func isDue(m *model.Message) bool {
+	return !m.NextAttemptAt.After(time.Now())
+}
+
+// scanMessage scans a row selected with messageColumns
+func scanMessage(row pgx.Row, m *model.Message) error {
+	return row.Scan(&m.ID, &m.To, &m.Content, &m.Status, &m.Provider, &m.ProviderMessageID, &m.ProviderStatus, &m.ProviderLatencyMs, &m.AttemptCount, &m.SendAt, &m.NextAttemptAt, &m.CreatedAt, &m.UpdatedAt, &m.SentAt, &m.DeliveredAt, &m.ReceiptAt, &m.LastError, &m.LeaseOwner, &m.LeaseExpiresAt)
+}
+
 // Postgres is the postgres storage implementation
 type Postgres struct {
 	pool   *pgxpool.Pool
@@ -45,63 +98,394 @@ func (p *Postgres) Close() { p.pool.Close() }
 // InsertMessage inserts a new message into the database
 func (p *Postgres) InsertMessage(ctx context.Context, m *model.Message) error {
 	p.logger.Info("InsertMessage", zap.String("to", m.To), zap.String("content", m.Content))
-	_, err := p.pool.Exec(ctx, `
-		INSERT INTO messages (id, "to", content, status, attempt_count, created_at, updated_at)
-		VALUES ($1,$2,$3,$4,$5,$6,$7)
-	`, m.ID, m.To, m.Content, m.Status, m.AttemptCount, m.CreatedAt, m.UpdatedAt)
+	_, err := p.pool.Exec(ctx, insertMessageNotifySQL, insertMessageNotifyArgs(m)...)
 	if err != nil {
 		p.logger.Error("InsertMessage fail", zap.Error(err))
 	}
 	return err
 }
 
-// ListSent lists sent messages
-func (p *Postgres) ListSent(ctx context.Context, limit, offset int) ([]model.Message, error) {
-	p.logger.Info("ListSent", zap.Int("limit", limit), zap.Int("offset", offset))
-	rows, err := p.pool.Query(ctx, `
-		SELECT id, "to", content, status, attempt_count, created_at, updated_at, sent_at, last_error
-		FROM messages
-		WHERE status='sent'
-		ORDER BY sent_at DESC NULLS LAST
-		LIMIT $1 OFFSET $2
-	`, limit, offset)
+// InsertMessages bulk inserts messages with COPY
+func (p *Postgres) InsertMessages(ctx context.Context, msgs []*model.Message) error {
+	p.logger.Info("InsertMessages", zap.Int("count", len(msgs)))
+	n, err := p.pool.CopyFrom(ctx,
+		pgx.Identifier{"messages"},
+		[]string{"id", "to", "content", "status", "attempt_count", "send_at", "next_attempt_at", "created_at", "updated_at"},
+		pgx.CopyFromSlice(len(msgs), func(i int) ([]any, error) {
+			return insertMessageArgs(msgs[i]), nil
+		}),
+	)
+	if err != nil {
+		p.logger.Error("InsertMessages fail", zap.Error(err))
+		return err
+	}
+	p.logger.Info("InsertMessages - inserted", zap.Int64("count", n))
+	for _, m := range msgs {
+		if isDue(m) {
+			if _, err := p.pool.Exec(ctx, `SELECT pg_notify($1, '')`, NotifyChannel); err != nil {
+				// the messages are stored, schedulers pick them up on their next tick
+				p.logger.Warn("InsertMessages: notify fail", zap.Error(err))
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// InsertMessageIdempotent inserts a message together with its idempotency key,
+// or returns the message first created under the key
+func (p *Postgres) InsertMessageIdempotent(ctx context.Context, m *model.Message, key, requestHash string, ttl time.Duration) (*model.Message, bool, error) {
+	p.logger.Info("InsertMessageIdempotent", zap.String("key", key), zap.String("to", m.To), zap.Duration("ttl", ttl))
+	response, err := json.Marshal(m)
+	if err != nil {
+		return nil, false, fmt.Errorf("marshal response: %w", err)
+	}
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		p.logger.Error("InsertMessageIdempotent: begin fail", zap.Error(err))
+		return nil, false, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+	_, err = tx.Exec(ctx, insertMessageNotifySQL, insertMessageNotifyArgs(m)...)
+	if err != nil {
+		p.logger.Error("InsertMessageIdempotent: insert message fail", zap.Error(err))
+		return nil, false, err
+	}
+	// a concurrent request with the same key blocks here until the first one commits,
+	// an expired key is taken over as if it was never used
+	ct, err := tx.Exec(ctx, `
+		INSERT INTO idempotency_keys (key, request_hash, message_id, response)
+		VALUES ($1,$2,$3,$4)
+		ON CONFLICT (key) DO UPDATE SET request_hash=EXCLUDED.request_hash, message_id=EXCLUDED.message_id,
+			response=EXCLUDED.response, created_at=now()
+		WHERE $5::float8 > 0 AND idempotency_keys.created_at < now() - make_interval(secs => $5::float8)
+	`, key, requestHash, m.ID, response, ttl.Seconds())
+	if err != nil {
+		p.logger.Error("InsertMessageIdempotent: insert key fail", zap.Error(err))
+		return nil, false, err
+	}
+	if ct.RowsAffected() == 1 {
+		if err := tx.Commit(ctx); err != nil {
+			p.logger.Error("InsertMessageIdempotent: commit fail", zap.Error(err))
+			return nil, false, err
+		}
+		return m, false, nil
+	}
+
+	// key already used, drop our insert and replay the stored response
+	if err := tx.Rollback(ctx); err != nil {
+		p.logger.Error("InsertMessageIdempotent: rollback fail", zap.Error(err))
+		return nil, false, err
+	}
+	var storedHash string
+	var storedResponse []byte
+	err = p.pool.QueryRow(ctx, `
+		SELECT request_hash, response FROM idempotency_keys WHERE key=$1
+	`, key).Scan(&storedHash, &storedResponse)
 	if err != nil {
-		p.logger.Error("ListSent query fail", zap.Error(err))
+		p.logger.Error("InsertMessageIdempotent: select key fail", zap.Error(err))
+		return nil, false, err
+	}
+	if storedHash != requestHash {
+		p.logger.Warn("InsertMessageIdempotent: key reused with a different request", zap.String("key", key))
+		return nil, false, storage.ErrIdempotencyConflict
+	}
+	var orig model.Message
+	if err := json.Unmarshal(storedResponse, &orig); err != nil {
+		return nil, false, fmt.Errorf("unmarshal stored response: %w", err)
+	}
+	p.logger.Info("InsertMessageIdempotent: replayed", zap.String("key", key), zap.String("id", orig.ID.String()))
+	return &orig, true, nil
+}
+
+// Listen calls onNotify whenever due messages are inserted, until ctx is done.
+// It holds a dedicated connection and reconnects with backoff when it drops,
+// onNotify is also called after a reconnect as notifications may have been missed.
+func (p *Postgres) Listen(ctx context.Context, onNotify func()) error {
+	delay := listenRetryMin
+	for reconnect := false; ; reconnect = true {
+		connected, err := p.listen(ctx, onNotify, reconnect)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			delay = listenRetryMin
+		}
+		p.logger.Warn("Listen: connection lost, reconnecting", zap.Error(err), zap.Duration("retry_in", delay))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, listenRetryMax)
+	}
+}
+
+// listen LISTENs on a new connection until it fails
+func (p *Postgres) listen(ctx context.Context, onNotify func(), reconnect bool) (connected bool, err error) {
+	conn, err := pgx.ConnectConfig(ctx, p.pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = conn.Close(context.Background())
+	}()
+	if _, err := conn.Exec(ctx, "LISTEN "+NotifyChannel); err != nil {
+		return false, err
+	}
+	p.logger.Info("Listen: listening", zap.String("channel", NotifyChannel))
+	if reconnect {
+		onNotify()
+	}
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return true, err
+		}
+		onNotify()
+	}
+}
+
+// CountByStatus counts messages by status
+func (p *Postgres) CountByStatus(ctx context.Context) (map[model.Status]int, error) {
+	rows, err := p.pool.Query(ctx, `SELECT status, count(*) FROM messages GROUP BY status`)
+	if err != nil {
+		p.logger.Error("CountByStatus query fail", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[model.Status]int)
+	for rows.Next() {
+		var st model.Status
+		var n int
+		if err := rows.Scan(&st, &n); err != nil {
+			p.logger.Error("CountByStatus scan fail", zap.Error(err))
+			return nil, err
+		}
+		counts[st] = n
+	}
+	if err := rows.Err(); err != nil {
+		p.logger.Error("CountByStatus rows fail", zap.Error(err))
+		return nil, err
+	}
+	return counts, nil
+}
+
+// ListMessages lists messages matching the filter
+func (p *Postgres) ListMessages(ctx context.Context, f storage.MessageFilter) ([]model.Message, error) {
+	p.logger.Info("ListMessages", zap.Any("filter", f))
+	var (
+		where []string
+		args  []any
+	)
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if len(f.Statuses) > 0 {
+		statuses := make([]string, len(f.Statuses))
+		for i, st := range f.Statuses {
+			statuses[i] = string(st)
+		}
+		where = append(where, "status = ANY("+arg(statuses)+")")
+	}
+	if f.To != "" {
+		where = append(where, `"to" = `+arg(f.To))
+	}
+	if f.CreatedFrom != nil {
+		where = append(where, "created_at >= "+arg(*f.CreatedFrom))
+	}
+	if f.CreatedTo != nil {
+		where = append(where, "created_at < "+arg(*f.CreatedTo))
+	}
+	if f.SentFrom != nil {
+		where = append(where, "sent_at >= "+arg(*f.SentFrom))
+	}
+	if f.SentTo != nil {
+		where = append(where, "sent_at < "+arg(*f.SentTo))
+	}
+
+	query := `SELECT ` + messageColumns + ` FROM messages`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	if sentOnly(f.Statuses) {
+		query += ` ORDER BY sent_at DESC NULLS LAST`
+	} else {
+		query += ` ORDER BY created_at DESC`
+	}
+	query += ` LIMIT ` + arg(f.Limit) + ` OFFSET ` + arg(f.Offset)
+
+	rows, err := p.pool.Query(ctx, query, args...)
+	if err != nil {
+		p.logger.Error("ListMessages query fail", zap.Error(err))
 		return nil, err
 	}
 	defer rows.Close()
 	var out []model.Message
 	for rows.Next() {
 		var m model.Message
-		if err := rows.Scan(&m.ID, &m.To, &m.Content, &m.Status, &m.AttemptCount, &m.CreatedAt, &m.UpdatedAt, &m.SentAt, &m.LastError); err != nil {
-			p.logger.Error("ListSent scan fail", zap.Error(err))
+		if err := scanMessage(rows, &m); err != nil {
+			p.logger.Error("ListMessages scan fail", zap.Error(err))
 			return nil, err
 		}
 		out = append(out, m)
 	}
-	p.logger.Info("ListSent - fetched", zap.Int("results", len(out)))
+	p.logger.Info("ListMessages - fetched", zap.Int("results", len(out)))
 	return out, rows.Err()
 }
 
-// FetchUnsent fetches unsent messages for update
-func (p *Postgres) FetchUnsent(ctx context.Context, n int) ([]model.Message, error) {
-	p.logger.Debug("FetchUnsent", zap.Int("batch", n))
-	tx, err := p.pool.Begin(ctx)
+// sentOnly reports whether statuses only has sent statuses, which are listed by sent_at
+func sentOnly(statuses []model.Status) bool {
+	if len(statuses) == 0 {
+		return false
+	}
+	for _, st := range statuses {
+		if !st.Sent() {
+			return false
+		}
+	}
+	return true
+}
+
+// GetMessage returns a message by id
+func (p *Postgres) GetMessage(ctx context.Context, id string) (*model.Message, error) {
+	p.logger.Debug("GetMessage", zap.String("id", id))
+	var m model.Message
+	err := scanMessage(p.pool.QueryRow(ctx, `
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE id=$1
+	`, id), &m)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
 	if err != nil {
-		p.logger.Error("FetchUnsent: begin fail", zap.Error(err))
+		p.logger.Error("GetMessage query fail", zap.Error(err))
 		return nil, err
 	}
-	defer func() {
-		_ = tx.Rollback(ctx)
-	}()
-	rows, err := tx.Query(ctx, `
-		SELECT id, "to", content, status, attempt_count, created_at, updated_at, sent_at, last_error
+	return &m, nil
+}
+
+// GetMessageByProviderID returns a message by its provider message id
+func (p *Postgres) GetMessageByProviderID(ctx context.Context, providerMessageID string) (*model.Message, error) {
+	p.logger.Debug("GetMessageByProviderID", zap.String("provider_message_id", providerMessageID))
+	var m model.Message
+	err := scanMessage(p.pool.QueryRow(ctx, `
+		SELECT `+messageColumns+`
 		FROM messages
-		WHERE status='unsent'
-		ORDER BY created_at ASC
-		FOR UPDATE SKIP LOCKED
-		LIMIT $1
-	`, n)
+		WHERE provider_message_id=$1
+		ORDER BY sent_at DESC NULLS LAST
+		LIMIT 1
+	`, providerMessageID), &m)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		p.logger.Error("GetMessageByProviderID query fail", zap.Error(err))
+		return nil, err
+	}
+	return &m, nil
+}
+
+// RequeueFailed moves a dead-lettered message back to the queue
+// and resets its attempt count
+func (p *Postgres) RequeueFailed(ctx context.Context, id string) (*model.Message, error) {
+	p.logger.Info("RequeueFailed", zap.String("id", id))
+	var m model.Message
+	err := scanMessage(p.pool.QueryRow(ctx, `
+		UPDATE messages SET status='unsent', attempt_count=0, next_attempt_at=now(), updated_at=now()
+		WHERE id=$1 AND status='failed'
+		RETURNING `+messageColumns+`
+	`, id), &m)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// tell a missing message apart from one that is not dead-lettered
+		if _, err := p.GetMessage(ctx, id); err != nil {
+			return nil, err
+		}
+		p.logger.Warn("RequeueFailed: message is not failed", zap.String("id", id))
+		return nil, storage.ErrStatusConflict
+	}
+	if err != nil {
+		p.logger.Error("RequeueFailed update fail", zap.Error(err))
+		return nil, err
+	}
+	return &m, nil
+}
+
+// CancelMessage cancels an unsent message
+func (p *Postgres) CancelMessage(ctx context.Context, id string) (*model.Message, error) {
+	p.logger.Info("CancelMessage", zap.String("id", id))
+	var m model.Message
+	err := scanMessage(p.pool.QueryRow(ctx, `
+		UPDATE messages SET status='cancelled', updated_at=now()
+		WHERE id=$1 AND status='unsent'
+		RETURNING `+messageColumns+`
+	`, id), &m)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if _, err := p.GetMessage(ctx, id); err != nil {
+			return nil, err
+		}
+		p.logger.Warn("CancelMessage: message is not unsent", zap.String("id", id))
+		return nil, storage.ErrStatusConflict
+	}
+	if err != nil {
+		p.logger.Error("CancelMessage update fail", zap.Error(err))
+		return nil, err
+	}
+	return &m, nil
+}
+
+// RecordReceipt applies a delivery receipt to a sent message,
+// a repeated receipt with the same status is accepted again
+func (p *Postgres) RecordReceipt(ctx context.Context, id string, status model.Status, deliveredAt time.Time, lastErr *string) (*model.Message, error) {
+	p.logger.Info("RecordReceipt", zap.String("id", id), zap.String("status", string(status)))
+	var m model.Message
+	err := scanMessage(p.pool.QueryRow(ctx, `
+		UPDATE messages
+		SET status=$2,
+			delivered_at=CASE WHEN $2='delivered' THEN $3::timestamptz END,
+			last_error=COALESCE($4, last_error),
+			receipt_at=now(), updated_at=now()
+		WHERE id=$1 AND status IN ('sent', $2)
+		RETURNING `+messageColumns+`
+	`, id, string(status), deliveredAt, lastErr), &m)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if _, err := p.GetMessage(ctx, id); err != nil {
+			return nil, err
+		}
+		p.logger.Warn("RecordReceipt: message is not sent", zap.String("id", id))
+		return nil, storage.ErrStatusConflict
+	}
+	if err != nil {
+		p.logger.Error("RecordReceipt update fail", zap.Error(err))
+		return nil, err
+	}
+	return &m, nil
+}
+
+// FetchUnsent claims up to n messages for owner and returns them.
+// Unsent messages that are due (send_at reached, retry backoff elapsed)
+// and messages whose lease has expired are eligible, oldest due first,
+// claimed rows move to 'sending' until lease elapses so that other
+// replicas skip them.
+func (p *Postgres) FetchUnsent(ctx context.Context, owner string, n int, lease time.Duration) ([]model.Message, error) {
+	p.logger.Debug("FetchUnsent", zap.String("owner", owner), zap.Int("batch", n), zap.Duration("lease", lease))
+	rows, err := p.pool.Query(ctx, `
+		UPDATE messages
+		SET status='sending', lease_owner=$1, lease_expires_at=now() + make_interval(secs => $3), updated_at=now()
+		WHERE id IN (
+			SELECT id
+			FROM messages
+			WHERE (status='unsent' AND next_attempt_at <= now())
+				OR (status='sending' AND lease_expires_at < now())
+			ORDER BY next_attempt_at ASC, created_at ASC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+messageColumns+`
+	`, owner, n, lease.Seconds())
 	if err != nil {
 		p.logger.Error("FetchUnsent: query fail", zap.Error(err))
 		return nil, err
@@ -110,48 +494,107 @@ func (p *Postgres) FetchUnsent(ctx context.Context, n int) ([]model.Message, err
 	var out []model.Message
 	for rows.Next() {
 		var m model.Message
-		if err := rows.Scan(&m.ID, &m.To, &m.Content, &m.Status, &m.AttemptCount, &m.CreatedAt, &m.UpdatedAt, &m.SentAt, &m.LastError); err != nil {
+		if err := scanMessage(rows, &m); err != nil {
 			p.logger.Error("FetchUnsent: scan fail", zap.Error(err))
 			return nil, err
 		}
 		out = append(out, m)
 	}
-	p.logger.Debug("FetchUnsent - fetched", zap.Int("count", len(out)))
-	if err := tx.Commit(ctx); err != nil {
-		p.logger.Error("FetchUnsent: commit fail", zap.Error(err))
+	if err := rows.Err(); err != nil {
+		p.logger.Error("FetchUnsent: rows fail", zap.Error(err))
 		return nil, err
 	}
+	// RETURNING does not keep the subquery order
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].NextAttemptAt.Equal(out[j].NextAttemptAt) {
+			return out[i].NextAttemptAt.Before(out[j].NextAttemptAt)
+		}
+		return out[i].CreatedAt.Before(out[j].CreatedAt)
+	})
+	p.logger.Debug("FetchUnsent - claimed", zap.Int("count", len(out)))
 	return out, nil
 }
 
-// MarkSent marks a message as sent
-func (p *Postgres) MarkSent(ctx context.Context, id string, sentAt time.Time) error {
-	p.logger.Info("MarkSent", zap.String("id", id), zap.Time("sentAt", sentAt))
+// MarkSent marks a leased message as sent together with the provider's answer
+func (p *Postgres) MarkSent(ctx context.Context, id, owner string, d model.Delivery) error {
+	p.logger.Info("MarkSent", zap.String("id", id), zap.String("owner", owner), zap.Time("sentAt", d.SentAt), zap.String("provider", d.Provider), zap.String("provider_message_id", d.ProviderMessageID))
 	ct, err := p.pool.Exec(ctx, `
-		UPDATE messages SET status='sent', sent_at=$2, updated_at=now()
-		WHERE id=$1 AND status='unsent'
-	`, id, sentAt)
+		UPDATE messages
+		SET status='sent', sent_at=$3, provider_message_id=NULLIF($4, ''), provider_status=$5, provider_latency_ms=$6,
+			provider=NULLIF($7, ''), lease_owner=NULL, lease_expires_at=NULL, updated_at=now()
+		WHERE id=$1 AND status='sending' AND lease_owner=$2
+	`, id, owner, d.SentAt, d.ProviderMessageID, d.ProviderStatus, d.ProviderLatency.Milliseconds(), d.Provider)
 	if err != nil {
 		p.logger.Error("MarkSent update fail", zap.Error(err))
 		return err
 	}
 	p.logger.Info("MarkSent RowsAffected", zap.Int64("rows_affected", ct.RowsAffected()))
 	if ct.RowsAffected() == 0 {
-		p.logger.Warn("MarkSent: no rows updated, possibly already sent", zap.String("id", id))
-		return errors.New("no rows updated (possibly already sent)")
+		p.logger.Warn("MarkSent: no rows updated, lease not held", zap.String("id", id), zap.String("owner", owner))
+		return storage.ErrLeaseLost
 	}
 	return nil
 }
 
-// IncrementAttempt increments the attempt count for a message
-func (p *Postgres) IncrementAttempt(ctx context.Context, id string, lastErr *string) error {
-	p.logger.Info("IncrementAttempt", zap.String("id", id), zap.Stringp("lastErr", lastErr))
-	_, err := p.pool.Exec(ctx, `
-		UPDATE messages SET attempt_count = attempt_count + 1, last_error=$2, updated_at=now()
-		WHERE id=$1
-	`, id, lastErr)
+// IncrementAttempt increments the attempt count for a leased message
+// and returns it to the queue, due again after retryIn
+func (p *Postgres) IncrementAttempt(ctx context.Context, id, owner string, lastErr *string, retryIn time.Duration) error {
+	p.logger.Info("IncrementAttempt", zap.String("id", id), zap.String("owner", owner), zap.Stringp("lastErr", lastErr), zap.Duration("retryIn", retryIn))
+	ct, err := p.pool.Exec(ctx, `
+		UPDATE messages
+		SET status='unsent', attempt_count = attempt_count + 1, last_error=$3,
+			next_attempt_at=now() + make_interval(secs => $4),
+			lease_owner=NULL, lease_expires_at=NULL, updated_at=now()
+		WHERE id=$1 AND status='sending' AND lease_owner=$2
+	`, id, owner, lastErr, retryIn.Seconds())
 	if err != nil {
 		p.logger.Error("IncrementAttempt update fail", zap.Error(err))
+		return err
 	}
-	return err
+	if ct.RowsAffected() == 0 {
+		p.logger.Warn("IncrementAttempt: no rows updated, lease not held", zap.String("id", id), zap.String("owner", owner))
+		return storage.ErrLeaseLost
+	}
+	return nil
+}
+
+// Defer returns a leased message to the queue without charging an attempt,
+// due again after retryIn
+func (p *Postgres) Defer(ctx context.Context, id, owner string, retryIn time.Duration) error {
+	p.logger.Info("Defer", zap.String("id", id), zap.String("owner", owner), zap.Duration("retryIn", retryIn))
+	ct, err := p.pool.Exec(ctx, `
+		UPDATE messages
+		SET status='unsent', next_attempt_at=now() + make_interval(secs => $3),
+			lease_owner=NULL, lease_expires_at=NULL, updated_at=now()
+		WHERE id=$1 AND status='sending' AND lease_owner=$2
+	`, id, owner, retryIn.Seconds())
+	if err != nil {
+		p.logger.Error("Defer update fail", zap.Error(err))
+		return err
+	}
+	if ct.RowsAffected() == 0 {
+		p.logger.Warn("Defer: no rows updated, lease not held", zap.String("id", id), zap.String("owner", owner))
+		return storage.ErrLeaseLost
+	}
+	return nil
+}
+
+// MarkFailed records a final failed attempt for a leased message
+// and moves it to the dead-letter status
+func (p *Postgres) MarkFailed(ctx context.Context, id, owner string, lastErr *string) error {
+	p.logger.Info("MarkFailed", zap.String("id", id), zap.String("owner", owner), zap.Stringp("lastErr", lastErr))
+	ct, err := p.pool.Exec(ctx, `
+		UPDATE messages
+		SET status='failed', attempt_count = attempt_count + 1, last_error=$3, lease_owner=NULL, lease_expires_at=NULL, updated_at=now()
+		WHERE id=$1 AND status='sending' AND lease_owner=$2
+	`, id, owner, lastErr)
+	if err != nil {
+		p.logger.Error("MarkFailed update fail", zap.Error(err))
+		return err
+	}
+	if ct.RowsAffected() == 0 {
+		p.logger.Warn("MarkFailed: no rows updated, lease not held", zap.String("id", id), zap.String("owner", owner))
+		return storage.ErrLeaseLost
+	}
+	return nil
 }
@@ -4,63 +4,522 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/hakan-sariman/insider-assessment/internal/model"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 )
 
 func runMigrations(t *testing.T, pool *pgxpool.Pool) {
-	upPath := filepath.Join("..", "..", "migrations", "001_init.up.sql")
-	b, err := os.ReadFile(upPath)
-	if err != nil {
-		t.Fatalf("read migration: %v", err)
+	upPaths, err := filepath.Glob(filepath.Join("..", "migrations", "*.up.sql"))
+	if err != nil || len(upPaths) == 0 {
+		t.Fatalf("find migrations: %v", err)
 	}
-	if _, err := pool.Exec(context.Background(), string(b)); err != nil {
-		t.Fatalf("apply migration: %v", err)
+	sort.Strings(upPaths)
+	for _, upPath := range upPaths {
+		b, err := os.ReadFile(upPath)
+		if err != nil {
+			t.Fatalf("read migration %s: %v", upPath, err)
+		}
+		if _, err := pool.Exec(context.Background(), string(b)); err != nil {
+			t.Fatalf("apply migration %s: %v", upPath, err)
+		}
 	}
 }
 
-func TestPostgres_CRUD(t *testing.T) {
+func newTestPostgres(t *testing.T) *Postgres {
 	url := os.Getenv("PG_URL")
 	if url == "" {
 		t.Skip("PG_URL not set")
 	}
-	ctx := context.Background()
-	log := zap.NewNop()
-	p, err := New(ctx, url, 3, log)
+	p, err := New(context.Background(), url, 3, zap.NewNop())
 	if err != nil {
 		t.Fatalf("new pg: %v", err)
 	}
-	defer p.Close()
+	t.Cleanup(p.Close)
 	runMigrations(t, p.pool)
+	return p
+}
+
+func TestPostgres_CRUD(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
 
 	msg, _ := model.NewMessage("to", "content")
 	if err := p.InsertMessage(ctx, msg); err != nil {
 		t.Fatalf("insert: %v", err)
 	}
 
-	unsent, err := p.FetchUnsent(ctx, 10)
+	unsent, err := p.FetchUnsent(ctx, "owner-a", 10, time.Minute)
 	if err != nil || len(unsent) == 0 {
 		t.Fatalf("fetch unsent: %v %d", err, len(unsent))
 	}
 
+	if err := p.IncrementAttempt(ctx, msg.ID.String(), "owner-a", nil, 0); err != nil {
+		t.Fatalf("inc attempt: %v", err)
+	}
+
+	if _, err := p.FetchUnsent(ctx, "owner-a", 10, time.Minute); err != nil {
+		t.Fatalf("fetch unsent again: %v", err)
+	}
+
 	sentAt := time.Now().UTC()
-	if err := p.MarkSent(ctx, msg.ID.String(), sentAt); err != nil {
+	if err := p.MarkSent(ctx, msg.ID.String(), "owner-a", model.Delivery{SentAt: sentAt}); err != nil {
 		t.Fatalf("mark sent: %v", err)
 	}
 
-	list, err := p.ListSent(ctx, 10, 0)
+	list, err := p.ListMessages(ctx, storage.MessageFilter{Statuses: []model.Status{model.StatusSent}, Limit: 10})
 	if err != nil || len(list) == 0 {
 		t.Fatalf("list sent: %v %d", err, len(list))
 	}
+}
+
+func TestPostgres_Lease(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
+
+	msg, _ := model.NewMessage("to", "lease")
+	if err := p.InsertMessage(ctx, msg); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	claimed := func(msgs []model.Message) bool {
+		for _, m := range msgs {
+			if m.ID == msg.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	a, err := p.FetchUnsent(ctx, "owner-a", 100, 500*time.Millisecond)
+	if err != nil || !claimed(a) {
+		t.Fatalf("owner-a claim: %v %d", err, len(a))
+	}
+	b, err := p.FetchUnsent(ctx, "owner-b", 100, time.Minute)
+	if err != nil || claimed(b) {
+		t.Fatalf("owner-b must not claim a leased message: %v", err)
+	}
+	if err := p.MarkSent(ctx, msg.ID.String(), "owner-b", model.Delivery{SentAt: time.Now()}); !errors.Is(err, storage.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost for non-holder, got %v", err)
+	}
+
+	// after the lease expires another owner can take over
+	time.Sleep(time.Second)
+	b, err = p.FetchUnsent(ctx, "owner-b", 100, time.Minute)
+	if err != nil || !claimed(b) {
+		t.Fatalf("owner-b reclaim: %v %d", err, len(b))
+	}
+	if err := p.MarkSent(ctx, msg.ID.String(), "owner-a", model.Delivery{SentAt: time.Now()}); !errors.Is(err, storage.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost for expired holder, got %v", err)
+	}
+	if err := p.MarkSent(ctx, msg.ID.String(), "owner-b", model.Delivery{SentAt: time.Now()}); err != nil {
+		t.Fatalf("mark sent: %v", err)
+	}
+}
+
+func TestPostgres_DeadLetter(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
+
+	msg, _ := model.NewMessage("to", "dead")
+	if err := p.InsertMessage(ctx, msg); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := p.RequeueFailed(ctx, msg.ID.String()); !errors.Is(err, storage.ErrStatusConflict) {
+		t.Fatalf("expected ErrStatusConflict for unsent message, got %v", err)
+	}
+	if _, err := p.FetchUnsent(ctx, "owner-a", 1000, time.Minute); err != nil {
+		t.Fatalf("fetch unsent: %v", err)
+	}
+	lastErr := "boom"
+	if err := p.MarkFailed(ctx, msg.ID.String(), "owner-a", &lastErr); err != nil {
+		t.Fatalf("mark failed: %v", err)
+	}
+
+	got, err := p.GetMessage(ctx, msg.ID.String())
+	if err != nil || got.Status != model.StatusFailed || got.AttemptCount != 1 {
+		t.Fatalf("get failed message: %v %#v", err, got)
+	}
+	list, err := p.ListMessages(ctx, storage.MessageFilter{Statuses: []model.Status{model.StatusFailed}, Limit: 10})
+	if err != nil || len(list) == 0 {
+		t.Fatalf("list failed: %v %d", err, len(list))
+	}
+
+	requeued, err := p.RequeueFailed(ctx, msg.ID.String())
+	if err != nil || requeued.Status != model.StatusUnsent || requeued.AttemptCount != 0 {
+		t.Fatalf("requeue: %v %#v", err, requeued)
+	}
+	if _, err := p.GetMessage(ctx, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPostgres_Backoff(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
 
-	if err := p.IncrementAttempt(ctx, msg.ID.String(), nil); err != nil {
+	msg, _ := model.NewMessage("to", "backoff")
+	if err := p.InsertMessage(ctx, msg); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := p.FetchUnsent(ctx, "owner-a", 1000, time.Minute); err != nil {
+		t.Fatalf("fetch unsent: %v", err)
+	}
+	if err := p.IncrementAttempt(ctx, msg.ID.String(), "owner-a", nil, time.Hour); err != nil {
 		t.Fatalf("inc attempt: %v", err)
 	}
+	msgs, err := p.FetchUnsent(ctx, "owner-a", 1000, time.Minute)
+	if err != nil {
+		t.Fatalf("fetch unsent: %v", err)
+	}
+	for _, m := range msgs {
+		if m.ID == msg.ID {
+			t.Fatalf("message must not be claimed before its next attempt is due")
+		}
+	}
+	got, err := p.GetMessage(ctx, msg.ID.String())
+	if err != nil || !got.NextAttemptAt.After(time.Now().Add(50*time.Minute)) {
+		t.Fatalf("unexpected next attempt: %v %v", err, got)
+	}
+}
+
+func TestPostgres_SendAt(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
+
+	msg, _ := model.NewMessage("to", "scheduled")
+	msg.ScheduleAt(time.Now().Add(time.Hour))
+	if err := p.InsertMessage(ctx, msg); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	msgs, err := p.FetchUnsent(ctx, "owner-a", 1000, time.Minute)
+	if err != nil {
+		t.Fatalf("fetch unsent: %v", err)
+	}
+	for _, m := range msgs {
+		if m.ID == msg.ID {
+			t.Fatalf("scheduled message must not be claimed before send_at")
+		}
+	}
+	got, err := p.GetMessage(ctx, msg.ID.String())
+	if err != nil || got.SendAt == nil || got.SendAt.Sub(*msg.SendAt).Abs() > time.Millisecond {
+		t.Fatalf("send_at not persisted: %v %v", err, got)
+	}
+}
+
+func TestPostgres_CancelAndFilter(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
+
+	to := "+90" + time.Now().Format("150405.000000")
+	msg, _ := model.NewMessage(to, "cancel me")
+	msg.ScheduleAt(time.Now().Add(time.Hour))
+	if err := p.InsertMessage(ctx, msg); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	cancelled, err := p.CancelMessage(ctx, msg.ID.String())
+	if err != nil || cancelled.Status != model.StatusCancelled {
+		t.Fatalf("cancel: %v %#v", err, cancelled)
+	}
+	if _, err := p.CancelMessage(ctx, msg.ID.String()); !errors.Is(err, storage.ErrStatusConflict) {
+		t.Fatalf("expected ErrStatusConflict, got %v", err)
+	}
+
+	from := msg.CreatedAt.Add(-time.Minute)
+	list, err := p.ListMessages(ctx, storage.MessageFilter{
+		Statuses:    []model.Status{model.StatusCancelled, model.StatusUnsent},
+		To:          to,
+		CreatedFrom: &from,
+		Limit:       10,
+	})
+	if err != nil || len(list) != 1 || list[0].ID != msg.ID {
+		t.Fatalf("list filtered: %v %#v", err, list)
+	}
+	list, err = p.ListMessages(ctx, storage.MessageFilter{Statuses: []model.Status{model.StatusSent}, To: to, Limit: 10})
+	if err != nil || len(list) != 0 {
+		t.Fatalf("list sent for recipient: %v %d", err, len(list))
+	}
+}
+
+func TestPostgres_InsertMessageIdempotent(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
+
+	key := "it-" + time.Now().Format(time.RFC3339Nano)
+	first, _ := model.NewMessage("to", "once")
+	got, replayed, err := p.InsertMessageIdempotent(ctx, first, key, "hash-a", time.Hour)
+	if err != nil || replayed || got.ID != first.ID {
+		t.Fatalf("first insert: %v %v %v", err, replayed, got)
+	}
+
+	retry, _ := model.NewMessage("to", "once")
+	got, replayed, err = p.InsertMessageIdempotent(ctx, retry, key, "hash-a", time.Hour)
+	if err != nil || !replayed || got.ID != first.ID {
+		t.Fatalf("replay: %v %v %v", err, replayed, got)
+	}
+	if _, err := p.GetMessage(ctx, retry.ID.String()); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("replayed request must not insert a message, got %v", err)
+	}
+
+	other, _ := model.NewMessage("to", "different")
+	if _, _, err := p.InsertMessageIdempotent(ctx, other, key, "hash-b", time.Hour); !errors.Is(err, storage.ErrIdempotencyConflict) {
+		t.Fatalf("expected ErrIdempotencyConflict, got %v", err)
+	}
+
+	// an expired key is taken over by the next request
+	if _, err := p.pool.Exec(ctx, `UPDATE idempotency_keys SET created_at = now() - interval '2 hours' WHERE key=$1`, key); err != nil {
+		t.Fatalf("age key: %v", err)
+	}
+	got, replayed, err = p.InsertMessageIdempotent(ctx, other, key, "hash-b", time.Hour)
+	if err != nil || replayed || got.ID != other.ID {
+		t.Fatalf("expired key: %v %v %v", err, replayed, got)
+	}
+	got, replayed, err = p.InsertMessageIdempotent(ctx, retry, key, "hash-b", time.Hour)
+	if err != nil || !replayed || got.ID != other.ID {
+		t.Fatalf("replay after takeover: %v %v %v", err, replayed, got)
+	}
+}
+
+func TestPostgres_InsertMessages(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
+
+	var msgs []*model.Message
+	for i := 0; i < 3; i++ {
+		m, _ := model.NewMessage("to", "bulk")
+		msgs = append(msgs, m)
+	}
+	msgs[2].ScheduleAt(time.Now().Add(time.Hour))
+	if err := p.InsertMessages(ctx, msgs); err != nil {
+		t.Fatalf("insert messages: %v", err)
+	}
+	for _, m := range msgs {
+		got, err := p.GetMessage(ctx, m.ID.String())
+		if err != nil || got.Status != model.StatusUnsent {
+			t.Fatalf("get %s: %v %v", m.ID, err, got)
+		}
+	}
+	got, _ := p.GetMessage(ctx, msgs[2].ID.String())
+	if got.SendAt == nil {
+		t.Fatalf("send_at not copied")
+	}
+}
+
+func TestPostgres_MarkSentDelivery(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
+
+	msg, _ := model.NewMessage("to", "delivery")
+	if err := p.InsertMessage(ctx, msg); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := p.FetchUnsent(ctx, "owner-a", 1000, time.Minute); err != nil {
+		t.Fatalf("fetch unsent: %v", err)
+	}
+	providerID := "prov-" + msg.ID.String()
+	d := model.Delivery{Provider: "primary", ProviderMessageID: providerID, ProviderStatus: 202, ProviderLatency: 42 * time.Millisecond, SentAt: time.Now()}
+	if err := p.MarkSent(ctx, msg.ID.String(), "owner-a", d); err != nil {
+		t.Fatalf("mark sent: %v", err)
+	}
+
+	got, err := p.GetMessageByProviderID(ctx, providerID)
+	if err != nil || got.ID != msg.ID {
+		t.Fatalf("get by provider id: %v %v", err, got)
+	}
+	if got.ProviderStatus == nil || *got.ProviderStatus != 202 || got.ProviderLatencyMs == nil || *got.ProviderLatencyMs != 42 ||
+		got.Provider == nil || *got.Provider != "primary" {
+		t.Fatalf("delivery metadata not persisted: %#v", got)
+	}
+	if _, err := p.GetMessageByProviderID(ctx, "missing-"+providerID); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPostgres_RecordReceipt(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
+
+	msg, _ := model.NewMessage("to", "receipt")
+	if err := p.InsertMessage(ctx, msg); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	deliveredAt := time.Now().UTC()
+	if _, err := p.RecordReceipt(ctx, msg.ID.String(), model.StatusDelivered, deliveredAt, nil); !errors.Is(err, storage.ErrStatusConflict) {
+		t.Fatalf("expected ErrStatusConflict for unsent message, got %v", err)
+	}
+	if _, err := p.FetchUnsent(ctx, "owner-a", 1000, time.Minute); err != nil {
+		t.Fatalf("fetch unsent: %v", err)
+	}
+	if err := p.MarkSent(ctx, msg.ID.String(), "owner-a", model.Delivery{SentAt: time.Now()}); err != nil {
+		t.Fatalf("mark sent: %v", err)
+	}
+
+	got, err := p.RecordReceipt(ctx, msg.ID.String(), model.StatusDelivered, deliveredAt, nil)
+	if err != nil || got.Status != model.StatusDelivered || got.DeliveredAt == nil || got.ReceiptAt == nil {
+		t.Fatalf("record receipt: %v %#v", err, got)
+	}
+	if _, err := p.RecordReceipt(ctx, msg.ID.String(), model.StatusDelivered, deliveredAt, nil); err != nil {
+		t.Fatalf("repeated receipt: %v", err)
+	}
+	if _, err := p.RecordReceipt(ctx, msg.ID.String(), model.StatusUndelivered, deliveredAt, nil); !errors.Is(err, storage.ErrStatusConflict) {
+		t.Fatalf("expected ErrStatusConflict for a conflicting receipt, got %v", err)
+	}
+}
+
+func TestPostgres_ListenNotify(t *testing.T) {
+	p := newTestPostgres(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notified := make(chan struct{}, 10)
+	go func() {
+		_ = p.Listen(ctx, func() { notified <- struct{}{} })
+	}()
+	// give the listener time to connect
+	time.Sleep(200 * time.Millisecond)
+
+	scheduled, _ := model.NewMessage("to", "later")
+	scheduled.ScheduleAt(time.Now().Add(time.Hour))
+	if err := p.InsertMessage(ctx, scheduled); err != nil {
+		t.Fatalf("insert scheduled: %v", err)
+	}
+	due, _ := model.NewMessage("to", "now")
+	if err := p.InsertMessage(ctx, due); err != nil {
+		t.Fatalf("insert due: %v", err)
+	}
+	select {
+	case <-notified:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a notification for a due message")
+	}
+	select {
+	case <-notified:
+		t.Fatal("a scheduled message must not notify")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPostgres_Defer(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPostgres(t)
+
+	msg, _ := model.NewMessage("to", "defer")
+	if err := p.InsertMessage(ctx, msg); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := p.FetchUnsent(ctx, "owner-a", 1000, time.Minute); err != nil {
+		t.Fatalf("fetch unsent: %v", err)
+	}
+	if err := p.Defer(ctx, msg.ID.String(), "owner-b", time.Hour); !errors.Is(err, storage.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost for non-holder, got %v", err)
+	}
+	if err := p.Defer(ctx, msg.ID.String(), "owner-a", time.Hour); err != nil {
+		t.Fatalf("defer: %v", err)
+	}
+	got, err := p.GetMessage(ctx, msg.ID.String())
+	if err != nil || got.Status != model.StatusUnsent || got.AttemptCount != 0 || !got.NextAttemptAt.After(time.Now().Add(50*time.Minute)) {
+		t.Fatalf("unexpected deferred message: %v %#v", err, got)
+	}
+}
+
+func TestPostgres_LeaderElection(t *testing.T) {
+	p := newTestPostgres(t)
+	ctx := context.Background()
+
+	campaign := func(id string) (chan bool, context.CancelFunc) {
+		changes := make(chan bool, 4)
+		cctx, cancel := context.WithCancel(ctx)
+		go func() {
+			_ = p.Campaign(cctx, id, 100*time.Millisecond, func(leader bool) { changes <- leader })
+		}()
+		return changes, cancel
+	}
+	expect := func(changes chan bool, want bool) {
+		t.Helper()
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Fatalf("expected leader=%v, got %v", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected leader=%v", want)
+		}
+	}
+
+	a, stopA := campaign("replica-a")
+	expect(a, true)
+	b, stopB := campaign("replica-b")
+	defer stopB()
+	if id, err := p.Leader(ctx); err != nil || id != "replica-a" {
+		t.Fatalf("expected replica-a to lead, got %q %v", id, err)
+	}
+
+	// stopping the leader hands over
+	stopA()
+	expect(a, false)
+	expect(b, true)
+	if id, err := p.Leader(ctx); err != nil || id != "replica-b" {
+		t.Fatalf("expected replica-b to lead, got %q %v", id, err)
+	}
+}
+
+func TestPostgres_SchedulerState(t *testing.T) {
+	p := newTestPostgres(t)
+	ctx := context.Background()
+
+	if _, err := p.pool.Exec(ctx, `DELETE FROM scheduler_state`); err != nil {
+		t.Fatalf("reset scheduler state: %v", err)
+	}
+	if _, err := p.GetSchedulerState(ctx); !errors.Is(err, storage.ErrNoSchedulerState) {
+		t.Fatalf("expected ErrNoSchedulerState, got %v", err)
+	}
+
+	// tuning first creates a running state
+	tuned, err := p.SetSchedulerTuning(ctx, model.SchedulerState{IntervalMs: 30_000, BatchSize: 10, UpdatedBy: "replica-a"})
+	if err != nil || !tuned.Running || tuned.IntervalMs != 30_000 || tuned.BatchSize != 10 {
+		t.Fatalf("set tuning: %v %#v", err, tuned)
+	}
+	// a zero setting keeps the stored one
+	tuned, err = p.SetSchedulerTuning(ctx, model.SchedulerState{BatchSize: 10, UpdatedBy: "replica-b"})
+	if err != nil || tuned.IntervalMs != 30_000 || tuned.BatchSize != 10 || tuned.UpdatedBy != "replica-b" {
+		t.Fatalf("set batch size only: %v %#v", err, tuned)
+	}
+
+	for _, running := range []bool{false, true} {
+		set, err := p.SetSchedulerState(ctx, model.SchedulerState{Running: running, Reason: "test", UpdatedBy: "replica-a"})
+		if err != nil || set.Running != running || set.UpdatedAt.IsZero() || set.IntervalMs != 30_000 || set.BatchSize != 10 {
+			t.Fatalf("set running=%v: %v %#v", running, err, set)
+		}
+		got, err := p.GetSchedulerState(ctx)
+		if err != nil || *got != *set {
+			t.Fatalf("expected %#v, got %#v %v", set, got, err)
+		}
+	}
+}
+
+func TestPostgres_CountByStatus(t *testing.T) {
+	p := newTestPostgres(t)
+	ctx := context.Background()
+
+	before, err := p.CountByStatus(ctx)
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	msg, _ := model.NewMessage("to", "content")
+	if err := p.InsertMessage(ctx, msg); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	after, err := p.CountByStatus(ctx)
+	if err != nil || after[model.StatusUnsent] != before[model.StatusUnsent]+1 {
+		t.Fatalf("expected one more unsent message, got %v -> %v %v", before, after, err)
+	}
 }
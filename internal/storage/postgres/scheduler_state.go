@@ -0,0 +1,72 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hakan-sariman/insider-assessment/internal/model"
+	"github.com/hakan-sariman/insider-assessment/internal/storage"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+// schedulerStateColumns is the column list scanned by scanSchedulerState
+const schedulerStateColumns = `running, COALESCE(reason, ''), COALESCE(interval_ms, 0), COALESCE(batch_size, 0), COALESCE(updated_by, ''), updated_at`
+
+func scanSchedulerState(row pgx.Row, st *model.SchedulerState) error {
+	return row.Scan(&st.Running, &st.Reason, &st.IntervalMs, &st.BatchSize, &st.UpdatedBy, &st.UpdatedAt)
+}
+
+// GetSchedulerState returns the desired scheduler state
+func (p *Postgres) GetSchedulerState(ctx context.Context) (*model.SchedulerState, error) {
+	var st model.SchedulerState
+	err := scanSchedulerState(p.pool.QueryRow(ctx, `SELECT `+schedulerStateColumns+` FROM scheduler_state WHERE id`), &st)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, storage.ErrNoSchedulerState
+	}
+	if err != nil {
+		p.logger.Error("GetSchedulerState query fail", zap.Error(err))
+		return nil, err
+	}
+	return &st, nil
+}
+
+// SetSchedulerState stores the desired running state
+func (p *Postgres) SetSchedulerState(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error) {
+	p.logger.Info("SetSchedulerState", zap.Bool("running", st.Running), zap.String("reason", st.Reason), zap.String("by", st.UpdatedBy))
+	var out model.SchedulerState
+	err := scanSchedulerState(p.pool.QueryRow(ctx, `
+		INSERT INTO scheduler_state (id, running, reason, updated_by, updated_at)
+		VALUES (TRUE, $1, NULLIF($2, ''), NULLIF($3, ''), now())
+		ON CONFLICT (id) DO UPDATE SET running=EXCLUDED.running, reason=EXCLUDED.reason,
+			updated_by=EXCLUDED.updated_by, updated_at=EXCLUDED.updated_at
+		RETURNING `+schedulerStateColumns+`
+	`, st.Running, st.Reason, st.UpdatedBy), &out)
+	if err != nil {
+		p.logger.Error("SetSchedulerState upsert fail", zap.Error(err))
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetSchedulerTuning stores the interval and batch size, zero ones are left as stored
+func (p *Postgres) SetSchedulerTuning(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error) {
+	p.logger.Info("SetSchedulerTuning", zap.Int64("interval_ms", st.IntervalMs), zap.Int("batch_size", st.BatchSize), zap.String("by", st.UpdatedBy))
+	var out model.SchedulerState
+	// the scheduler runs until a state is set, a new row keeps it running
+	err := scanSchedulerState(p.pool.QueryRow(ctx, `
+		INSERT INTO scheduler_state (id, running, interval_ms, batch_size, updated_by, updated_at)
+		VALUES (TRUE, TRUE, NULLIF($1, 0), NULLIF($2, 0), NULLIF($3, ''), now())
+		ON CONFLICT (id) DO UPDATE SET
+			interval_ms=COALESCE(EXCLUDED.interval_ms, scheduler_state.interval_ms),
+			batch_size=COALESCE(EXCLUDED.batch_size, scheduler_state.batch_size),
+			updated_by=EXCLUDED.updated_by, updated_at=EXCLUDED.updated_at
+		RETURNING `+schedulerStateColumns+`
+	`, st.IntervalMs, st.BatchSize, st.UpdatedBy), &out)
+	if err != nil {
+		p.logger.Error("SetSchedulerTuning upsert fail", zap.Error(err))
+		return nil, err
+	}
+	return &out, nil
+}
@@ -2,16 +2,85 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/hakan-sariman/insider-assessment/internal/model"
 )
 
+var (
+	// ErrLeaseLost is returned when the caller no longer holds the lease of a message
+	ErrLeaseLost = errors.New("message lease lost")
+	// ErrNotFound is returned when a message does not exist
+	ErrNotFound = errors.New("message not found")
+	// ErrStatusConflict is returned when a message is not in the status an operation requires
+	ErrStatusConflict = errors.New("message status conflict")
+	// ErrIdempotencyConflict is returned when an idempotency key is reused for a different request
+	ErrIdempotencyConflict = errors.New("idempotency key reused with a different request")
+	// ErrNoSchedulerState is returned when the desired scheduler state was never set
+	ErrNoSchedulerState = errors.New("scheduler state not set")
+)
+
+// MessageFilter narrows down ListMessages, zero fields do not filter
+type MessageFilter struct {
+	Statuses    []model.Status
+	To          string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	SentFrom    *time.Time
+	SentTo      *time.Time
+	Limit       int
+	Offset      int
+}
+
 type Storage interface {
 	InsertMessage(ctx context.Context, m *model.Message) error
-	ListSent(ctx context.Context, limit, offset int) ([]model.Message, error)
-	FetchUnsent(ctx context.Context, n int) ([]model.Message, error)
-	MarkSent(ctx context.Context, id string, sentAt time.Time) error
-	IncrementAttempt(ctx context.Context, id string, lastErr *string) error
+	// InsertMessages inserts all messages in one round trip, either all or none are stored
+	InsertMessages(ctx context.Context, msgs []*model.Message) error
+	// InsertMessageIdempotent inserts m under an idempotency key. When the key was
+	// already used for the same request hash the original message is returned with
+	// replayed set, ErrIdempotencyConflict if it was used for a different request.
+	// Keys older than ttl are expired and taken over by m, zero keeps them forever.
+	InsertMessageIdempotent(ctx context.Context, m *model.Message, key, requestHash string, ttl time.Duration) (orig *model.Message, replayed bool, err error)
+	// ListMessages lists messages matching the filter, newest first
+	// (by sent_at when only sent messages are listed)
+	ListMessages(ctx context.Context, f MessageFilter) ([]model.Message, error)
+	// CountByStatus returns the number of messages in each status, statuses without messages are left out
+	CountByStatus(ctx context.Context) (map[model.Status]int, error)
+	// GetMessage returns a message by id, ErrNotFound if it does not exist
+	GetMessage(ctx context.Context, id string) (*model.Message, error)
+	// GetMessageByProviderID returns a message by the id the provider gave it, ErrNotFound if none
+	GetMessageByProviderID(ctx context.Context, providerMessageID string) (*model.Message, error)
+	// RequeueFailed moves a dead-lettered message back to the queue with its attempts reset,
+	// ErrNotFound if it does not exist and ErrStatusConflict if it is not failed
+	RequeueFailed(ctx context.Context, id string) (*model.Message, error)
+	// RecordReceipt moves a sent message to delivered or undelivered,
+	// ErrNotFound if it does not exist, ErrStatusConflict if it was not sent
+	RecordReceipt(ctx context.Context, id string, status model.Status, deliveredAt time.Time, lastErr *string) (*model.Message, error)
+	// CancelMessage cancels a message that has not been picked up for sending yet,
+	// ErrNotFound if it does not exist and ErrStatusConflict if it is not unsent
+	CancelMessage(ctx context.Context, id string) (*model.Message, error)
+	// FetchUnsent claims up to n due unsent (or lease-expired) messages for owner
+	// and returns them; the claim is held until lease elapses
+	FetchUnsent(ctx context.Context, owner string, n int, lease time.Duration) ([]model.Message, error)
+	// MarkSent marks a leased message as sent and records the provider's answer,
+	// ErrLeaseLost if owner does not hold the lease
+	MarkSent(ctx context.Context, id, owner string, d model.Delivery) error
+	// IncrementAttempt records a failed attempt and releases the lease, the message is due
+	// again after retryIn, ErrLeaseLost if owner does not hold the lease
+	IncrementAttempt(ctx context.Context, id, owner string, lastErr *string, retryIn time.Duration) error
+	// MarkFailed records a final failed attempt and dead-letters the message, ErrLeaseLost if owner does not hold the lease
+	MarkFailed(ctx context.Context, id, owner string, lastErr *string) error
+	// Defer releases the lease without charging an attempt, the message is due
+	// again after retryIn, ErrLeaseLost if owner does not hold the lease
+	Defer(ctx context.Context, id, owner string, retryIn time.Duration) error
+	// GetSchedulerState returns the desired scheduler state shared by all replicas,
+	// ErrNoSchedulerState if it was never set
+	GetSchedulerState(ctx context.Context) (*model.SchedulerState, error)
+	// SetSchedulerState stores the desired running state and returns the scheduler state as stored
+	SetSchedulerState(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error)
+	// SetSchedulerTuning stores the interval and batch size of st and returns the scheduler state as stored,
+	// zero settings and the desired running state are left as they are, running when it was never set
+	SetSchedulerTuning(ctx context.Context, st model.SchedulerState) (*model.SchedulerState, error)
 	Close()
 }